@@ -0,0 +1,231 @@
+package muse
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.sia.tech/siad/modules"
+	"lukechampine.com/us/hostdb"
+)
+
+// validate checks that the entry is a host key, net address, or CIDR subnet.
+func (e AccessEntry) validate() error {
+	switch {
+	case e.Entry == "":
+		return errors.New("empty entry")
+	case strings.HasPrefix(e.Entry, "ed25519:"):
+		if len(e.Entry) != len("ed25519:")+64 {
+			return fmt.Errorf("invalid host key %q", e.Entry)
+		}
+	case strings.Contains(e.Entry, "/"):
+		if _, _, err := net.ParseCIDR(e.Entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupTimeout is how long a DNS lookup of a host's address may take.
+const lookupTimeout = 5 * time.Second
+
+// lookupHostIPs returns the IP addresses of host, which may be an IP address
+// or a hostname.
+func lookupHostIPs(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+// match reports whether the entry matches the specified host, which is
+// reachable at addr and the specified IPs.
+func (e AccessEntry) match(hostKey hostdb.HostPublicKey, addr modules.NetAddress, ips []net.IP) bool {
+	switch {
+	case strings.HasPrefix(e.Entry, "ed25519:"):
+		return hostdb.HostPublicKey(e.Entry) == hostKey
+	case strings.Contains(e.Entry, "/"):
+		_, subnet, err := net.ParseCIDR(e.Entry)
+		if err != nil {
+			return false
+		}
+		for _, ip := range ips {
+			if subnet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	default:
+		return addr != "" && (string(addr) == e.Entry || addr.Host() == e.Entry)
+	}
+}
+
+// accessLists are the server's host blocklist and allowlist. If the allowlist
+// is non-empty, only hosts matching one of its entries are permitted; hosts
+// matching a blocklist entry are never permitted.
+type accessLists struct {
+	block []AccessEntry
+	allow []AccessEntry
+}
+
+// needsIPs reports whether checking a host against list requires its IP
+// addresses.
+func needsIPs(list []AccessEntry) bool {
+	for _, e := range list {
+		if strings.Contains(e.Entry, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns a host_blocked error if the host is not permitted. addr may be
+// empty if the host's address is unknown, in which case only entries that are
+// host keys are considered. If the blocklist contains subnets and addr cannot
+// be resolved, the host is treated as blocked.
+func (al accessLists) check(hostKey hostdb.HostPublicKey, addr modules.NetAddress) error {
+	if len(al.block) == 0 && len(al.allow) == 0 {
+		return nil
+	}
+	var ips []net.IP
+	if addr != "" && (needsIPs(al.block) || needsIPs(al.allow)) {
+		var err error
+		if ips, err = lookupHostIPs(addr.Host()); err != nil && needsIPs(al.block) {
+			return Error{
+				Code:    CodeHostBlocked,
+				Message: fmt.Sprintf("could not resolve %v to check host %v against the blocklist: %v", addr.Host(), hostKey.ShortKey(), err),
+			}
+		}
+	}
+	for _, e := range al.block {
+		if e.match(hostKey, addr, ips) {
+			msg := fmt.Sprintf("host %v is blocked by %v", hostKey.ShortKey(), e.Entry)
+			if e.Reason != "" {
+				msg += " (" + e.Reason + ")"
+			}
+			return Error{Code: CodeHostBlocked, Message: msg}
+		}
+	}
+	if len(al.allow) == 0 {
+		return nil
+	}
+	for _, e := range al.allow {
+		if e.match(hostKey, addr, ips) {
+			return nil
+		}
+	}
+	return Error{Code: CodeHostBlocked, Message: fmt.Sprintf("host %v is not on the allowlist", hostKey.ShortKey())}
+}
+
+func loadAccessLists(store Store) (al accessLists, err error) {
+	err = store.View(func(tx StoreTx) error {
+		if _, err := tx.Get("access", "blocklist", &al.block); err != nil {
+			return err
+		}
+		_, err := tx.Get("access", "allowlist", &al.allow)
+		return err
+	})
+	return
+}
+
+// checkHost returns a host_blocked error if the server's access lists do not
+// permit the host.
+func (s *server) checkHost(hostKey hostdb.HostPublicKey, addr modules.NetAddress) error {
+	s.mu.Lock()
+	al := s.access
+	s.mu.Unlock()
+	return al.check(hostKey, addr)
+}
+
+// checkHosts returns a host_blocked error listing the hosts that the server's
+// access lists do not permit. Hosts are resolved through the shard server only
+// if the access lists contain entries that are not host keys.
+func (s *server) checkHosts(hostKeys []hostdb.HostPublicKey) error {
+	s.mu.Lock()
+	al := s.access
+	s.mu.Unlock()
+	byAddr := false
+	for _, list := range [][]AccessEntry{al.block, al.allow} {
+		for _, e := range list {
+			byAddr = byAddr || !strings.HasPrefix(e.Entry, "ed25519:")
+		}
+	}
+	var blocked []string
+	for _, hostKey := range hostKeys {
+		var addr modules.NetAddress
+		if byAddr {
+			addr, _ = s.resolveHostKey(hostKey)
+		}
+		if err := al.check(hostKey, addr); err != nil {
+			blocked = append(blocked, err.(Error).Message)
+		}
+	}
+	if len(blocked) > 0 {
+		return Error{
+			Code:    CodeHostBlocked,
+			Message: strings.Join(blocked, "; "),
+			Details: blocked,
+		}
+	}
+	return nil
+}
+
+// accessList returns the blocklist (if block is true) or the allowlist, along
+// with its key in the "access" bucket. The caller must hold the server lock.
+func (s *server) accessList(block bool) (*[]AccessEntry, string) {
+	if block {
+		return &s.access.block, "blocklist"
+	}
+	return &s.access.allow, "allowlist"
+}
+
+// handleAccessListGET returns a handler that lists the entries of the
+// blocklist (if block is true) or the allowlist.
+func (s *server) handleAccessListGET(block bool) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		s.mu.Lock()
+		list, _ := s.accessList(block)
+		entries := append([]AccessEntry(nil), *list...)
+		s.mu.Unlock()
+		writeJSON(w, entries)
+	}
+}
+
+// handleAccessListPUT returns a handler that replaces the entries of the
+// blocklist (if block is true) or the allowlist.
+func (s *server) handleAccessListPUT(block bool) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		var entries []AccessEntry
+		if err := json.NewDecoder(req.Body).Decode(&entries); err != nil {
+			writeError(w, CodeBadRequest, err)
+			return
+		}
+		for _, e := range entries {
+			if err := e.validate(); err != nil {
+				writeError(w, CodeBadRequest, err)
+				return
+			}
+		}
+		s.mu.Lock()
+		list, key := s.accessList(block)
+		err := s.store.Update(func(tx StoreTx) error {
+			return tx.Put("access", key, entries)
+		})
+		if err == nil {
+			*list = entries
+		}
+		s.mu.Unlock()
+		if err != nil {
+			writeError(w, CodeInternal, err)
+			return
+		}
+	}
+}
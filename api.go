@@ -3,7 +3,9 @@ package muse // import "lukechampine.com/muse"
 
 import (
 	"crypto/ed25519"
+	_ "embed" // for openapi.json
 	"encoding/json"
+	"time"
 
 	"go.sia.tech/siad/modules"
 	"go.sia.tech/siad/types"
@@ -11,6 +13,15 @@ import (
 	"lukechampine.com/us/renter"
 )
 
+// apiPrefix is the path under which the current version of the API is served.
+const apiPrefix = "/api/v1"
+
+// openAPISpec is the OpenAPI 3 description of the API, served at
+// apiPrefix+"/openapi.json".
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
 // A Contract represents a Sia file contract, along with additional metadata.
 type Contract struct {
 	renter.Contract
@@ -63,3 +74,441 @@ type RequestRenew struct {
 type RequestScan struct {
 	HostKey hostdb.HostPublicKey
 }
+
+// ResponseScan is the response type for the /scan endpoint. Changes lists the
+// unfavorable differences between the host's settings and those reported by
+// its most recent successful scan, if that scan happened within the last 24
+// hours.
+type ResponseScan struct {
+	hostdb.HostSettings
+	Changes []SettingsChange `json:"changes,omitempty"`
+}
+
+// A SettingsChange is an unfavorable change to one of a host's settings: an
+// increase in a price, or a decrease in collateral. Field is the JSON name of
+// the setting.
+type SettingsChange struct {
+	Field string         `json:"field"`
+	Old   types.Currency `json:"old"`
+	New   types.Currency `json:"new"`
+}
+
+// RequestScanBatch is the request type for the /scan/batch endpoint. The hosts
+// to scan are either the members of HostSet or HostKeys, but not both. At most
+// Concurrency hosts are scanned at once, and each scan is abandoned after
+// TimeoutMS milliseconds; zero values select the defaults of 10 hosts and 10
+// seconds.
+type RequestScanBatch struct {
+	HostSet     string                 `json:"hostSet"`
+	HostKeys    []hostdb.HostPublicKey `json:"hostKeys"`
+	Concurrency int                    `json:"concurrency"`
+	TimeoutMS   int64                  `json:"timeoutMS"`
+}
+
+// A ScanResult is the outcome of scanning one host in a batch. If the scan
+// failed, Error is set and Settings is nil; Address is empty if the host could
+// not be resolved. Changes is as in ResponseScan.
+type ScanResult struct {
+	HostKey   hostdb.HostPublicKey `json:"hostKey"`
+	Address   modules.NetAddress   `json:"address"`
+	LatencyMS float64              `json:"latencyMS"`
+	Settings  *hostdb.HostSettings `json:"settings,omitempty"`
+	Changes   []SettingsChange     `json:"changes,omitempty"`
+	Error     *Error               `json:"error,omitempty"`
+}
+
+// Metrics describe the server's operation.
+type Metrics struct {
+	HostCache CacheMetrics `json:"hostCache"`
+}
+
+// CacheMetrics describe the server's cache of host addresses, host lookups
+// proxied to the shard server, and host scans. Hit and miss counts are
+// cumulative; Addresses, Lookups, and Scans are the number of entries
+// currently cached. Invalidations counts the times that cached addresses and
+// lookups were discarded because the chain height changed, and Evictions the
+// cached addresses discarded because a scan of the host failed.
+type CacheMetrics struct {
+	Enabled       bool   `json:"enabled"`
+	ResolveHits   uint64 `json:"resolveHits"`
+	ResolveMisses uint64 `json:"resolveMisses"`
+	LookupHits    uint64 `json:"lookupHits"`
+	LookupMisses  uint64 `json:"lookupMisses"`
+	ScanHits      uint64 `json:"scanHits"`
+	ScanMisses    uint64 `json:"scanMisses"`
+	Invalidations uint64 `json:"invalidations"`
+	Evictions     uint64 `json:"evictions"`
+	Addresses     int    `json:"addresses"`
+	Lookups       int    `json:"lookups"`
+	Scans         int    `json:"scans"`
+}
+
+// A ScanRecord is a stored scan of a host. If the scan failed, Error is set and
+// Settings is nil.
+type ScanRecord struct {
+	Timestamp time.Time            `json:"timestamp"`
+	Address   modules.NetAddress   `json:"address"`
+	Success   bool                 `json:"success"`
+	LatencyMS float64              `json:"latencyMS"`
+	Error     string               `json:"error,omitempty"`
+	Settings  *hostdb.HostSettings `json:"settings,omitempty"`
+}
+
+// PriceTrend reports the relative change in a host's prices between its
+// oldest and newest successful stored scans; e.g. 0.5 means that a price rose
+// by 50%, and -0.5 that it fell by half.
+type PriceTrend struct {
+	Storage    float64 `json:"storage"`
+	Upload     float64 `json:"upload"`
+	Download   float64 `json:"download"`
+	Contract   float64 `json:"contract"`
+	Collateral float64 `json:"collateral"`
+}
+
+// HostInfo summarizes the stored scans of a host. Uptime is the fraction of
+// scans that succeeded. Settings are those of the newest successful scan, and
+// History holds the newest scans, newest first.
+type HostInfo struct {
+	HostKey      hostdb.HostPublicKey `json:"hostKey"`
+	Address      modules.NetAddress   `json:"address"`
+	FirstScan    time.Time            `json:"firstScan"`
+	LastScan     time.Time            `json:"lastScan"`
+	LastSuccess  time.Time            `json:"lastSuccess"`
+	Scans        int                  `json:"scans"`
+	Successes    int                  `json:"successes"`
+	Uptime       float64              `json:"uptime"`
+	AvgLatencyMS float64              `json:"avgLatencyMS"`
+	PriceTrend   PriceTrend           `json:"priceTrend"`
+	Settings     *hostdb.HostSettings `json:"settings,omitempty"`
+	History      []ScanRecord         `json:"history"`
+}
+
+// ResponseHostSetEdit is the response type for the /hostsets/:name/add and
+// /hostsets/:name/remove endpoints.
+type ResponseHostSetEdit struct {
+	Hosts   []hostdb.HostPublicKey `json:"hosts"`   // the resulting host set
+	Changed []hostdb.HostPublicKey `json:"changed"` // the hosts that were added or removed
+}
+
+// A HostSetRevision records a change to a host set. Actor identifies the token
+// that authorized the change ("admin" or "tenant:<name>"), or else the client's
+// address; Note is the unverified Muse-Actor header sent by the client.
+type HostSetRevision struct {
+	Version   uint64                 `json:"version"`
+	Timestamp time.Time              `json:"timestamp"`
+	Actor     string                 `json:"actor"`
+	Note      string                 `json:"note,omitempty"`
+	Action    string                 `json:"action"`
+	Hosts     []hostdb.HostPublicKey `json:"hosts"` // empty if the set was deleted
+}
+
+// RequestRollback is the request type for the /hostsets/:name/rollback
+// endpoint.
+type RequestRollback struct {
+	Version uint64 `json:"version"`
+}
+
+// ContractDefaults are the default parameters of contracts formed with a host
+// set.
+type ContractDefaults struct {
+	Funds    types.Currency    `json:"funds"`
+	Duration types.BlockHeight `json:"duration"`
+}
+
+// HostSetMetadata describes the purpose and intended use of a host set.
+type HostSetMetadata struct {
+	Owner       string            `json:"owner"`
+	Description string            `json:"description"`
+	Labels      map[string]string `json:"labels"`
+	MinHosts    int               `json:"minHosts"` // intended redundancy
+	Contract    ContractDefaults  `json:"contract"`
+	Diversity   DiversityPolicy   `json:"diversity"`
+}
+
+// A DiversityPolicy determines how the server responds when the hosts of a
+// host set share a subnet or announced hostname, and are thus likely to be
+// run by the same operator. The zero value is equivalent to DiversityWarn.
+type DiversityPolicy string
+
+// Diversity policies.
+const (
+	DiversityWarn   DiversityPolicy = "warn"   // publish an event
+	DiversityReject DiversityPolicy = "reject" // refuse the change
+	DiversityIgnore DiversityPolicy = "ignore"
+)
+
+// A DiversityViolation is a group of hosts in a host set that share a /24
+// (IPv4) or /48 (IPv6) subnet, or an announced hostname. Reason is either
+// "subnet" or "hostname", and Group is the shared subnet or hostname.
+type DiversityViolation struct {
+	Reason string                 `json:"reason"`
+	Group  string                 `json:"group"`
+	Hosts  []hostdb.HostPublicKey `json:"hosts"`
+}
+
+// HostSetRules define a host set by the settings of its hosts, rather than by
+// an explicit list. Membership is resolved by scanning each candidate host and
+// keeping those that satisfy every rule; zero-valued rules are ignored. If
+// Candidates is empty, the hosts of the tenant's contracts are considered.
+type HostSetRules struct {
+	Candidates          []hostdb.HostPublicKey `json:"candidates"`
+	MaxStoragePrice     types.Currency         `json:"maxStoragePrice"`
+	MinRemainingStorage uint64                 `json:"minRemainingStorage"`
+	AcceptingContracts  bool                   `json:"acceptingContracts"`
+	MinVersion          string                 `json:"minVersion"`
+	ExcludedSubnets     []string               `json:"excludedSubnets"` // CIDR notation
+}
+
+// RequestCompose is the request and response type for the
+// /hostsets/:name/compose endpoint. The expression combines other host sets by
+// name, e.g. "eu | us - blocklist"; see the API docs for its syntax.
+type RequestCompose struct {
+	Expression string `json:"expression"`
+}
+
+// HostSetInfo is the response type for the /hostsets endpoint.
+type HostSetInfo struct {
+	Name       string          `json:"name"`
+	Hosts      int             `json:"hosts"`
+	Dynamic    bool            `json:"dynamic"`    // defined by HostSetRules
+	Expression string          `json:"expression"` // composed of other host sets
+	Metadata   HostSetMetadata `json:"metadata"`
+	Warnings   []string        `json:"warnings"`
+}
+
+// An EventType identifies the kind of an Event.
+type EventType string
+
+// Event types published by the muse server.
+const (
+	EventContractFormed      EventType = "contract_formed"
+	EventContractRenewed     EventType = "contract_renewed"
+	EventContractRenewFailed EventType = "contract_renew_failed"
+	EventContractExpiring    EventType = "contract_expiring"
+	EventTpoolRejected       EventType = "tpool_rejected"
+	EventHostSetChanged      EventType = "hostset_changed"
+	EventHostSetBelowMinimum EventType = "hostset_below_minimum"
+	EventHostSetNotDiverse   EventType = "hostset_not_diverse"
+	EventHostOffline         EventType = "host_offline"
+	EventHostNotAccepting    EventType = "host_not_accepting"
+	EventHostLowStorage      EventType = "host_low_storage"
+	EventHostPriceChanged    EventType = "host_price_changed"
+	EventHostSettingsChanged EventType = "host_settings_changed"
+	EventWalletLow           EventType = "wallet_low"
+	EventShardUnsynced       EventType = "shard_unsynced"
+)
+
+// An Event is a notification of a change in the server's state. The type of
+// Data depends on Type: EventContract for contract_formed, contract_renewed,
+// and contract_expiring; EventContractError for contract_renew_failed and
+// tpool_rejected; EventHostSet for hostset_changed; EventHostSetSize for
+// hostset_below_minimum; EventHostSetDiversity for hostset_not_diverse;
+// EventHost for host_offline, host_not_accepting, host_low_storage, and
+// host_price_changed; EventHostSettings for host_settings_changed; EventWallet
+// for wallet_low; and EventShard for shard_unsynced. Tenant names the tenant
+// that the event concerns; it is empty for the default tenant and for
+// server-wide events.
+type Event struct {
+	ID        uint64          `json:"id"`
+	Type      EventType       `json:"type"`
+	Tenant    string          `json:"tenant,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// EventContract is the data of a contract event. It does not include the
+// renter key.
+type EventContract struct {
+	HostKey     hostdb.HostPublicKey `json:"hostKey"`
+	ID          types.FileContractID `json:"id"`
+	RenewedFrom types.FileContractID `json:"renewedFrom"`
+	HostAddress modules.NetAddress   `json:"hostAddress"`
+	EndHeight   types.BlockHeight    `json:"endHeight"`
+}
+
+// EventContractError is the data of an event reporting a failed contract
+// operation.
+type EventContractError struct {
+	HostKey    hostdb.HostPublicKey `json:"hostKey"`
+	ContractID types.FileContractID `json:"contractID"`
+	Error      string               `json:"error"`
+}
+
+// EventHostSet is the data of an EventHostSetChanged event. If the set was
+// deleted, Hosts is empty.
+type EventHostSet struct {
+	Name  string                 `json:"name"`
+	Hosts []hostdb.HostPublicKey `json:"hosts"`
+}
+
+// EventHostSetSize is the data of an EventHostSetBelowMinimum event.
+type EventHostSetSize struct {
+	Name     string `json:"name"`
+	Hosts    int    `json:"hosts"`
+	MinHosts int    `json:"minHosts"`
+}
+
+// EventHostSetDiversity is the data of an EventHostSetNotDiverse event.
+type EventHostSetDiversity struct {
+	Name       string               `json:"name"`
+	Violations []DiversityViolation `json:"violations"`
+}
+
+// EventHost is the data of an event reported by the host monitor. HostSets
+// names the tenant's host sets that contain the host. Error is set for
+// host_offline, and PriceChange for host_price_changed, where it is relative
+// to the prices at the previous host_price_changed event, or else when the
+// monitor first scanned the host.
+type EventHost struct {
+	HostKey          hostdb.HostPublicKey `json:"hostKey"`
+	Address          modules.NetAddress   `json:"address"`
+	HostSets         []string             `json:"hostSets"`
+	Error            string               `json:"error,omitempty"`
+	RemainingStorage uint64               `json:"remainingStorage"`
+	PriceChange      *PriceTrend          `json:"priceChange,omitempty"`
+}
+
+// EventHostSettings is the data of an EventHostSettingsChanged event, which is
+// published when a scan requested by the tenant reveals unfavorable changes to
+// a host's settings.
+type EventHostSettings struct {
+	HostKey hostdb.HostPublicKey `json:"hostKey"`
+	Address modules.NetAddress   `json:"address"`
+	Changes []SettingsChange     `json:"changes"`
+}
+
+// EventWallet is the data of an EventWalletLow event.
+type EventWallet struct {
+	Balance    types.Currency `json:"balance"`
+	MinBalance types.Currency `json:"minBalance"`
+}
+
+// EventShard is the data of an EventShardUnsynced event.
+type EventShard struct {
+	Error string `json:"error,omitempty"`
+}
+
+// A Webhook is a URL that the server POSTs the events of a tenant to. Each
+// request body is a JSON-encoded Event, signed with Secret; see VerifyWebhook.
+// Secret is only returned when the webhook is created.
+type Webhook struct {
+	ID     string      `json:"id"`
+	URL    string      `json:"url"`
+	Secret string      `json:"secret,omitempty"`
+	Tenant string      `json:"tenant,omitempty"`
+	Events []EventType `json:"events"` // if empty, all events are sent
+}
+
+// TenantConfig is the configuration of a tenant. If Budget is non-zero, the
+// total funds allocated to contracts formed or renewed by the tenant over its
+// lifetime may not exceed it; funds are not returned to the budget when a
+// contract expires or its record is deleted. If Tokens is non-empty, requests to the tenant's routes must
+// carry one of them as a bearer token; a nil Tokens leaves the existing
+// tokens unchanged.
+type TenantConfig struct {
+	Budget types.Currency `json:"budget"`
+	Tokens []string       `json:"tokens"`
+}
+
+// TenantInfo describes a tenant.
+type TenantInfo struct {
+	Name   string         `json:"name"`
+	Budget types.Currency `json:"budget"`
+	Spent  types.Currency `json:"spent"`
+}
+
+// An AccessEntry is an entry in the server's host blocklist or allowlist. Entry
+// is a host public key (e.g. "ed25519:..."), a net address (either host:port
+// or just the hostname), or a CIDR subnet, which is matched against the IP
+// addresses of the host's announced net address.
+type AccessEntry struct {
+	Entry  string `json:"entry"`
+	Reason string `json:"reason"`
+}
+
+// An ErrorCode identifies the kind of error returned by the muse API.
+type ErrorCode string
+
+// Error codes returned by the muse API.
+const (
+	CodeBadRequest        ErrorCode = "bad_request"
+	CodeNotFound          ErrorCode = "not_found"
+	CodeMethodNotAllowed  ErrorCode = "method_not_allowed"
+	CodeInternal          ErrorCode = "internal"
+	CodeUnknownHost       ErrorCode = "unknown_host"
+	CodeHostUnreachable   ErrorCode = "host_unreachable"
+	CodeHostRejected      ErrorCode = "host_rejected"
+	CodeInsufficientFunds ErrorCode = "insufficient_funds"
+	CodeUnknownHostSet    ErrorCode = "unknown_host_set"
+	CodePriceGouging      ErrorCode = "price_gouging"
+	CodeUnknownTenant     ErrorCode = "unknown_tenant"
+	CodeUnauthorized      ErrorCode = "unauthorized"
+	CodeBudgetExceeded    ErrorCode = "budget_exceeded"
+	CodeHostSetConflict   ErrorCode = "hostset_conflict"
+	CodeHostBlocked       ErrorCode = "host_blocked"
+	CodeNotDiverse        ErrorCode = "hostset_not_diverse"
+	CodeNotSynced         ErrorCode = "not_synced"
+)
+
+// Errors that may be returned by the muse API. They are intended for use with
+// errors.Is; only the Code field is compared.
+var (
+	ErrUnknownHost       = Error{Code: CodeUnknownHost}
+	ErrHostUnreachable   = Error{Code: CodeHostUnreachable}
+	ErrHostRejected      = Error{Code: CodeHostRejected}
+	ErrInsufficientFunds = Error{Code: CodeInsufficientFunds}
+	ErrUnknownHostSet    = Error{Code: CodeUnknownHostSet}
+	ErrPriceGouging      = Error{Code: CodePriceGouging}
+	ErrUnknownTenant     = Error{Code: CodeUnknownTenant}
+	ErrUnauthorized      = Error{Code: CodeUnauthorized}
+	ErrBudgetExceeded    = Error{Code: CodeBudgetExceeded}
+	ErrHostSetConflict   = Error{Code: CodeHostSetConflict}
+	ErrHostBlocked       = Error{Code: CodeHostBlocked}
+	ErrNotDiverse        = Error{Code: CodeNotDiverse}
+	ErrNotSynced         = Error{Code: CodeNotSynced}
+)
+
+// An Error is the response type for all failed requests.
+type Error struct {
+	Code    ErrorCode   `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// Error implements error.
+func (e Error) Error() string {
+	if e.Message == "" {
+		return string(e.Code)
+	}
+	return e.Message
+}
+
+// Is reports whether target is an Error (or *Error) with the same Code as e. A
+// target without a Code, such as one returned by NewError, matches only if its
+// message is identical to e's.
+func (e Error) Is(target error) bool {
+	var t Error
+	switch target := target.(type) {
+	case Error:
+		t = target
+	case *Error:
+		if target == nil {
+			return false
+		}
+		t = *target
+	default:
+		return false
+	}
+	if t.Code == "" {
+		return t.Message == e.Message
+	}
+	return t.Code == e.Code
+}
+
+// NewError returns an Error without a Code that formats as the given text.
+//
+// Deprecated: Use the Err* values, or compare the Code of an Error obtained
+// with errors.As.
+func NewError(str string) Error {
+	return Error{Message: str}
+}
@@ -0,0 +1,286 @@
+package muse
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.sia.tech/siad/modules"
+	"go.sia.tech/siad/types"
+	"lukechampine.com/us/hostdb"
+)
+
+// heightCheckInterval is the minimum time between checks of the chain height,
+// which determine whether cached host addresses may be stale.
+const heightCheckInterval = 10 * time.Second
+
+// A cacheEntry is a cached value and the time at which it expires.
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// A hostCache caches host addresses resolved by the shard server, host lookups
+// proxied to the shard server, and successful scans, so that bursts of
+// requests concerning the same hosts do not each contact the shard server or
+// the host.
+//
+// The shard server does not report individual announcements, so cached
+// addresses and lookups are discarded whenever the chain height changes, since
+// any new block may contain a new announcement. This only approximates
+// invalidation on announcement: the height is checked at most once per
+// heightCheckInterval, so a new address may be missed for that long, and a
+// reorg that replaces a block without changing the height is not detected at
+// all until the entry expires. Cached entries concerning a host are also
+// discarded when a scan of that host fails, as it may have moved.
+type hostCache struct {
+	resolveTTL time.Duration
+	scanTTL    time.Duration
+
+	mu      sync.Mutex
+	height  types.BlockHeight
+	checked time.Time             // when height was last checked
+	addrs   map[string]cacheEntry // by host key
+	lookups map[string]cacheEntry // cachedLookups, by path
+	scans   map[string]cacheEntry // by host key
+	metrics CacheMetrics
+}
+
+// A cachedLookup is a successful response from the shard server's host lookup
+// route.
+type cachedLookup struct {
+	contentType string
+	body        []byte
+}
+
+// getEntry returns the unexpired value stored under key, deleting it if it has
+// expired.
+func getEntry(m map[string]cacheEntry, key string) (interface{}, bool) {
+	e, ok := m[key]
+	if ok && time.Now().After(e.expires) {
+		delete(m, key)
+		ok = false
+	}
+	return e.value, ok
+}
+
+// setHeight records the current chain height, discarding cached addresses and
+// lookups if it has changed.
+func (c *hostCache) setHeight(height types.BlockHeight) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if height != c.height {
+		if len(c.addrs) > 0 || len(c.lookups) > 0 {
+			c.metrics.Invalidations++
+		}
+		c.height = height
+		c.addrs = make(map[string]cacheEntry)
+		c.lookups = make(map[string]cacheEntry)
+	}
+}
+
+// evict discards every cached entry concerning the specified host.
+func (c *hostCache) evict(hostKey hostdb.HostPublicKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.addrs[string(hostKey)]; ok {
+		c.metrics.Evictions++
+	}
+	delete(c.addrs, string(hostKey))
+	delete(c.scans, string(hostKey))
+	delete(c.lookups, "/host/"+string(hostKey))
+}
+
+// snapshot returns the cache's current metrics.
+func (c *hostCache) snapshot() CacheMetrics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range []map[string]cacheEntry{c.addrs, c.lookups, c.scans} {
+		for key := range m {
+			getEntry(m, key)
+		}
+	}
+	m := c.metrics
+	m.Enabled = true
+	m.Addresses = len(c.addrs)
+	m.Lookups = len(c.lookups)
+	m.Scans = len(c.scans)
+	return m
+}
+
+// WithHostCache enables caching of host addresses for resolveTTL and of
+// successful host scans for scanTTL. A zero TTL disables the corresponding
+// cache.
+func WithHostCache(resolveTTL, scanTTL time.Duration) ServerOption {
+	return func(s *server) {
+		s.cache = &hostCache{
+			resolveTTL: resolveTTL,
+			scanTTL:    scanTTL,
+			addrs:      make(map[string]cacheEntry),
+			lookups:    make(map[string]cacheEntry),
+			scans:      make(map[string]cacheEntry),
+		}
+	}
+}
+
+// checkHeight discards stale cache entries if the chain height has changed
+// since it was last checked. The height is checked at most once per
+// heightCheckInterval.
+func (s *server) checkHeight() {
+	s.cache.mu.Lock()
+	check := time.Since(s.cache.checked) >= heightCheckInterval
+	if check {
+		s.cache.checked = time.Now()
+	}
+	s.cache.mu.Unlock()
+	if check {
+		if height, err := s.shard.ChainHeight(); err == nil {
+			s.cache.setHeight(height)
+		}
+	}
+}
+
+// resolveHostKey resolves a host key to the host's most recently announced
+// address, using the cache if possible.
+func (s *server) resolveHostKey(hostKey hostdb.HostPublicKey) (modules.NetAddress, error) {
+	if s.cache == nil || s.cache.resolveTTL == 0 {
+		return s.shard.ResolveHostKey(hostKey)
+	}
+	s.checkHeight()
+	c := s.cache
+	c.mu.Lock()
+	addr, ok := getEntry(c.addrs, string(hostKey))
+	if ok {
+		c.metrics.ResolveHits++
+	} else {
+		c.metrics.ResolveMisses++
+	}
+	c.mu.Unlock()
+	if ok {
+		return addr.(modules.NetAddress), nil
+	}
+	hostAddr, err := s.shard.ResolveHostKey(hostKey)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.addrs[string(hostKey)] = cacheEntry{hostAddr, time.Now().Add(c.resolveTTL)}
+	c.mu.Unlock()
+	return hostAddr, nil
+}
+
+// cachedScan returns the result of a recent successful scan of the host, if
+// one is cached.
+func (s *server) cachedScan(hostKey hostdb.HostPublicKey) (ScanResult, bool) {
+	if s.cache == nil || s.cache.scanTTL == 0 {
+		return ScanResult{}, false
+	}
+	c := s.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := getEntry(c.scans, string(hostKey))
+	if ok {
+		c.metrics.ScanHits++
+		return r.(ScanResult), true
+	}
+	c.metrics.ScanMisses++
+	return ScanResult{}, false
+}
+
+// cacheScan caches the result of a scan if it succeeded, or else evicts the
+// host from the cache.
+func (s *server) cacheScan(r ScanResult) {
+	if s.cache == nil {
+		return
+	} else if r.Error != nil {
+		s.cache.evict(r.HostKey)
+		return
+	} else if s.cache.scanTTL == 0 {
+		return
+	}
+	r.Changes = nil
+	c := s.cache
+	c.mu.Lock()
+	c.scans[string(r.HostKey)] = cacheEntry{r, time.Now().Add(c.scanTTL)}
+	c.mu.Unlock()
+}
+
+// cachingShardProxy wraps a proxy to the shard server, serving successful host
+// lookups from the cache where possible.
+func (s *server) cachingShardProxy(proxy http.Handler) http.Handler {
+	if s.cache == nil || s.cache.resolveTTL == 0 {
+		return proxy
+	}
+	c := s.cache
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path := strings.TrimPrefix(req.URL.Path, apiPrefix+"/shard")
+		if !strings.HasPrefix(path, "/host/") {
+			proxy.ServeHTTP(w, req)
+			return
+		}
+		s.checkHeight()
+		c.mu.Lock()
+		resp, ok := getEntry(c.lookups, path)
+		if ok {
+			c.metrics.LookupHits++
+		} else {
+			c.metrics.LookupMisses++
+		}
+		c.mu.Unlock()
+		if ok {
+			l := resp.(cachedLookup)
+			w.Header().Set("Content-Type", l.contentType)
+			w.Write(l.body)
+			return
+		}
+		rec := &recordingWriter{ResponseWriter: w}
+		proxy.ServeHTTP(rec, req)
+		// only cache announcements; a host that was not found may announce
+		// at any time
+		if rec.status == http.StatusOK && rec.buf.Len() > 0 {
+			l := cachedLookup{
+				contentType: rec.Header().Get("Content-Type"),
+				body:        rec.buf.Bytes(),
+			}
+			if l.contentType == "" {
+				// the type that net/http sniffed for the original response
+				l.contentType = http.DetectContentType(l.body)
+			}
+			c.mu.Lock()
+			c.lookups[path] = cacheEntry{l, time.Now().Add(c.resolveTTL)}
+			c.mu.Unlock()
+		}
+	})
+}
+
+// A recordingWriter is an http.ResponseWriter that records the status and body
+// of the response.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.buf.Write(p)
+	return rw.ResponseWriter.Write(p)
+}
+
+func (s *server) handleMetrics(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var m Metrics
+	if s.cache != nil {
+		m.HostCache = s.cache.snapshot()
+	}
+	writeJSON(w, m)
+}
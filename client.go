@@ -1,6 +1,7 @@
 package muse
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -11,6 +12,7 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
 
 	"go.sia.tech/siad/types"
@@ -20,78 +22,162 @@ import (
 	"lukechampine.com/us/renter"
 )
 
-// Error is an error wrapper that provides Is function.
-type Error struct {
-	error
+// A Client communicates with a muse server.
+type Client struct {
+	addr   string
+	ctx    context.Context
+	tenant string
+	token  string
+	actor  string
 }
 
-// NewError returns an error that formats as the given text.
-func NewError(str string) Error {
-	return Error{error: errors.New(str)}
+// scoped returns route prefixed with the Client's tenant, if any.
+func (c *Client) scoped(route string) string {
+	if c.tenant == "" {
+		return route
+	}
+	return "/tenants/" + c.tenant + route
 }
 
-// Is reports whether this error matches target.
-func (e Error) Is(err error) bool {
-	return strings.Contains(e.Error(), err.Error())
+func (c *Client) newRequest(method string, route string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(c.ctx, method, fmt.Sprintf("%v%v%v", c.addr, apiPrefix, route), body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.actor != "" {
+		req.Header.Set("Muse-Actor", c.actor)
+	}
+	return req, nil
 }
 
-// A Client communicates with a muse server.
-type Client struct {
-	addr string
-	ctx  context.Context
+func (c *Client) req(method string, route string, data, resp interface{}) error {
+	_, err := c.reqHeader(method, route, nil, data, resp)
+	return err
 }
 
-func (c *Client) req(method string, route string, data, resp interface{}) (err error) {
+// reqHeader is like req, but additionally sets the supplied request headers
+// and returns the response headers.
+func (c *Client) reqHeader(method string, route string, header http.Header, data, resp interface{}) (_ http.Header, err error) {
 	var body io.Reader
 	if data != nil {
 		js, _ := json.Marshal(data)
 		body = bytes.NewReader(js)
 	}
-	req, err := http.NewRequestWithContext(c.ctx, method, fmt.Sprintf("%v%v", c.addr, route), body)
+	req, err := c.newRequest(method, route, body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header[k] = v
+	}
 	r, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer multierr.AppendInvoke(&err, multierr.Close(r.Body))
 	if r.StatusCode != 200 {
-		err, _ := ioutil.ReadAll(r.Body)
-		return NewError(strings.TrimSpace(string(err)))
+		return nil, decodeError(r)
 	}
 	if resp == nil {
-		return nil
+		return r.Header, nil
+	}
+	return r.Header, json.NewDecoder(r.Body).Decode(resp)
+}
+
+// decodeError decodes the Error in the body of a failed response. Responses
+// that do not contain a JSON-encoded Error (e.g. from a proxy) are converted
+// to an Error with a code derived from the status code.
+func decodeError(r *http.Response) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
 	}
-	return json.NewDecoder(r.Body).Decode(resp)
+	var e Error
+	if json.Unmarshal(body, &e) == nil && e.Code != "" {
+		return e
+	}
+	e.Message = strings.TrimSpace(string(body))
+	switch r.StatusCode {
+	case http.StatusBadRequest:
+		e.Code = CodeBadRequest
+	case http.StatusUnauthorized:
+		e.Code = CodeUnauthorized
+	case http.StatusNotFound:
+		e.Code = CodeNotFound
+	case http.StatusMethodNotAllowed:
+		e.Code = CodeMethodNotAllowed
+	case http.StatusPreconditionFailed:
+		e.Code = CodeHostSetConflict
+	case http.StatusServiceUnavailable:
+		e.Code = CodeNotSynced
+	default:
+		e.Code = CodeInternal
+	}
+	return e
 }
 
 func (c *Client) get(route string, r interface{}) error     { return c.req("GET", route, nil, r) }
 func (c *Client) post(route string, d, r interface{}) error { return c.req("POST", route, d, r) }
 func (c *Client) put(route string, d, r interface{}) error  { return c.req("PUT", route, d, r) }
+func (c *Client) delete(route string) error                 { return c.req("DELETE", route, nil, nil) }
 
 // WithContext returns a new Client whose requests are subject to the supplied
 // context.
 func (c *Client) WithContext(ctx context.Context) *Client {
 	return &Client{
-		addr: c.addr,
-		ctx:  ctx,
+		addr:   c.addr,
+		ctx:    ctx,
+		tenant: c.tenant,
+		token:  c.token,
+		actor:  c.actor,
 	}
 }
 
-// AllContracts returns all contracts formed by the server.
+// WithActor returns a new Client that sends actor in its Muse-Actor header. The
+// server records it as a note in the history of each host set that it
+// modifies; the revision's actor is determined by the Client's token.
+func (c *Client) WithActor(actor string) *Client {
+	return &Client{
+		addr:   c.addr,
+		ctx:    c.ctx,
+		tenant: c.tenant,
+		token:  c.token,
+		actor:  actor,
+	}
+}
+
+// Tenant returns a new Client whose host set, contract, scan, event, and
+// webhook requests are scoped to the named tenant, authenticated with token.
+// An empty name refers to the default tenant, whose token is the server's
+// admin token, if it has one.
+func (c *Client) Tenant(name, token string) *Client {
+	return &Client{
+		addr:   c.addr,
+		ctx:    c.ctx,
+		tenant: name,
+		token:  token,
+		actor:  c.actor,
+	}
+}
+
+// AllContracts returns all contracts formed by the server for the Client's
+// tenant.
 func (c *Client) AllContracts() (cs []Contract, err error) {
-	err = c.get("/contracts", &cs)
+	err = c.get(c.scoped("/contracts"), &cs)
 	return
 }
 
-// Contracts returns the contracts in the specified set.
+// Contracts returns the Client's tenant's contracts with the hosts of the
+// specified set.
 func (c *Client) Contracts(set string) (cs []Contract, err error) {
 	if set == "" {
 		return nil, errors.New("no host set provided; to retrieve all contracts, use AllContracts")
 	}
-	err = c.get("/contracts?hostset="+set, &cs)
+	err = c.get(c.scoped("/contracts")+"?hostset="+url.QueryEscape(set), &cs)
 	return
 }
 
@@ -99,17 +185,83 @@ func (c *Client) Contracts(set string) (cs []Contract, err error) {
 //
 // Note that the host may also be scanned via the hostdb.Scan function.
 func (c *Client) Scan(host hostdb.HostPublicKey) (settings hostdb.HostSettings, err error) {
-	err = c.post("/scan", RequestScan{
+	err = c.post(c.scoped("/scan"), RequestScan{
 		HostKey: host,
 	}, &settings)
 	return
 }
 
+// ScanChanges is like Scan, but also reports any unfavorable changes to the
+// host's settings since muse last scanned it.
+func (c *Client) ScanChanges(host hostdb.HostPublicKey) (rs ResponseScan, err error) {
+	err = c.post(c.scoped("/scan"), RequestScan{
+		HostKey: host,
+	}, &rs)
+	return
+}
+
+// ScanMany scans multiple hosts concurrently, as specified by rs. Results are
+// sent on the returned channel as each scan finishes; the channel is closed
+// once every host has been scanned.
+func (c *Client) ScanMany(rs RequestScanBatch) (<-chan ScanResult, error) {
+	js, _ := json.Marshal(rs)
+	req, err := c.newRequest("POST", c.scoped("/scan/batch"), bytes.NewReader(js))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if r.StatusCode != 200 {
+		defer r.Body.Close()
+		return nil, decodeError(r)
+	}
+	ch := make(chan ScanResult)
+	go func() {
+		defer close(ch)
+		defer r.Body.Close()
+		dec := json.NewDecoder(r.Body)
+		for {
+			var sr ScanResult
+			if err := dec.Decode(&sr); err != nil {
+				return
+			}
+			select {
+			case ch <- sr:
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// HostInfo returns statistics about a host, computed from the scans stored by
+// the server. At most limit scans are included in the returned history; if
+// limit is zero, the server's default is used.
+func (c *Client) HostInfo(host hostdb.HostPublicKey, limit int) (info HostInfo, err error) {
+	route := "/hosts/" + string(host)
+	if limit > 0 {
+		route += "?limit=" + strconv.Itoa(limit)
+	}
+	err = c.get(route, &info)
+	return
+}
+
+// Metrics returns metrics describing the server's operation.
+func (c *Client) Metrics() (m Metrics, err error) {
+	err = c.get("/metrics", &m)
+	return
+}
+
 // Form forms a contract with a host. The settings should be obtained from a
 // recent call to Scan. If the settings have changed in the interim, the host
-// may reject the contract.
+// may reject the contract; ScanChanges reports whether they changed since the
+// previous scan.
 func (c *Client) Form(host *hostdb.ScannedHost, funds types.Currency, start, end types.BlockHeight) (contract Contract, err error) {
-	err = c.post("/form", RequestForm{
+	err = c.post(c.scoped("/form"), RequestForm{
 		HostKey:     host.PublicKey,
 		Funds:       funds,
 		StartHeight: start,
@@ -124,7 +276,7 @@ func (c *Client) Form(host *hostdb.ScannedHost, funds types.Currency, start, end
 // from a recent call to Scan. If the settings have changed in the interim, the
 // host may reject the contract.
 func (c *Client) Renew(host *hostdb.ScannedHost, old *renter.Contract, funds types.Currency, start, end types.BlockHeight) (contract Contract, err error) {
-	err = c.post("/renew", RequestRenew{
+	err = c.post(c.scoped("/renew"), RequestRenew{
 		ID:          old.ID,
 		Funds:       funds,
 		StartHeight: start,
@@ -140,43 +292,281 @@ func (c *Client) Renew(host *hostdb.ScannedHost, old *renter.Contract, funds typ
 // is not revised or otherwise affected in any way. In general, this method
 // should only be used on contracts that have expired and are no longer needed.
 func (c *Client) Delete(id types.FileContractID) (err error) {
-	err = c.post("/delete/"+id.String(), nil, nil)
+	err = c.delete(c.scoped("/contracts/" + id.String()))
 	return
 }
 
-// HostSets returns the current list of host sets.
-func (c *Client) HostSets() (hs []string, err error) {
-	err = c.get("/hostsets/", &hs)
+// HostSets returns the names of the current host sets.
+func (c *Client) HostSets() ([]string, error) {
+	infos, err := c.HostSetInfos()
+	if err != nil {
+		return nil, err
+	}
+	hs := make([]string, len(infos))
+	for i := range infos {
+		hs[i] = infos[i].Name
+	}
+	return hs, nil
+}
+
+// HostSetInfos returns the current host sets, along with their metadata and
+// any warnings about them.
+func (c *Client) HostSetInfos() (infos []HostSetInfo, err error) {
+	err = c.get(c.scoped("/hostsets"), &infos)
 	return
 }
 
 // HostSet returns the contents of the named host set.
 func (c *Client) HostSet(name string) (hosts []hostdb.HostPublicKey, err error) {
-	err = c.get("/hostsets/"+name, &hosts)
+	err = c.get(c.scoped("/hostsets/"+name), &hosts)
 	return
 }
 
+// HostSetVersion returns the contents of the named host set, along with its
+// current version, for use with SetHostSetIfMatch.
+func (c *Client) HostSetVersion(name string) (hosts []hostdb.HostPublicKey, version string, err error) {
+	h, err := c.reqHeader("GET", c.scoped("/hostsets/"+name), nil, nil, &hosts)
+	if err != nil {
+		return nil, "", err
+	}
+	return hosts, h.Get("ETag"), nil
+}
+
 // SetHostSet sets the contents of a host set, creating it if it does not exist.
 // If an empty slice is passed, the host set is deleted.
 func (c *Client) SetHostSet(name string, hosts []hostdb.HostPublicKey) (err error) {
-	err = c.put("/hostsets/"+name, hosts, nil)
+	err = c.put(c.scoped("/hostsets/"+name), hosts, nil)
+	return
+}
+
+// SetHostSetIfMatch is like SetHostSet, but fails with ErrHostSetConflict if
+// the host set has been modified since version was obtained from
+// HostSetVersion. An empty version matches any existing host set.
+func (c *Client) SetHostSetIfMatch(name string, hosts []hostdb.HostPublicKey, version string) (err error) {
+	if version == "" {
+		version = "*"
+	}
+	_, err = c.reqHeader("PUT", c.scoped("/hostsets/"+name), http.Header{"If-Match": {version}}, hosts, nil)
+	return
+}
+
+// HostSetHistory returns the revisions of the named host set, oldest first.
+// The history of a deleted host set is retained.
+func (c *Client) HostSetHistory(name string) (revs []HostSetRevision, err error) {
+	err = c.get(c.scoped("/hostsets/"+name+"/history"), &revs)
+	return
+}
+
+// RollbackHostSet restores the named host set to the contents it had at the
+// specified version, recording the rollback as a new revision.
+func (c *Client) RollbackHostSet(name string, version uint64) (rev HostSetRevision, err error) {
+	err = c.post(c.scoped("/hostsets/"+name+"/rollback"), RequestRollback{Version: version}, &rev)
 	return
 }
 
+// HostSetMetadata returns the metadata of the named host set.
+func (c *Client) HostSetMetadata(name string) (md HostSetMetadata, err error) {
+	err = c.get(c.scoped("/hostsets/"+name+"/metadata"), &md)
+	return
+}
+
+// SetHostSetMetadata replaces the metadata of the named host set.
+func (c *Client) SetHostSetMetadata(name string, md HostSetMetadata) (err error) {
+	err = c.put(c.scoped("/hostsets/"+name+"/metadata"), md, nil)
+	return
+}
+
+// HostSetRules returns the rules defining the named host set.
+func (c *Client) HostSetRules(name string) (rules HostSetRules, err error) {
+	err = c.get(c.scoped("/hostsets/"+name+"/rules"), &rules)
+	return
+}
+
+// SetHostSetRules defines the named host set by rules, resolving them
+// immediately and returning the hosts that satisfy them. If rules is nil, the
+// rules are removed, and the host set keeps its current hosts.
+func (c *Client) SetHostSetRules(name string, rules *HostSetRules) (hosts []hostdb.HostPublicKey, err error) {
+	err = c.put(c.scoped("/hostsets/"+name+"/rules"), rules, &hosts)
+	return
+}
+
+// RefreshHostSet resolves the rules of the named host set immediately,
+// returning the hosts that satisfy them.
+func (c *Client) RefreshHostSet(name string) (hosts []hostdb.HostPublicKey, err error) {
+	err = c.post(c.scoped("/hostsets/"+name+"/refresh"), nil, &hosts)
+	return
+}
+
+// HostSetExpression returns the expression composing the named host set.
+func (c *Client) HostSetExpression(name string) (string, error) {
+	var rc RequestCompose
+	err := c.get(c.scoped("/hostsets/"+name+"/compose"), &rc)
+	return rc.Expression, err
+}
+
+// ComposeHostSet defines the named host set as a combination of other host
+// sets, such as "eu | us - blocklist", returning its resulting hosts. If expr
+// is empty, the host set keeps its current hosts as a static set.
+func (c *Client) ComposeHostSet(name, expr string) (hosts []hostdb.HostPublicKey, err error) {
+	err = c.put(c.scoped("/hostsets/"+name+"/compose"), RequestCompose{Expression: expr}, &hosts)
+	return
+}
+
+// HostSetDiversity returns the groups of hosts in the named host set that share
+// a subnet or announced hostname.
+func (c *Client) HostSetDiversity(name string) (violations []DiversityViolation, err error) {
+	err = c.get(c.scoped("/hostsets/"+name+"/diversity"), &violations)
+	return
+}
+
+// Blocklist returns the entries of the server's host blocklist.
+func (c *Client) Blocklist() (entries []AccessEntry, err error) {
+	err = c.get("/blocklist", &entries)
+	return
+}
+
+// SetBlocklist replaces the entries of the server's host blocklist.
+func (c *Client) SetBlocklist(entries []AccessEntry) error {
+	return c.put("/blocklist", entries, nil)
+}
+
+// Allowlist returns the entries of the server's host allowlist.
+func (c *Client) Allowlist() (entries []AccessEntry, err error) {
+	err = c.get("/allowlist", &entries)
+	return
+}
+
+// SetAllowlist replaces the entries of the server's host allowlist. If the
+// allowlist is non-empty, only hosts matching one of its entries are
+// permitted.
+func (c *Client) SetAllowlist(entries []AccessEntry) error {
+	return c.put("/allowlist", entries, nil)
+}
+
+// Tenants returns the names of the server's tenants, excluding the default
+// tenant.
+func (c *Client) Tenants() (names []string, err error) {
+	err = c.get("/tenants", &names)
+	return
+}
+
+// TenantInfo returns information about the named tenant. It requires the
+// tenant's token or the admin token.
+func (c *Client) TenantInfo(name string) (info TenantInfo, err error) {
+	err = c.get("/tenants/"+name, &info)
+	return
+}
+
+// SetTenant configures the named tenant, creating it if it does not exist. It
+// requires the admin token, and fails if the server was not given one.
+func (c *Client) SetTenant(name string, config TenantConfig) (info TenantInfo, err error) {
+	err = c.put("/tenants/"+name, config, &info)
+	return
+}
+
+// AddToHostSet adds hosts to the named host set, creating it if it does not
+// exist. The hosts must be known to the server's shard backend.
+func (c *Client) AddToHostSet(name string, hosts ...hostdb.HostPublicKey) (resp ResponseHostSetEdit, err error) {
+	err = c.post(c.scoped("/hostsets/"+name+"/add"), hosts, &resp)
+	return
+}
+
+// RemoveFromHostSet removes hosts from the named host set. If no hosts remain,
+// the host set is deleted.
+func (c *Client) RemoveFromHostSet(name string, hosts ...hostdb.HostPublicKey) (resp ResponseHostSetEdit, err error) {
+	err = c.post(c.scoped("/hostsets/"+name+"/remove"), hosts, &resp)
+	return
+}
+
+// Webhooks returns the webhooks registered for the Client's tenant. Their
+// secrets are not included.
+func (c *Client) Webhooks() (whs []Webhook, err error) {
+	err = c.get(c.scoped("/webhooks"), &whs)
+	return
+}
+
+// AddWebhook registers a webhook that will receive the Client's tenant's events
+// of the specified types. If no types are specified, the webhook receives all
+// of the tenant's events. The returned Webhook contains the secret used to sign
+// requests; it cannot be retrieved later.
+func (c *Client) AddWebhook(url string, events ...EventType) (wh Webhook, err error) {
+	err = c.post(c.scoped("/webhooks"), Webhook{
+		URL:    url,
+		Events: events,
+	}, &wh)
+	return
+}
+
+// RemoveWebhook removes the webhook with the specified ID, discarding any
+// pending deliveries to it.
+func (c *Client) RemoveWebhook(id string) (err error) {
+	err = c.delete(c.scoped("/webhooks/" + id))
+	return
+}
+
+// Events subscribes to the event stream of the Client's tenant. The default
+// tenant's stream also carries server-wide events. Only events with IDs greater
+// than lastID are sent; pass 0 to receive all events retained by the server.
+// The returned channel is closed when the stream ends, either because the
+// Client's context was canceled or because the connection was lost. To resume
+// the stream, call Events again with the ID of the last event received.
+func (c *Client) Events(lastID uint64) (<-chan Event, error) {
+	req, err := c.newRequest("GET", c.scoped("/events"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if lastID != 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatUint(lastID, 10))
+	}
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if r.StatusCode != 200 {
+		defer r.Body.Close()
+		return nil, decodeError(r)
+	}
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+		defer r.Body.Close()
+		s := bufio.NewScanner(r.Body)
+		s.Buffer(nil, 1<<20)
+		for s.Scan() {
+			// we only need the data field, since it contains the full Event
+			line := s.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			var e Event
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+				return
+			}
+			select {
+			case ch <- e:
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
 // SHARD returns a client for the muse server's shard endpoints.
 func (c *Client) SHARD() *shard.Client {
 	u, err := url.Parse(c.addr)
 	if err != nil {
 		panic(err)
 	}
-	u.Path = path.Join(u.Path, "shard")
+	u.Path = path.Join(u.Path, apiPrefix, "shard")
 	return shard.NewClient(u.String())
 }
 
 // NewClient returns a client that communicates with a muse server listening
 // on the specified address.
 func NewClient(addr string) *Client {
-	return &Client{addr, context.Background()}
+	return &Client{addr: addr, ctx: context.Background()}
 }
 
 func modifyURL(str string, fn func(*url.URL)) string {
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"go.sia.tech/siad/types"
+	"lukechampine.com/muse"
+)
+
+// A config is the configuration of the muse daemon. It is read from a TOML
+// file, if one is supplied; flags take precedence over values in the file.
+//
+// On SIGHUP, the file is read again, and the fields that can safely be changed
+// while the daemon is running are applied: log.verbose, limits, renewal
+// max_duration, and tenants. Changes to other fields require a restart.
+type config struct {
+	Network    string `toml:"network"`
+	APIAddr    string `toml:"api_addr"`
+	Dir        string `toml:"dir"`
+	AdminToken string `toml:"admin_token"`
+
+	Log struct {
+		Verbose bool   `toml:"verbose"`
+		File    string `toml:"file"`
+	} `toml:"log"`
+
+	Walrus struct {
+		Addr  string `toml:"addr"`
+		Serve bool   `toml:"serve"`
+	} `toml:"walrus"`
+
+	Shard struct {
+		Addr   string     `toml:"addr"`
+		Serve  bool       `toml:"serve"`
+		Extra  stringList `toml:"extra"`
+		Quorum int        `toml:"quorum"`
+	} `toml:"shard"`
+
+	Gateway struct {
+		Addr      string   `toml:"addr"`
+		Bootstrap []string `toml:"bootstrap"`
+	} `toml:"gateway"`
+
+	Monitor struct {
+		Interval         duration `toml:"interval"`
+		MinBalance       uint64   `toml:"min_balance"`
+		ResolveInterval  duration `toml:"resolve_interval"`
+		HostScanInterval duration `toml:"host_scan_interval"`
+		MinHostStorage   uint64   `toml:"min_host_storage"`
+		PriceChange      float64  `toml:"price_change"`
+	} `toml:"monitor"`
+
+	Cache struct {
+		AddrTTL duration `toml:"addr_ttl"`
+		ScanTTL duration `toml:"scan_ttl"`
+	} `toml:"cache"`
+
+	Limits struct {
+		MaxStoragePrice  currency `toml:"max_storage_price"`  // per TB per month
+		MaxUploadPrice   currency `toml:"max_upload_price"`   // per TB
+		MaxDownloadPrice currency `toml:"max_download_price"` // per TB
+		MaxContractPrice currency `toml:"max_contract_price"`
+	} `toml:"limits"`
+
+	Renewal struct {
+		ExpiryWindow uint64 `toml:"expiry_window"`
+		MaxDuration  uint64 `toml:"max_duration"`
+	} `toml:"renewal"`
+
+	Tenants map[string]tenantConfig `toml:"tenants"`
+
+	// whether the walrus and shard APIs should be served when running
+	// in-process, i.e. whether their addresses were specified
+	exposeWalrus bool
+	exposeShard  bool
+}
+
+// A tenantConfig configures a tenant. If Tokens is omitted, the tenant's
+// existing tokens are kept.
+type tenantConfig struct {
+	Budget currency `toml:"budget"`
+	Tokens []string `toml:"tokens"`
+}
+
+// defaultConfig returns the default configuration. The monitors, periodic rule
+// resolution, and host cache are disabled unless configured.
+func defaultConfig() config {
+	var c config
+	c.Network = networkMainnet
+	c.APIAddr = ":9580"
+	c.Dir = "."
+	c.Walrus.Addr = "localhost:9380"
+	c.Shard.Addr = "localhost:9480"
+	c.Gateway.Addr = ":9381"
+	c.Monitor.MinHostStorage = 10
+	c.Monitor.PriceChange = 0.2
+	c.Renewal.ExpiryWindow = 1008
+	return c
+}
+
+// bindFlags defines flags on fs that set the fields of c, using the current
+// values of c as defaults.
+func (c *config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Network, "network", c.Network, "network to use: mainnet or local (a single-node chain that mines blocks on demand)")
+	fs.StringVar(&c.APIAddr, "a", c.APIAddr, "host:port that the API server listens on")
+	fs.StringVar(&c.Walrus.Addr, "w", c.Walrus.Addr, "host:port of the walrus server (with -serve-walrus, serve the walrus API here if specified)")
+	fs.BoolVar(&c.Walrus.Serve, "serve-walrus", c.Walrus.Serve, "run a wallet in-process instead of connecting to a walrus server")
+	fs.StringVar(&c.Shard.Addr, "s", c.Shard.Addr, "host:port of the shard server (with -serve-shard, serve the shard API here if specified)")
+	fs.BoolVar(&c.Shard.Serve, "serve-shard", c.Shard.Serve, "run a shard relay in-process instead of connecting to a shard server")
+	fs.Var(&c.Shard.Extra, "shards", "comma-separated host:port list of additional shard servers, used if the -s server fails")
+	fs.IntVar(&c.Shard.Quorum, "shard-quorum", c.Shard.Quorum, "query every shard server, requiring this many to agree (0 to fail over instead)")
+	fs.StringVar(&c.Gateway.Addr, "gateway", c.Gateway.Addr, "host:port that the gateway listens on (with -serve-walrus or -serve-shard)")
+	fs.StringVar(&c.Dir, "d", c.Dir, "directory where server state is stored")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "bearer token required by the default tenant's routes (prefer setting admin_token in the config file)")
+	fs.BoolVar(&c.Log.Verbose, "verbose", c.Log.Verbose, "print verbose logging to stderr")
+	fs.DurationVar(&c.Monitor.Interval.Duration, "monitor", c.Monitor.Interval.Duration, "interval between health checks, which publish alert events (0 to disable)")
+	fs.Uint64Var(&c.Renewal.ExpiryWindow, "expiry-window", c.Renewal.ExpiryWindow, "publish an event when a contract is within this many blocks of expiring")
+	fs.Uint64Var(&c.Monitor.MinBalance, "min-balance", c.Monitor.MinBalance, "publish an event when the wallet balance falls below this many SC (0 to disable)")
+	fs.DurationVar(&c.Monitor.ResolveInterval.Duration, "resolve-interval", c.Monitor.ResolveInterval.Duration, "interval between resolutions of rule-defined host sets (0 to disable)")
+	fs.DurationVar(&c.Monitor.HostScanInterval.Duration, "host-scan-interval", c.Monitor.HostScanInterval.Duration, "interval between scans of every host in every host set, which publish alert events (0 to disable)")
+	fs.Uint64Var(&c.Monitor.MinHostStorage, "min-host-storage", c.Monitor.MinHostStorage, "publish an event when a host reports less than this many GB of remaining storage (0 to disable)")
+	fs.Float64Var(&c.Monitor.PriceChange, "price-change", c.Monitor.PriceChange, "publish an event when a host changes a price by more than this fraction (0 to disable)")
+	fs.DurationVar(&c.Cache.AddrTTL.Duration, "addr-cache-ttl", c.Cache.AddrTTL.Duration, "how long resolved host addresses are cached (0 to disable)")
+	fs.DurationVar(&c.Cache.ScanTTL.Duration, "scan-cache-ttl", c.Cache.ScanTTL.Duration, "how long successful host scans are cached (0 to disable)")
+}
+
+// loadConfig reads the config file at path, if path is non-empty, and then
+// applies the flags in overrides, which maps flag names to values.
+func loadConfig(path string, overrides map[string]string) (config, error) {
+	c := defaultConfig()
+	if path != "" {
+		md, err := toml.DecodeFile(path, &c)
+		if err != nil {
+			return config{}, err
+		} else if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return config{}, fmt.Errorf("unknown config field %q", undecoded[0])
+		}
+		c.exposeWalrus = md.IsDefined("walrus", "addr")
+		c.exposeShard = md.IsDefined("shard", "addr")
+	}
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	c.bindFlags(fs)
+	for name, value := range overrides {
+		if err := fs.Set(name, value); err != nil {
+			return config{}, fmt.Errorf("invalid value for -%v: %w", name, err)
+		}
+	}
+	_, setWalrus := overrides["w"]
+	_, setShard := overrides["s"]
+	c.exposeWalrus = c.exposeWalrus || setWalrus
+	c.exposeShard = c.exposeShard || setShard
+	return c, nil
+}
+
+// contractLimits converts the configured limits to the units of host settings.
+func (c *config) contractLimits() muse.ContractLimits {
+	const blocksPerMonth = 4320
+	return muse.ContractLimits{
+		MaxStoragePrice:  c.Limits.MaxStoragePrice.Div64(1e12).Div64(blocksPerMonth),
+		MaxUploadPrice:   c.Limits.MaxUploadPrice.Div64(1e12),
+		MaxDownloadPrice: c.Limits.MaxDownloadPrice.Div64(1e12),
+		MaxContractPrice: c.Limits.MaxContractPrice.Currency,
+		MaxDuration:      types.BlockHeight(c.Renewal.MaxDuration),
+	}
+}
+
+// tenantConfigs converts the configured tenants to the form accepted by the
+// server.
+func (c *config) tenantConfigs() map[string]muse.TenantConfig {
+	tenants := make(map[string]muse.TenantConfig, len(c.Tenants))
+	for name, tc := range c.Tenants {
+		tenants[name] = muse.TenantConfig{
+			Budget: tc.Budget.Currency,
+			Tokens: tc.Tokens,
+		}
+	}
+	return tenants
+}
+
+// A duration is a time.Duration that can be decoded from a string such as
+// "10m".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(b []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(b))
+	return
+}
+
+// A currency is a types.Currency that can be decoded from a string with units,
+// such as "100SC".
+type currency struct {
+	types.Currency
+}
+
+func (c *currency) UnmarshalText(b []byte) error {
+	s := string(b)
+	exp := int64(-1)
+	if strings.HasSuffix(s, "H") {
+		s, exp = strings.TrimSuffix(s, "H"), 0
+	} else {
+		units := []string{"pS", "nS", "uS", "mS", "SC", "KS", "MS", "GS", "TS"}
+		for i, unit := range units {
+			if strings.HasSuffix(s, unit) {
+				s, exp = strings.TrimSuffix(s, unit), 24+3*(int64(i)-4)
+				break
+			}
+		}
+	}
+	if exp < 0 {
+		return errors.New("currency value is missing units")
+	}
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok {
+		return errors.New("malformed currency value")
+	}
+	mag := new(big.Int).Exp(big.NewInt(10), big.NewInt(exp), nil)
+	r.Mul(r, new(big.Rat).SetInt(mag))
+	if !r.IsInt() {
+		return errors.New("non-integer number of hastings")
+	} else if r.Sign() < 0 {
+		return errors.New("negative currency value")
+	}
+	c.Currency = types.NewCurrency(r.Num())
+	return nil
+}
+
+// A stringList is a comma-separated list of strings.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	if s != "" {
+		*l = strings.Split(s, ",")
+	}
+	return nil
+}
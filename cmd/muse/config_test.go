@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.sia.tech/siad/types"
+)
+
+func TestCurrency(t *testing.T) {
+	for _, test := range []struct {
+		s   string
+		c   types.Currency
+		err bool
+	}{
+		{"1H", types.NewCurrency64(1), false},
+		{"1pS", types.NewCurrency64(1e12), false},
+		{"1SC", types.SiacoinPrecision, false},
+		{"10 SC", types.SiacoinPrecision.Mul64(10), false},
+		{"1.5KS", types.SiacoinPrecision.Mul64(1500), false},
+		{"2TS", types.SiacoinPrecision.Mul64(2e12), false},
+		{"0SC", types.ZeroCurrency, false},
+		{"100", types.Currency{}, true},
+		{"", types.Currency{}, true},
+		{"fooSC", types.Currency{}, true},
+		{"0.5H", types.Currency{}, true},
+		{"0.0000000000001pS", types.Currency{}, true},
+		{"-1SC", types.Currency{}, true},
+	} {
+		var c currency
+		err := c.UnmarshalText([]byte(test.s))
+		if (err != nil) != test.err {
+			t.Errorf("%q: unexpected error %v", test.s, err)
+		} else if err == nil && !c.Equals(test.c) {
+			t.Errorf("%q: expected %v, got %v", test.s, test.c, c.Currency)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	for _, test := range []struct {
+		s   string
+		d   time.Duration
+		err bool
+	}{
+		{"10m", 10 * time.Minute, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"0s", 0, false},
+		{"0", 0, false},
+		{"10", 0, true},
+		{"", 0, true},
+		{"an hour", 0, true},
+	} {
+		var d duration
+		err := d.UnmarshalText([]byte(test.s))
+		if (err != nil) != test.err {
+			t.Errorf("%q: unexpected error %v", test.s, err)
+		} else if err == nil && d.Duration != test.d {
+			t.Errorf("%q: expected %v, got %v", test.s, test.d, d.Duration)
+		}
+	}
+}
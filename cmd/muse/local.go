@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gitlab.com/NebulousLabs/encoding"
+	"go.sia.tech/siad/build"
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/siad/modules"
+	"go.sia.tech/siad/types"
+)
+
+// The networks that muse can run on.
+const (
+	networkMainnet = "mainnet"
+	networkLocal   = "local"
+)
+
+// checkNetwork returns an error if muse cannot run on the specified network.
+// siad selects its consensus constants at compile time, so a chain run
+// in-process must match the constants the binary was built with.
+func checkNetwork(network string, inProcess bool) error {
+	switch network {
+	case networkMainnet:
+		if inProcess && build.Release != "standard" {
+			return fmt.Errorf("this binary was built with %v constants and cannot run on mainnet", build.Release)
+		}
+	case networkLocal:
+		if build.Release != "dev" {
+			return errors.New("local mode requires a binary built with dev constants (make dev)")
+		}
+	default:
+		return fmt.Errorf("unknown network %q (must be %v or %v)", network, networkMainnet, networkLocal)
+	}
+	return nil
+}
+
+// A localMiner mines blocks on a single-node chain, paying the block rewards
+// to addr. Mining on demand requires adminToken.
+type localMiner struct {
+	cs         modules.ConsensusSet
+	tp         modules.TransactionPool
+	addr       types.UnlockHash
+	adminToken string
+	mu         sync.Mutex
+}
+
+// mine mines n blocks containing the transactions in the transaction pool.
+func (m *localMiner) mine(n int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := 0; i < n; i++ {
+		parent := m.cs.CurrentBlock()
+		target, ok := m.cs.ChildTarget(parent.ID())
+		if !ok {
+			return errors.New("could not determine target of next block")
+		}
+		// blocks are timestamped a day apart (without exceeding the current
+		// time), so that the difficulty falls rather than rising as blocks
+		// are mined faster than the usual block frequency
+		timestamp := parent.Timestamp + 24*60*60
+		if now := types.CurrentTimestamp(); timestamp > now {
+			timestamp = now
+		}
+		b := types.Block{
+			ParentID:     parent.ID(),
+			Timestamp:    timestamp,
+			Transactions: m.tp.TransactionList(),
+		}
+		b.MinerPayouts = []types.SiacoinOutput{{
+			Value:      b.CalculateSubsidy(m.cs.Height() + 1),
+			UnlockHash: m.addr,
+		}}
+		// the ASIC hardfork requires nonces to be multiples of the factor
+		header := encoding.Marshal(b.Header())
+		for nonce := uint64(0); ; nonce += types.ASICHardforkFactor {
+			binary.LittleEndian.PutUint64(header[32:40], nonce)
+			if id := crypto.HashBytes(header); bytes.Compare(target[:], id[:]) >= 0 {
+				break
+			}
+		}
+		copy(b.Nonce[:], header[32:40])
+		if err := m.cs.AcceptBlock(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fund mines enough blocks for the first block reward to mature and for the
+// chain to pass the Foundation hardfork, after which the wallet's signatures
+// are valid, if the chain has not already done so.
+func (m *localMiner) fund() error {
+	height := types.MaturityDelay + 1
+	if height <= types.FoundationHardforkHeight {
+		height = types.FoundationHardforkHeight + 1
+	}
+	if m.cs.Height() >= height {
+		return nil
+	}
+	log.Println("Mining initial blocks...")
+	return m.mine(int(height - m.cs.Height()))
+}
+
+// handleMine mines the number of blocks given by the "blocks" query parameter
+// (default 1), responding with the new chain height. Requests must carry the
+// admin token; if the server has none, blocks cannot be mined on demand.
+func (m *localMiner) handleMine(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if m.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(m.adminToken)) != 1 {
+		http.Error(w, "mining requires the admin token", http.StatusUnauthorized)
+		return
+	}
+	n := 1
+	if s := req.FormValue("blocks"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			http.Error(w, "invalid number of blocks", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := m.mine(n); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(m.cs.Height())
+}
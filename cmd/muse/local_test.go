@@ -0,0 +1,109 @@
+//go:build dev
+// +build dev
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.sia.tech/siad/types"
+	"lukechampine.com/us/wallet"
+)
+
+func TestLocalChain(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping local chain test in short mode")
+	}
+	cfg := defaultConfig()
+	cfg.Network = networkLocal
+	cfg.Dir = t.TempDir()
+	if err := checkNetwork(cfg.Network, true); err != nil {
+		t.Fatal(err)
+	}
+	sw, ltp, err := createWallet(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cs.Close()
+		g.Close()
+		cs, g = nil, nil
+	}()
+	hw := &localWallet{
+		HotWallet: wallet.NewHotWallet(sw, wallet.NewSeed()),
+		used:      make(map[types.SiacoinOutputID]bool),
+	}
+	addr, err := hw.Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+	miner := &localMiner{cs: cs, tp: ltp, addr: addr, adminToken: "admin"}
+	if err := miner.fund(); err != nil {
+		t.Fatal(err)
+	} else if sw.Balance(false).IsZero() {
+		t.Fatal("first block reward should be spendable")
+	}
+
+	// mining on demand requires the admin token
+	height := cs.Height()
+	for _, token := range []string{"", "wrong"} {
+		req := httptest.NewRequest(http.MethodPost, "/local/mine?blocks=2", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		miner.handleMine(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatal("expected 401, got", rec.Code)
+		}
+	}
+	req := httptest.NewRequest(http.MethodPost, "/local/mine?blocks=2", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	rec := httptest.NewRecorder()
+	miner.handleMine(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatal("mining failed:", rec.Body.String())
+	} else if cs.Height() != height+2 {
+		t.Fatal("wrong height:", cs.Height())
+	}
+
+	// a formed contract should be confirmed immediately
+	height = cs.Height()
+	payout := types.SiacoinPrecision
+	outputs := []types.SiacoinOutput{{Value: types.PostTax(height, payout), UnlockHash: addr}}
+	txn := types.Transaction{
+		FileContracts: []types.FileContract{{
+			WindowStart:        height + 10,
+			WindowEnd:          height + 20,
+			Payout:             payout,
+			ValidProofOutputs:  outputs,
+			MissedProofOutputs: outputs,
+			UnlockHash:         types.UnlockConditions{}.UnlockHash(),
+		}},
+	}
+	toSign, discard, err := hw.FundTransaction(&txn, payout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer discard()
+	if err := hw.SignTransaction(&txn, toSign); err != nil {
+		t.Fatal(err)
+	}
+	tp := localTxnPool{w: sw, tp: ltp, miner: miner}
+	if err := tp.AcceptTransactionSet([]types.Transaction{txn}); err != nil {
+		t.Fatal(err)
+	} else if cs.Height() != height+1 {
+		t.Fatal("wrong height:", cs.Height())
+	} else if _, ok := sw.Transaction(txn.ID()); !ok {
+		t.Fatal("contract transaction was not confirmed")
+	} else if len(ltp.TransactionList()) != 0 {
+		t.Fatal("transaction pool should be empty")
+	}
+	var found bool
+	for _, fc := range sw.FileContracts(-1) {
+		found = found || fc.ID == txn.FileContractID(0)
+	}
+	if !found {
+		t.Fatal("contract is not tracked by the wallet")
+	}
+}
@@ -1,24 +1,33 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/gorilla/handlers"
 	"go.sia.tech/siad/build"
+	"go.sia.tech/siad/crypto"
 	"go.sia.tech/siad/modules"
 	"go.sia.tech/siad/modules/consensus"
 	"go.sia.tech/siad/modules/gateway"
 	"go.sia.tech/siad/modules/transactionpool"
+	"go.sia.tech/siad/types"
 	"golang.org/x/term"
 	"lukechampine.com/muse"
 	"lukechampine.com/shard"
+	"lukechampine.com/us/renter/proto"
 	"lukechampine.com/us/wallet"
 	"lukechampine.com/walrus"
 )
@@ -51,13 +60,9 @@ func getSeed() wallet.Seed {
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile | log.Lmicroseconds)
-	apiAddr := flag.String("a", ":9580", "host:port that the API server listens on")
-	walrusAddr := flag.String("w", "localhost:9380", "host:port of the walrus server")
-	serveWalrus := flag.Bool("serve-walrus", false, "run a walrus server (on the addr given by -w)")
-	shardAddr := flag.String("s", "localhost:9480", "host:port of the shard server")
-	serveShard := flag.Bool("serve-shard", false, "run a shard server (on the addr given by -s)")
-	dir := flag.String("d", ".", "directory where server state is stored")
-	verbose := flag.Bool("verbose", false, "print verbose logging to stderr")
+	flagCfg := defaultConfig()
+	flagCfg.bindFlags(flag.CommandLine)
+	configPath := flag.String("config", "", "TOML file containing server configuration (overridden by flags)")
 	flag.Parse()
 
 	if len(flag.Args()) == 1 && flag.Arg(0) == "version" {
@@ -69,109 +74,355 @@ func main() {
 		return
 	}
 
-	if *serveWalrus {
-		if err := createWalletServer(*walrusAddr, *dir, *verbose); err != nil {
-			log.Fatalln("Couldn't initialize walrus server:", err)
+	overrides := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			overrides[f.Name] = f.Value.String()
 		}
-		log.Println("Started walrus server at", *walrusAddr)
-		*walrusAddr = "http://" + *walrusAddr
+	})
+	cfg, err := loadConfig(*configPath, overrides)
+	if err != nil {
+		log.Fatalln("Could not load config:", err)
+	} else if err := checkNetwork(cfg.Network, cfg.Walrus.Serve || cfg.Shard.Serve); err != nil {
+		log.Fatalln(err)
+	}
+	if cfg.Network == networkLocal {
+		// a local chain has no peers, so the wallet and shard relay must run
+		// in-process; its state is kept apart from that of other networks
+		cfg.Walrus.Serve = true
+		cfg.Shard.Serve = true
+		cfg.Dir = filepath.Join(cfg.Dir, networkLocal)
+		if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+			log.Fatalln("Could not create state directory:", err)
+		}
+	}
+	if cfg.Log.File != "" {
+		f, err := os.OpenFile(cfg.Log.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0660)
+		if err != nil {
+			log.Fatalln("Could not open log file:", err)
+		}
+		defer f.Close()
+		log.SetOutput(f)
+		logOutput = f
+	}
+	setVerbose(cfg.Log.Verbose)
+	var limits atomic.Value
+	limits.Store(cfg.contractLimits())
+
+	var w proto.Wallet
+	var tp proto.TransactionPool
+	var balance func() (types.Currency, error)
+	var miner *localMiner
+	if cfg.Walrus.Serve {
+		sw, ltp, err := createWallet(cfg)
+		if err != nil {
+			log.Fatalln("Couldn't initialize wallet:", err)
+		}
+		// when running in-process, only expose the walrus API if its address
+		// was specified
+		if cfg.exposeWalrus {
+			if err := serveAPI(cfg.Walrus.Addr, walrus.NewServer(sw, ltp)); err != nil {
+				log.Fatalln("Couldn't start walrus server:", err)
+			}
+			log.Println("Started walrus server at", cfg.Walrus.Addr)
+		}
+		hw := newLocalWallet(sw, getSeed())
+		if cfg.Network == networkLocal {
+			addr, err := hw.Address()
+			if err != nil {
+				log.Fatalln("Couldn't generate mining address:", err)
+			}
+			miner = &localMiner{cs: cs, tp: ltp, addr: addr, adminToken: cfg.AdminToken}
+			if err := miner.fund(); err != nil {
+				log.Fatalln("Couldn't mine initial blocks:", err)
+			}
+		}
+		w = hw
+		tp = localTxnPool{w: sw, tp: ltp, miner: miner}
+		balance = func() (types.Currency, error) { return sw.Balance(false), nil }
 	} else {
-		log.Println("Connecting to walrus server at", *walrusAddr)
-		if _, err := walrus.NewClient(*walrusAddr).Balance(false); err != nil {
+		log.Println("Connecting to walrus server at", cfg.Walrus.Addr)
+		wc := walrus.NewClient(cfg.Walrus.Addr)
+		if _, err := wc.Balance(false); err != nil {
 			log.Println("WARNING: walrus server not reachable")
 		}
+		w = wc.ProtoWallet(getSeed())
+		tp = wc.ProtoTransactionPool()
+		balance = func() (types.Currency, error) { return wc.Balance(false) }
 	}
-	if *serveShard {
-		if err := createShardServer(*shardAddr, *dir, *verbose); err != nil {
-			log.Fatalln("Couldn't initialize shard server:", err)
+	var sh muse.Shard
+	if cfg.Shard.Serve {
+		r, err := createRelay(cfg)
+		if err != nil {
+			log.Fatalln("Couldn't initialize shard relay:", err)
+		}
+		if cfg.exposeShard {
+			if err := serveAPI(cfg.Shard.Addr, shard.NewServer(r)); err != nil {
+				log.Fatalln("Couldn't start shard server:", err)
+			}
+			log.Println("Started shard server at", cfg.Shard.Addr)
 		}
-		log.Println("Started shard server at", *shardAddr)
-		*shardAddr = "http://" + *shardAddr
+		sh = muse.LocalShard(r)
 	} else {
-		log.Println("Connecting to shard server at", *shardAddr)
-		if _, err := shard.NewClient(*shardAddr).ChainHeight(); err != nil {
+		log.Println("Connecting to shard server at", cfg.Shard.Addr)
+		if _, err := shard.NewClient(cfg.Shard.Addr).ChainHeight(); err != nil {
 			log.Println("WARNING: shard server not reachable")
 		}
+		sh = muse.RemoteShard(cfg.Shard.Addr)
 	}
 
-	wc := walrus.NewClient(*walrusAddr)
-	srv, err := muse.NewServer(*dir, wc.ProtoWallet(getSeed()), wc.ProtoTransactionPool(), *shardAddr)
+	var opts []muse.ServerOption
+	if cfg.Monitor.Interval.Duration > 0 {
+		opts = append(opts, muse.WithMonitor(cfg.Monitor.Interval.Duration, types.BlockHeight(cfg.Renewal.ExpiryWindow)))
+		if cfg.Monitor.MinBalance > 0 {
+			opts = append(opts, muse.WithBalanceAlert(balance, types.SiacoinPrecision.Mul64(cfg.Monitor.MinBalance)))
+		}
+	}
+	opts = append(opts, muse.WithRuleInterval(cfg.Monitor.ResolveInterval.Duration))
+	if cfg.Monitor.HostScanInterval.Duration > 0 {
+		opts = append(opts, muse.WithHostMonitor(cfg.Monitor.HostScanInterval.Duration, cfg.Monitor.MinHostStorage*1e9, cfg.Monitor.PriceChange))
+	}
+	if len(cfg.Shard.Extra) > 0 || cfg.Shard.Quorum > 0 {
+		var shards []muse.Shard
+		for _, addr := range cfg.Shard.Extra {
+			shards = append(shards, muse.RemoteShard(addr))
+		}
+		opts = append(opts, muse.WithShards(shards, cfg.Shard.Quorum))
+	}
+	if cfg.Cache.AddrTTL.Duration > 0 || cfg.Cache.ScanTTL.Duration > 0 {
+		opts = append(opts, muse.WithHostCache(cfg.Cache.AddrTTL.Duration, cfg.Cache.ScanTTL.Duration))
+	}
+	opts = append(opts, muse.WithContractLimits(func() muse.ContractLimits {
+		return limits.Load().(muse.ContractLimits)
+	}))
+	if cfg.AdminToken != "" {
+		opts = append(opts, muse.WithAdminToken(cfg.AdminToken))
+	}
+	tenants := make(chan map[string]muse.TenantConfig, 1)
+	tenants <- cfg.tenantConfigs()
+	opts = append(opts, muse.WithTenants(tenants))
+	srv, err := muse.NewServer(cfg.Dir, w, tp, sh, opts...)
 	if err != nil {
 		log.Fatalln("Could not initialize server:", err)
 	}
 
-	log.Printf("Listening on %v...", *apiAddr)
-	log.Fatal(http.ListenAndServe(*apiAddr, loggingHandler(*verbose, handlers.CompressHandler(srv))))
+	go func() {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		for range sighup {
+			next, err := loadConfig(*configPath, overrides)
+			if err != nil {
+				log.Println("WARN: could not reload config:", err)
+				continue
+			}
+			setVerbose(next.Log.Verbose)
+			limits.Store(next.contractLimits())
+			tenants <- next.tenantConfigs()
+			log.Println("Reloaded config")
+		}
+	}()
+
+	h := srv
+	if miner != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/", srv)
+		mux.HandleFunc("/local/mine", miner.handleMine)
+		h = mux
+		log.Println("Running a local chain at height", cs.Height())
+	}
+
+	log.Printf("Listening on %v...", cfg.APIAddr)
+	log.Fatal(http.ListenAndServe(cfg.APIAddr, loggingHandler(handlers.CompressHandler(h))))
 }
 
-// global vars to make it easier to compose createShardServer and createWalletServer
+// global vars to make it easier to compose createRelay and createWallet
 // (yeah yeah, sue me)
 var (
 	g  modules.Gateway
 	cs modules.ConsensusSet
 )
 
-func createShardServer(addr, dir string, verbose bool) (err error) {
+func loadConsensus(cfg config) (err error) {
+	// a local chain neither connects to peers nor waits to sync with them
+	bootstrap := cfg.Network != networkLocal
 	if g == nil {
-		g, err = gateway.New(":9381", true, filepath.Join(dir, "gateway"))
+		// if bootstrap peers are configured, connect to them instead of the
+		// default peers
+		addr, peers := cfg.Gateway.Addr, cfg.Gateway.Bootstrap
+		if !bootstrap {
+			addr, peers = "localhost:0", nil
+		}
+		g, err = gateway.New(addr, bootstrap && len(peers) == 0, filepath.Join(cfg.Dir, "gateway"))
 		if err != nil {
 			return err
 		}
+		go func() {
+			for _, peer := range peers {
+				if err := g.Connect(modules.NetAddress(peer)); err != nil {
+					log.Printf("WARN: could not connect to bootstrap peer %v: %v", peer, err)
+				}
+			}
+		}()
 	}
 	if cs == nil {
 		var errChan <-chan error
-		cs, errChan = consensus.New(g, true, filepath.Join(dir, "consensus"))
+		cs, errChan = consensus.New(g, bootstrap, filepath.Join(cfg.Dir, "consensus"))
 		err = handleAsyncErr(errChan)
 		if err != nil {
 			return err
 		}
 	}
-	// muse expects a shard URL, not an interface, so start up a server and
-	// return the address it's listening on. This is kind of gross.
-	r, err := shard.NewRelay(cs, shard.NewJSONPersist(dir))
+	return nil
+}
+
+func createRelay(cfg config) (*shard.Relay, error) {
+	if err := loadConsensus(cfg); err != nil {
+		return nil, err
+	}
+	return shard.NewRelay(cs, shard.NewJSONPersist(cfg.Dir))
+}
+
+func createWallet(cfg config) (*wallet.SeedWallet, modules.TransactionPool, error) {
+	if err := loadConsensus(cfg); err != nil {
+		return nil, nil, err
+	}
+	tp, err := transactionpool.New(cs, g, filepath.Join(cfg.Dir, "tpool"))
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	l, err := net.Listen("tcp", addr)
+	store, err := wallet.NewBoltDBStore(filepath.Join(cfg.Dir, "wallet.db"), nil)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	go http.Serve(l, loggingHandler(verbose, handlers.CompressHandler(shard.NewServer(r))))
-	return nil
+	w := wallet.New(store)
+	if err := cs.ConsensusSetSubscribe(w.ConsensusSetSubscriber(store), store.ConsensusChangeID(), nil); err != nil {
+		return nil, nil, err
+	}
+	return w, tp, nil
 }
 
-func createWalletServer(addr, dir string, verbose bool) (err error) {
-	if g == nil {
-		g, err = gateway.New(":9381", true, filepath.Join(dir, "gateway"))
-		if err != nil {
-			return err
+// localWallet implements proto.Wallet using an in-process HotWallet. It funds
+// transactions itself, because wallet.NewHotWallet does not initialize the
+// set of claimed outputs, causing HotWallet.FundTransaction to panic.
+type localWallet struct {
+	*wallet.HotWallet
+	mu   sync.Mutex
+	used map[types.SiacoinOutputID]bool
+}
+
+// newLocalWallet returns a localWallet for the provided wallet and seed.
+func newLocalWallet(sw *wallet.SeedWallet, seed wallet.Seed) *localWallet {
+	return &localWallet{
+		HotWallet: wallet.NewHotWallet(sw, seed),
+		used:      make(map[types.SiacoinOutputID]bool),
+	}
+}
+
+// FundTransaction implements proto.Wallet.
+func (lw *localWallet) FundTransaction(txn *types.Transaction, amount types.Currency) ([]crypto.Hash, func(), error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if amount.IsZero() {
+		return nil, func() {}, nil
+	}
+	// only spend confirmed outputs that are neither spent by a Limbo
+	// transaction nor claimed by another call
+	unspent := make(map[types.SiacoinOutputID]bool)
+	for _, o := range lw.UnspentOutputs(true) {
+		unspent[o.ID] = true
+	}
+	var inputs []wallet.ValuedInput
+	for _, o := range lw.UnspentOutputs(false) {
+		info, ok := lw.AddressInfo(o.UnlockHash)
+		if !unspent[o.ID] || lw.used[o.ID] || !ok {
+			continue
 		}
+		inputs = append(inputs, wallet.ValuedInput{
+			SiacoinInput: types.SiacoinInput{
+				ParentID:         o.ID,
+				UnlockConditions: info.UnlockConditions,
+			},
+			Value: o.Value,
+		})
 	}
-	if cs == nil {
-		var errChan <-chan error
-		cs, errChan = consensus.New(g, true, filepath.Join(dir, "consensus"))
-		err = handleAsyncErr(errChan)
+	inputs, change, ok := wallet.FundAtLeast(amount, inputs)
+	if !ok {
+		return nil, nil, wallet.ErrInsufficientFunds
+	}
+	if !change.IsZero() {
+		addr, err := lw.Address()
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
+		txn.SiacoinOutputs = append(txn.SiacoinOutputs, types.SiacoinOutput{
+			UnlockHash: addr,
+			Value:      change,
+		})
 	}
-	tp, err := transactionpool.New(cs, g, filepath.Join(dir, "tpool"))
-	if err != nil {
-		return err
+	toSign := make([]crypto.Hash, len(inputs))
+	for i, in := range inputs {
+		txn.SiacoinInputs = append(txn.SiacoinInputs, in.SiacoinInput)
+		toSign[i] = crypto.Hash(in.ParentID)
+		txn.TransactionSignatures = append(txn.TransactionSignatures, wallet.StandardTransactionSignature(toSign[i]))
+		lw.used[in.ParentID] = true
 	}
-	store, err := wallet.NewBoltDBStore(filepath.Join(dir, "wallet.db"), nil)
-	if err != nil {
+	discard := func() {
+		lw.mu.Lock()
+		defer lw.mu.Unlock()
+		for _, in := range inputs {
+			delete(lw.used, in.ParentID)
+		}
+	}
+	return toSign, discard, nil
+}
+
+// localTxnPool implements proto.TransactionPool using an in-process
+// transaction pool, tracking relevant transactions in the wallet's limbo as the
+// walrus server does. On a local chain, a block is mined for each accepted
+// transaction set, confirming it immediately.
+type localTxnPool struct {
+	w     *wallet.SeedWallet
+	tp    modules.TransactionPool
+	miner *localMiner
+}
+
+func (ltp localTxnPool) AcceptTransactionSet(txnSet []types.Transaction) error {
+	// ignore duplicate error -- if the set is already in the tpool, great
+	err := ltp.tp.AcceptTransactionSet(txnSet)
+	if err != nil && !errors.Is(err, modules.ErrDuplicateTransactionSet) {
 		return err
 	}
-	w := wallet.New(store)
-	err = cs.ConsensusSetSubscribe(w.ConsensusSetSubscriber(store), store.ConsensusChangeID(), nil)
+	for _, txn := range txnSet {
+		if wallet.RelevantTransaction(ltp.w, txn) {
+			ltp.w.AddToLimbo(txn)
+		}
+	}
+	if ltp.miner != nil {
+		return ltp.miner.mine(1)
+	}
+	return nil
+}
+
+func (ltp localTxnPool) UnconfirmedParents(txn types.Transaction) ([]types.Transaction, error) {
+	limbo := wallet.UnconfirmedParents(txn, ltp.w.LimboTransactions())
+	parents := make([]types.Transaction, len(limbo))
+	for i := range limbo {
+		parents[i] = limbo[i].Transaction
+	}
+	return parents, nil
+}
+
+func (ltp localTxnPool) FeeEstimate() (min, max types.Currency, err error) {
+	median, _ := ltp.tp.FeeEstimation()
+	return median, median.Mul64(3), nil
+}
 
-	// same grossness as above
+func serveAPI(addr string, h http.Handler) error {
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
-	go http.Serve(l, loggingHandler(verbose, handlers.CompressHandler(walrus.NewServer(w, tp))))
+	go http.Serve(l, loggingHandler(handlers.CompressHandler(h)))
 	return nil
 }
 
@@ -190,9 +441,28 @@ func handleAsyncErr(errCh <-chan error) error {
 	return nil
 }
 
-func loggingHandler(verbose bool, h http.Handler) http.Handler {
-	if !verbose {
-		return h
+// verbose logging can be toggled by reloading the config, so it is stored
+// globally
+var (
+	verbose   int32
+	logOutput io.Writer = os.Stderr
+)
+
+func setVerbose(v bool) {
+	if v {
+		atomic.StoreInt32(&verbose, 1)
+	} else {
+		atomic.StoreInt32(&verbose, 0)
 	}
-	return handlers.LoggingHandler(os.Stderr, h)
+}
+
+func loggingHandler(h http.Handler) http.Handler {
+	lh := handlers.LoggingHandler(logOutput, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&verbose) == 1 {
+			lh.ServeHTTP(w, req)
+		} else {
+			h.ServeHTTP(w, req)
+		}
+	})
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"go.sia.tech/siad/modules"
+	"go.sia.tech/siad/types"
+	"lukechampine.com/us/wallet"
+)
+
+func TestLocalWallet(t *testing.T) {
+	store := wallet.NewEphemeralStore()
+	lw := newLocalWallet(wallet.New(store), wallet.NewSeed())
+	addr, err := lw.Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// give the wallet a single confirmed output
+	output := wallet.UnspentOutput{
+		SiacoinOutput: types.SiacoinOutput{
+			UnlockHash: addr,
+			Value:      types.SiacoinPrecision.Mul64(10),
+		},
+		ID: types.SiacoinOutputID{1},
+	}
+	store.ApplyConsensusChange(wallet.ProcessedConsensusChange{}, wallet.ProcessedConsensusChange{
+		Outputs:    []wallet.UnspentOutput{output},
+		BlockCount: 1,
+	}, modules.ConsensusChangeID{1})
+
+	var txn types.Transaction
+	toSign, discard, err := lw.FundTransaction(&txn, types.SiacoinPrecision.Mul64(4))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(txn.SiacoinInputs) != 1 || txn.SiacoinInputs[0].ParentID != output.ID {
+		t.Fatal("transaction was not funded with the wallet's output:", txn.SiacoinInputs)
+	} else if len(txn.SiacoinOutputs) != 1 || !txn.SiacoinOutputs[0].Value.Equals(types.SiacoinPrecision.Mul64(6)) {
+		t.Fatal("transaction has wrong change output:", txn.SiacoinOutputs)
+	} else if err := lw.SignTransaction(&txn, toSign); err != nil {
+		t.Fatal(err)
+	} else if err := txn.StandaloneValid(types.FoundationHardforkHeight + 1); err != nil {
+		t.Fatal("transaction is not valid:", err)
+	}
+
+	// the output is claimed until the transaction is discarded
+	var txn2 types.Transaction
+	if _, _, err := lw.FundTransaction(&txn2, types.SiacoinPrecision); !errors.Is(err, wallet.ErrInsufficientFunds) {
+		t.Fatal("expected insufficient funds, got", err)
+	}
+	discard()
+	if _, _, err := lw.FundTransaction(&txn2, types.SiacoinPrecision); err != nil {
+		t.Fatal(err)
+	}
+}
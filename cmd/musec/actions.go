@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"math/big"
 	"os"
+	"sort"
 	"strings"
 	"text/tabwriter"
 	"time"
@@ -19,7 +20,7 @@ import (
 )
 
 func form(museAddr, hostPrefix string, funds types.Currency, endStr string) error {
-	mc := muse.NewClient(museAddr)
+	mc := newClient(museAddr)
 	sc := mc.SHARD()
 	start, err := sc.ChainHeight()
 	if err != nil {
@@ -42,14 +43,22 @@ func form(museAddr, hostPrefix string, funds types.Currency, endStr string) erro
 		PublicKey:    hostKey,
 	}, funds, start, end)
 	if err != nil {
-		return err
+		return explainNotSynced(err)
 	}
 	fmt.Println("Formed contract", c.ID)
 	return nil
 }
 
+// explainNotSynced replaces a not_synced error with a more helpful message.
+func explainNotSynced(err error) error {
+	if errors.Is(err, muse.ErrNotSynced) {
+		return errors.New("muse's shard server is not synced with the Sia network; wait for it to finish syncing and try again")
+	}
+	return err
+}
+
 func renew(museAddr, id string, funds types.Currency, endStr string) error {
-	mc := muse.NewClient(museAddr)
+	mc := newClient(museAddr)
 	sc := mc.SHARD()
 
 	var fcid types.FileContractID
@@ -90,14 +99,14 @@ func renew(museAddr, id string, funds types.Currency, endStr string) error {
 		PublicKey:    old.HostKey,
 	}, &old.Contract, funds, start, end)
 	if err != nil {
-		return err
+		return explainNotSynced(err)
 	}
 	fmt.Println("Renewed contract:", rc.ID)
 	return nil
 }
 
 func listContracts(museAddr, hostset string) error {
-	c := muse.NewClient(museAddr)
+	c := newClient(museAddr)
 	var contracts []muse.Contract
 	var err error
 	if hostset != "" {
@@ -122,21 +131,33 @@ func listContracts(museAddr, hostset string) error {
 }
 
 func listHosts(museAddr string) error {
-	c := muse.NewClient(museAddr)
-	sets, err := c.HostSets()
+	c := newClient(museAddr)
+	infos, err := c.HostSetInfos()
 	if err != nil {
 		return err
 	}
-	if len(sets) == 0 {
+	if len(infos) == 0 {
 		fmt.Println("No host sets.")
 		return nil
 	}
-	for _, setName := range sets {
-		set, err := c.HostSet(setName)
+	for _, info := range infos {
+		set, err := c.HostSet(info.Name)
 		if err != nil {
 			return err
 		}
-		fmt.Printf("%s (%v hosts):", setName, len(set))
+		fmt.Printf("%s (%v hosts)", info.Name, len(set))
+		if info.Dynamic {
+			fmt.Print(" [rules]")
+		} else if info.Expression != "" {
+			fmt.Printf(" = %s", info.Expression)
+		}
+		if md := info.Metadata; md.Description != "" {
+			fmt.Printf(" - %s", md.Description)
+		}
+		fmt.Print(":")
+		for _, w := range info.Warnings {
+			fmt.Printf("\n  Warning: %s", w)
+		}
 		for i := range set {
 			if i%5 == 0 {
 				fmt.Printf("\n  ")
@@ -149,7 +170,7 @@ func listHosts(museAddr string) error {
 }
 
 func createHostSet(museAddr string, setName string, hostPrefixes []string) error {
-	c := muse.NewClient(museAddr)
+	c := newClient(museAddr)
 	sc := c.SHARD()
 	hosts := make([]hostdb.HostPublicKey, len(hostPrefixes))
 	for i := range hosts {
@@ -168,7 +189,7 @@ func createHostSet(museAddr string, setName string, hostPrefixes []string) error
 }
 
 func deleteHostSet(museAddr string, setName string) error {
-	c := muse.NewClient(museAddr)
+	c := newClient(museAddr)
 	err := c.SetHostSet(setName, nil)
 	if err != nil {
 		return err
@@ -178,57 +199,276 @@ func deleteHostSet(museAddr string, setName string) error {
 }
 
 func addHost(museAddr string, setName string, host string) error {
-	c := muse.NewClient(museAddr)
+	c := newClient(museAddr)
 	hostKey, err := c.SHARD().LookupHost(host)
 	if err != nil {
 		return err
 	}
-	hosts, err := c.HostSet(setName)
+	resp, err := c.AddToHostSet(setName, hostKey)
 	if err != nil {
 		return err
+	} else if len(resp.Changed) == 0 {
+		fmt.Printf("Host %v is already in host set %q\n", hostKey.ShortKey(), setName)
+		return nil
 	}
-	for _, h := range hosts {
-		if h == hostKey {
-			fmt.Printf("Host %v is already in host set %q\n", hostKey.ShortKey(), setName)
-			return nil
+	fmt.Printf("Added host %v to host set %q\n", hostKey.ShortKey(), setName)
+	return nil
+}
+
+func removeHost(museAddr string, setName string, host string) error {
+	c := newClient(museAddr)
+	hostKey, err := c.SHARD().LookupHost(host)
+	if err != nil {
+		return err
+	}
+	resp, err := c.RemoveFromHostSet(setName, hostKey)
+	if err != nil {
+		return err
+	} else if len(resp.Changed) == 0 {
+		fmt.Printf("Host %v is not in host set %q\n", hostKey.ShortKey(), setName)
+		return nil
+	}
+	fmt.Printf("Removed host %v from host set %q\n", hostKey.ShortKey(), setName)
+	return nil
+}
+
+func hostSetHistory(museAddr string, setName string) error {
+	c := newClient(museAddr)
+	revs, err := c.HostSetHistory(setName)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Version\tTime\tActor\tAction\tHosts\n")
+	for _, rev := range revs {
+		actor := rev.Actor
+		if rev.Note != "" {
+			actor += " (" + rev.Note + ")"
 		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", rev.Version, rev.Timestamp.Format(time.RFC3339), actor, rev.Action, len(rev.Hosts))
 	}
-	hosts = append(hosts, hostKey)
-	err = c.SetHostSet(setName, hosts)
+	return tw.Flush()
+}
+
+func rollbackHostSet(museAddr string, setName string, version uint64) error {
+	c := newClient(museAddr)
+	rev, err := c.RollbackHostSet(setName, version)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Added host %v to host set %q\n", hostKey.ShortKey(), setName)
+	if len(rev.Hosts) == 0 {
+		fmt.Printf("Rolled back host set %q to version %v (deleted)\n", setName, version)
+	} else {
+		fmt.Printf("Rolled back host set %q to version %v (%v hosts)\n", setName, version, len(rev.Hosts))
+	}
 	return nil
 }
 
-func removeHost(museAddr string, setName string, host string) error {
-	c := muse.NewClient(museAddr)
-	hostKey, err := c.SHARD().LookupHost(host)
+func hostSetMetadata(museAddr string, setName string, edit func(*muse.HostSetMetadata)) error {
+	c := newClient(museAddr)
+	md, err := c.HostSetMetadata(setName)
+	if err != nil {
+		return err
+	}
+	if edit != nil {
+		edit(&md)
+		if err := c.SetHostSetMetadata(setName, md); err != nil {
+			return err
+		}
+		fmt.Printf("Updated metadata of host set %q\n", setName)
+		return nil
+	}
+	labels := make([]string, 0, len(md.Labels))
+	for k, v := range md.Labels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Owner:\t%v\n", md.Owner)
+	fmt.Fprintf(tw, "Description:\t%v\n", md.Description)
+	fmt.Fprintf(tw, "Labels:\t%v\n", strings.Join(labels, ", "))
+	fmt.Fprintf(tw, "Min hosts:\t%v\n", md.MinHosts)
+	fmt.Fprintf(tw, "Contract funds:\t%v\n", currencyUnits(md.Contract.Funds))
+	fmt.Fprintf(tw, "Contract duration:\t%v blocks\n", md.Contract.Duration)
+	diversity := md.Diversity
+	if diversity == "" {
+		diversity = muse.DiversityWarn
+	}
+	fmt.Fprintf(tw, "Diversity policy:\t%v\n", diversity)
+	return tw.Flush()
+}
+
+func hostSetDiversity(museAddr string, setName string) error {
+	violations, err := newClient(museAddr).HostSetDiversity(setName)
+	if err != nil {
+		return err
+	} else if len(violations) == 0 {
+		fmt.Printf("No hosts in host set %q share a subnet or hostname\n", setName)
+		return nil
+	}
+	for _, v := range violations {
+		fmt.Printf("%v hosts share %v %v:\n", len(v.Hosts), v.Reason, v.Group)
+		for _, h := range v.Hosts {
+			fmt.Printf("    %v\n", h)
+		}
+	}
+	return nil
+}
+
+func hostSetRules(museAddr string, setName string, candidatePrefixes []string, rules *muse.HostSetRules) error {
+	c := newClient(museAddr)
+	if rules == nil {
+		rules, err := c.HostSetRules(setName)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		candidates := "hosts of existing contracts"
+		if len(rules.Candidates) > 0 {
+			candidates = fmt.Sprintf("%v hosts", len(rules.Candidates))
+		}
+		fmt.Fprintf(tw, "Candidates:\t%v\n", candidates)
+		if !rules.MaxStoragePrice.IsZero() {
+			fmt.Fprintf(tw, "Max storage price:\t%v\n", currencyUnits(rules.MaxStoragePrice))
+		}
+		if rules.MinRemainingStorage > 0 {
+			fmt.Fprintf(tw, "Min remaining storage:\t%v\n", filesizeUnits(int64(rules.MinRemainingStorage)))
+		}
+		fmt.Fprintf(tw, "Accepting contracts:\t%v\n", rules.AcceptingContracts)
+		if rules.MinVersion != "" {
+			fmt.Fprintf(tw, "Min version:\t%v\n", rules.MinVersion)
+		}
+		if len(rules.ExcludedSubnets) > 0 {
+			fmt.Fprintf(tw, "Excluded subnets:\t%v\n", strings.Join(rules.ExcludedSubnets, ", "))
+		}
+		return tw.Flush()
+	}
+
+	sc := c.SHARD()
+	for _, prefix := range candidatePrefixes {
+		hostKey, err := sc.LookupHost(prefix)
+		if err != nil {
+			return err
+		}
+		rules.Candidates = append(rules.Candidates, hostKey)
+	}
+	hosts, err := c.SetHostSetRules(setName, rules)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Host set %q is now defined by rules (%v hosts currently match)\n", setName, len(hosts))
+	return nil
+}
+
+func clearHostSetRules(museAddr string, setName string) error {
+	hosts, err := newClient(museAddr).SetHostSetRules(setName, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed rules from host set %q (%v hosts kept)\n", setName, len(hosts))
+	return nil
+}
+
+func refreshHostSet(museAddr string, setName string) error {
+	hosts, err := newClient(museAddr).RefreshHostSet(setName)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Host set %q has %v hosts\n", setName, len(hosts))
+	return nil
+}
+
+func composeHostSet(museAddr string, setName string, expr string) error {
+	c := newClient(museAddr)
+	if expr == "" {
+		expr, err := c.HostSetExpression(setName)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s = %s\n", setName, expr)
+		return nil
+	}
+	hosts, err := c.ComposeHostSet(setName, expr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Host set %q is now %s (%v hosts)\n", setName, expr, len(hosts))
+	return nil
+}
+
+func decomposeHostSet(museAddr string, setName string) error {
+	hosts, err := newClient(museAddr).ComposeHostSet(setName, "")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Host set %q is now a static host set (%v hosts)\n", setName, len(hosts))
+	return nil
+}
+
+// accessList returns the entries of the blocklist (if block is true) or the
+// allowlist, along with a function that replaces them.
+func accessList(c *muse.Client, block bool) ([]muse.AccessEntry, func([]muse.AccessEntry) error, error) {
+	if block {
+		entries, err := c.Blocklist()
+		return entries, c.SetBlocklist, err
+	}
+	entries, err := c.Allowlist()
+	return entries, c.SetAllowlist, err
+}
+
+func listAccessList(museAddr string, block bool) error {
+	entries, _, err := accessList(newClient(museAddr), block)
+	if err != nil {
+		return err
+	} else if len(entries) == 0 {
+		fmt.Println("No entries")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Entry\tReason\n")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%v\t%v\n", e.Entry, e.Reason)
+	}
+	return tw.Flush()
+}
+
+func addAccessEntry(museAddr string, block bool, entry muse.AccessEntry) error {
+	entries, set, err := accessList(newClient(museAddr), block)
 	if err != nil {
 		return err
 	}
-	hosts, err := c.HostSet(setName)
+	for i, e := range entries {
+		if e.Entry == entry.Entry {
+			entries = append(entries[:i], entries[i+1:]...)
+			break
+		}
+	}
+	if err := set(append(entries, entry)); err != nil {
+		return err
+	}
+	fmt.Printf("Added %v\n", entry.Entry)
+	return nil
+}
+
+func removeAccessEntry(museAddr string, block bool, entry string) error {
+	entries, set, err := accessList(newClient(museAddr), block)
 	if err != nil {
 		return err
 	}
-	for i, h := range hosts {
-		if h == hostKey {
-			hosts = append(hosts[:i], hosts[i+1:]...)
-			err = c.SetHostSet(setName, hosts)
-			if err != nil {
+	for i, e := range entries {
+		if e.Entry == entry {
+			if err := set(append(entries[:i], entries[i+1:]...)); err != nil {
 				return err
 			}
-			fmt.Printf("Removed host %v from host set %q\n", hostKey.ShortKey(), setName)
+			fmt.Printf("Removed %v\n", entry)
 			return nil
 		}
 	}
-	fmt.Printf("Host %v is not in host set %q\n", hostKey.ShortKey(), setName)
-	return nil
+	return fmt.Errorf("no entry %q", entry)
 }
 
 func scan(museAddr, hostKeyPrefix string, bytes uint64, duration types.BlockHeight) error {
-	c := muse.NewClient(museAddr)
+	c := newClient(museAddr)
 	sc := c.SHARD()
 
 	currentHeight, err := sc.ChainHeight()
@@ -239,11 +479,19 @@ func scan(museAddr, hostKeyPrefix string, bytes uint64, duration types.BlockHeig
 	if err != nil {
 		return errors.Wrap(err, "could not lookup host")
 	}
-	host, err := c.Scan(hostKey)
+	rs, err := c.ScanChanges(hostKey)
 	if err != nil {
 		return errors.Wrap(err, "could not scan host")
 	}
+	host := rs.HostSettings
 
+	for _, change := range rs.Changes {
+		verb := "increased"
+		if change.New.Cmp(change.Old) < 0 {
+			verb = "decreased"
+		}
+		fmt.Printf("Warning: host %v %v since last scan: %v -> %v\n", verb, change.Field, currencyUnits(change.Old), currencyUnits(change.New))
+	}
 	if !host.AcceptingContracts {
 		fmt.Printf("Warning: host is not accepting contracts\n")
 	} else if host.RemainingStorage < bytes {
@@ -313,8 +561,89 @@ Transaction Cost: %8v (this is the amount that will be deducted from your wallet
 	return nil
 }
 
+func scanMany(museAddr, setName string, concurrency int, timeout time.Duration) error {
+	results, err := newClient(museAddr).ScanMany(muse.RequestScanBatch{
+		HostSet:     setName,
+		Concurrency: concurrency,
+		TimeoutMS:   timeout.Milliseconds(),
+	})
+	if err != nil {
+		return err
+	}
+	var total, ok int
+	for r := range results {
+		total++
+		status := "ok"
+		if r.Error != nil {
+			status = r.Error.Message
+		} else {
+			ok++
+			if !r.Settings.AcceptingContracts {
+				status = "not accepting contracts"
+			} else if len(r.Changes) > 0 {
+				fields := make([]string, len(r.Changes))
+				for i, change := range r.Changes {
+					fields[i] = change.Field
+				}
+				status = "changed " + strings.Join(fields, ", ")
+			}
+		}
+		addr := string(r.Address)
+		if addr == "" {
+			addr = "?"
+		}
+		latency := "-"
+		if r.LatencyMS > 0 {
+			latency = fmt.Sprintf("%.0fms", r.LatencyMS)
+		}
+		fmt.Printf("%v  %-30v %8v  %v\n", r.HostKey.ShortKey(), addr, latency, status)
+	}
+	fmt.Printf("%v of %v hosts responded\n", ok, total)
+	return nil
+}
+
+func showHost(museAddr, hostKeyPrefix string) error {
+	c := newClient(museAddr)
+	hostKey, err := c.SHARD().LookupHost(hostKeyPrefix)
+	if err != nil {
+		return errors.Wrap(err, "could not lookup host")
+	}
+	info, err := c.HostInfo(hostKey, 10)
+	if err != nil {
+		return err
+	}
+	pct := func(f float64) string { return fmt.Sprintf("%+.1f%%", f*100) }
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Public Key:\t%v\n", info.HostKey)
+	fmt.Fprintf(tw, "Address:\t%v\n", info.Address)
+	fmt.Fprintf(tw, "Scans:\t%v since %v\n", info.Scans, info.FirstScan.Format(time.RFC822))
+	fmt.Fprintf(tw, "Uptime:\t%.1f%%\n", info.Uptime*100)
+	fmt.Fprintf(tw, "Avg. Latency:\t%.0fms\n", info.AvgLatencyMS)
+	if info.Settings != nil {
+		fmt.Fprintf(tw, "Last Success:\t%v\n", info.LastSuccess.Format(time.RFC822))
+		fmt.Fprintf(tw, "Storage Price:\t%v/TB/month\t(%v)\n", currencyUnits(info.Settings.StoragePrice.Mul64(1e12).Mul64(4320)), pct(info.PriceTrend.Storage))
+		fmt.Fprintf(tw, "Upload Price:\t%v/TB\t(%v)\n", currencyUnits(info.Settings.UploadBandwidthPrice.Mul64(1e12)), pct(info.PriceTrend.Upload))
+		fmt.Fprintf(tw, "Download Price:\t%v/TB\t(%v)\n", currencyUnits(info.Settings.DownloadBandwidthPrice.Mul64(1e12)), pct(info.PriceTrend.Download))
+		fmt.Fprintf(tw, "Contract Price:\t%v\t(%v)\n", currencyUnits(info.Settings.ContractPrice), pct(info.PriceTrend.Contract))
+		fmt.Fprintf(tw, "Collateral:\t%v/TB/month\t(%v)\n", currencyUnits(info.Settings.Collateral.Mul64(1e12).Mul64(4320)), pct(info.PriceTrend.Collateral))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Println("\nRecent Scans:")
+	tw = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, rec := range info.History {
+		status := "ok"
+		if !rec.Success {
+			status = rec.Error
+		}
+		fmt.Fprintf(tw, "%v\t%.0fms\t%v\n", rec.Timestamp.Format(time.RFC822), rec.LatencyMS, status)
+	}
+	return tw.Flush()
+}
+
 func info(museAddr string, id string) error {
-	c := muse.NewClient(museAddr)
+	c := newClient(museAddr)
 	sc := c.SHARD()
 	contracts, err := c.AllContracts()
 	if err != nil {
@@ -369,7 +698,7 @@ Sectors:      %v
 }
 
 func checkup(museAddr string, id string) error {
-	c := muse.NewClient(museAddr)
+	c := newClient(museAddr)
 	sc := c.SHARD()
 	contracts, err := c.AllContracts()
 	if err != nil {
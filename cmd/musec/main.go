@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"log"
+	"os"
 	"os/user"
 	"path/filepath"
 	"runtime"
@@ -11,6 +12,7 @@ import (
 	"github.com/BurntSushi/toml"
 	"go.sia.tech/siad/build"
 	"lukechampine.com/flagg"
+	"lukechampine.com/muse"
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/renter"
 )
@@ -31,17 +33,26 @@ Actions:
     renew           renew a contract
     contracts       list all contracts
     hosts           view and create host sets
+    blocklist       view and edit the host blocklist
+    allowlist       view and edit the host allowlist
     checkup         check the health of a contract
     info            display info about a contract
 `
 	versionUsage = rootUsage
 	scanUsage    = `Usage:
     musec scan hostkey bytes duration
+    musec scan -hostset name
 
 Scans the specified host and reports various metrics.
 
 bytes is the number of bytes intended to be stored on the host; duration is
-the number of blocks that the contract will be active.
+the number of blocks that the contract will be active. If muse scanned the
+host within the last day, any price increases or collateral decreases since
+then are reported.
+
+If -hostset is provided, every host in the named host set is scanned
+concurrently instead, and the address, latency, and status of each host are
+reported as its scan finishes.
 `
 	formUsage = `Usage:
     musec form hostkey funds duration
@@ -87,8 +98,16 @@ Actions:
 	delete          delete a host set
 	add             add a host to a host set
 	remove          remove a host from a host set
-
-Lists host sets.
+	history         show the history of a host set
+	rollback        restore a previous version of a host set
+	meta            view or edit the metadata of a host set
+	rules           view or set the rules defining a host set
+	refresh         resolve the rules defining a host set
+	compose         combine other host sets into a host set
+	diversity       check whether hosts in a host set share a subnet
+	show            show the scan history and statistics of a host
+
+Lists host sets, along with their metadata and any warnings about them.
 `
 	hostsCreateUsage = `Usage:
 musec hosts create [name] [host set]
@@ -110,6 +129,128 @@ Adds a host to the host set with the given name.
 musec hosts remove [name] [host]
 
 Removes a host from the host set with the given name.
+`
+	hostsHistoryUsage = `Usage:
+musec hosts history [name]
+
+Lists every recorded change to the host set with the given name, including
+changes made before it was deleted.
+`
+	hostsRollbackUsage = `Usage:
+musec hosts rollback [name] [version]
+
+Restores the host set with the given name to the contents it had at the given
+version, as listed by 'musec hosts history'. The rollback is itself recorded as
+a new version.
+`
+	hostsMetaUsage = `Usage:
+musec hosts meta [flags] [name]
+
+Displays the metadata of the host set with the given name. If any flags are
+provided, the corresponding fields are updated instead; other fields are left
+unchanged. If the set has fewer hosts than its minimum, a warning is shown by
+'musec hosts'.
+
+The -diversity flag controls how muse responds when hosts in the set share a
+/24 (IPv4) or /48 (IPv6) subnet, or an announced hostname: 'warn' (the default)
+publishes a hostset_not_diverse event, 'reject' refuses the change, and 'ignore'
+does nothing.
+`
+	hostsRulesUsage = `Usage:
+musec hosts rules [flags] [name]
+
+Displays the rules defining the host set with the given name. If any flags are
+provided, the host set is instead defined by the given rules, replacing any
+previous rules and hosts. The rules are resolved by scanning each candidate
+host; those that satisfy every rule become members of the set. Muse resolves
+the rules again periodically, recording each change in the set's history.
+
+If -candidates is not provided, the hosts of existing contracts are
+considered. Use -clear to remove the rules, leaving the set's current hosts
+in place.
+`
+	hostsRefreshUsage = `Usage:
+musec hosts refresh [name]
+
+Resolves the rules defining the host set with the given name immediately,
+rather than waiting for muse to resolve them.
+`
+	hostsComposeUsage = `Usage:
+musec hosts compose [name] [expression]
+
+Defines the host set with the given name as a combination of other host sets.
+The expression combines host set names with | (union), & (intersection), and
+- (difference), which must be separated from names by spaces, e.g.:
+
+    musec hosts compose prod "eu | us - blocklist"
+
+& binds more tightly than | and -, and parentheses may be used for grouping.
+The set's hosts are resolved whenever it is read, so changes to eu, us, or
+blocklist take effect immediately.
+
+If no expression is provided, the current expression is displayed. Use -clear
+to keep the set's current hosts as a static host set.
+`
+	blocklistUsage = `Usage:
+    musec blocklist [action]
+
+Actions:
+	add             add an entry to the blocklist
+	remove          remove an entry from the blocklist
+
+Lists the entries of the host blocklist. Muse will not scan, form contracts
+with, or renew contracts with a blocked host, and host sets cannot contain
+blocked hosts. The blocklist applies to every tenant.
+`
+	blocklistAddUsage = `Usage:
+musec blocklist add [entry] [reason]
+
+Adds an entry to the host blocklist. An entry may be a host public key, a host
+address (host:port, or just the hostname), or a subnet in CIDR notation, e.g.
+203.0.113.0/24.
+`
+	blocklistRemoveUsage = `Usage:
+musec blocklist remove [entry]
+
+Removes an entry from the host blocklist.
+`
+	allowlistUsage = `Usage:
+    musec allowlist [action]
+
+Actions:
+	add             add an entry to the allowlist
+	remove          remove an entry from the allowlist
+
+Lists the entries of the host allowlist. If the allowlist is non-empty, muse
+will only scan, form contracts with, or renew contracts with hosts matching
+one of its entries. The blocklist takes precedence over the allowlist.
+`
+	allowlistAddUsage = `Usage:
+musec allowlist add [entry] [reason]
+
+Adds an entry to the host allowlist. Entries take the same forms as blocklist
+entries; see 'musec blocklist add'.
+`
+	allowlistRemoveUsage = `Usage:
+musec allowlist remove [entry]
+
+Removes an entry from the host allowlist.
+`
+	hostsDiversityUsage = `Usage:
+musec hosts diversity [name]
+
+Resolves the address of each host in the host set with the given name, and
+lists groups of hosts that share a /24 (IPv4) or /48 (IPv6) subnet, or an
+announced hostname. Such hosts are likely to be run by the same operator, and
+may fail together.
+`
+	hostsShowUsage = `Usage:
+musec hosts show [host]
+
+Displays statistics about the specified host, computed from every scan that
+muse has performed on it: its uptime (the fraction of scans that succeeded),
+average latency, current prices along with their change over the stored
+scans, and its most recent scans.
 `
 	infoUsage = `Usage:
     musec info contract
@@ -136,6 +277,25 @@ func scanHost(hkr renter.HostKeyResolver, pubkey hostdb.HostPublicKey) (hostdb.S
 	return hostdb.Scan(ctx, addr, pubkey)
 }
 
+// tenant and token scope musec's requests to a muse tenant.
+var tenant, token string
+
+func newClient(museAddr string) *muse.Client {
+	return muse.NewClient(museAddr).Tenant(tenant, token).WithActor(actor())
+}
+
+// actor identifies the user running musec, for host set histories.
+func actor() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		name += "@" + host
+	}
+	return name
+}
+
 func loadAddrFromConfig() string {
 	user, err := user.Current()
 	if err != nil {
@@ -156,10 +316,15 @@ func main() {
 
 	rootCmd := flagg.Root
 	rootCmd.StringVar(&museAddr, "a", museAddr, "host:port that the muse API is running on")
+	rootCmd.StringVar(&tenant, "tenant", "", "muse tenant to operate on")
+	rootCmd.StringVar(&token, "token", "", "bearer token for the muse tenant")
 	rootCmd.Usage = flagg.SimpleUsage(rootCmd, rootUsage)
 
 	versionCmd := flagg.New("version", versionUsage)
 	scanCmd := flagg.New("scan", scanUsage)
+	scanHostSet := scanCmd.String("hostset", "", "scan every host in the named host set")
+	scanConcurrency := scanCmd.Int("concurrency", 0, "maximum number of hosts to scan at once (with -hostset)")
+	scanTimeout := scanCmd.Duration("timeout", 0, "timeout for each scan (with -hostset)")
 	formCmd := flagg.New("form", formUsage)
 	renewCmd := flagg.New("renew", renewUsage)
 	checkupCmd := flagg.New("checkup", checkupUsage)
@@ -169,6 +334,35 @@ func main() {
 	hostsDeleteCmd := flagg.New("delete", hostsDeleteUsage)
 	hostsAddCmd := flagg.New("add", hostsAddUsage)
 	hostsRemoveCmd := flagg.New("remove", hostsRemoveUsage)
+	hostsHistoryCmd := flagg.New("history", hostsHistoryUsage)
+	hostsRollbackCmd := flagg.New("rollback", hostsRollbackUsage)
+	hostsMetaCmd := flagg.New("meta", hostsMetaUsage)
+	hostsMetaCmd.String("owner", "", "owner of the host set")
+	hostsMetaCmd.String("description", "", "description of the host set")
+	hostsMetaCmd.Var(make(labelsFlag), "label", "key=value label to set (repeatable); an empty value removes the label")
+	hostsMetaCmd.Int("min-hosts", 0, "minimum number of hosts in the set")
+	hostsMetaCmd.String("funds", "", "default contract funds")
+	hostsMetaCmd.String("duration", "", "default contract duration, in blocks")
+	hostsMetaCmd.String("diversity", "", "diversity policy (warn, reject, or ignore)")
+	hostsRulesCmd := flagg.New("rules", hostsRulesUsage)
+	hostsRulesCmd.String("candidates", "", "comma-separated list of hosts to consider")
+	hostsRulesCmd.String("max-storage-price", "", "maximum storage price, per byte per block")
+	hostsRulesCmd.String("min-remaining-storage", "", "minimum remaining storage, e.g. 1tb")
+	hostsRulesCmd.Bool("accepting", false, "only include hosts that are accepting contracts")
+	hostsRulesCmd.String("min-version", "", "minimum host version")
+	hostsRulesCmd.String("exclude-subnets", "", "comma-separated list of subnets to exclude, in CIDR notation")
+	hostsRulesClear := hostsRulesCmd.Bool("clear", false, "remove the rules, keeping the current hosts")
+	hostsRefreshCmd := flagg.New("refresh", hostsRefreshUsage)
+	hostsComposeCmd := flagg.New("compose", hostsComposeUsage)
+	hostsComposeClear := hostsComposeCmd.Bool("clear", false, "remove the expression, keeping the current hosts")
+	hostsDiversityCmd := flagg.New("diversity", hostsDiversityUsage)
+	hostsShowCmd := flagg.New("show", hostsShowUsage)
+	blocklistCmd := flagg.New("blocklist", blocklistUsage)
+	blocklistAddCmd := flagg.New("add", blocklistAddUsage)
+	blocklistRemoveCmd := flagg.New("remove", blocklistRemoveUsage)
+	allowlistCmd := flagg.New("allowlist", allowlistUsage)
+	allowlistAddCmd := flagg.New("add", allowlistAddUsage)
+	allowlistRemoveCmd := flagg.New("remove", allowlistRemoveUsage)
 	infoCmd := flagg.New("info", infoUsage)
 
 	cmd := flagg.Parse(flagg.Tree{
@@ -184,8 +378,24 @@ func main() {
 				{Cmd: hostsCreateCmd},
 				{Cmd: hostsAddCmd},
 				{Cmd: hostsRemoveCmd},
+				{Cmd: hostsHistoryCmd},
+				{Cmd: hostsRollbackCmd},
+				{Cmd: hostsMetaCmd},
+				{Cmd: hostsRulesCmd},
+				{Cmd: hostsRefreshCmd},
+				{Cmd: hostsComposeCmd},
+				{Cmd: hostsDiversityCmd},
+				{Cmd: hostsShowCmd},
 				{Cmd: hostsDeleteCmd},
 			}},
+			{Cmd: blocklistCmd, Sub: []flagg.Tree{
+				{Cmd: blocklistAddCmd},
+				{Cmd: blocklistRemoveCmd},
+			}},
+			{Cmd: allowlistCmd, Sub: []flagg.Tree{
+				{Cmd: allowlistAddCmd},
+				{Cmd: allowlistRemoveCmd},
+			}},
 			{Cmd: infoCmd},
 		},
 	})
@@ -203,6 +413,15 @@ func main() {
 			githash, build.Release, runtime.Version(), runtime.GOOS, runtime.GOARCH, builddate)
 
 	case scanCmd:
+		if *scanHostSet != "" {
+			if len(args) != 0 {
+				cmd.Usage()
+				return
+			}
+			err := scanMany(museAddr, *scanHostSet, *scanConcurrency, *scanTimeout)
+			check("Scan failed:", err)
+			return
+		}
 		hostkey, bytes, duration := parseScan(args, scanCmd)
 		err := scan(museAddr, hostkey, bytes, duration)
 		check("Scan failed:", err)
@@ -267,6 +486,89 @@ func main() {
 		err := removeHost(museAddr, args[0], args[1])
 		check("Could not remove host:", err)
 
+	case hostsHistoryCmd:
+		if len(args) != 1 {
+			cmd.Usage()
+			return
+		}
+		err := hostSetHistory(museAddr, args[0])
+		check("Could not get host set history:", err)
+
+	case hostsRollbackCmd:
+		name, version := parseHostsRollback(args, hostsRollbackCmd)
+		err := rollbackHostSet(museAddr, name, version)
+		check("Could not roll back host set:", err)
+
+	case hostsMetaCmd:
+		name, edit := parseHostsMeta(args, hostsMetaCmd)
+		err := hostSetMetadata(museAddr, name, edit)
+		check("Could not update host set metadata:", err)
+
+	case hostsRulesCmd:
+		name, candidates, rules := parseHostsRules(args, hostsRulesCmd)
+		var err error
+		if *hostsRulesClear {
+			err = clearHostSetRules(museAddr, name)
+		} else {
+			err = hostSetRules(museAddr, name, candidates, rules)
+		}
+		check("Could not set host set rules:", err)
+
+	case hostsRefreshCmd:
+		if len(args) != 1 {
+			cmd.Usage()
+			return
+		}
+		err := refreshHostSet(museAddr, args[0])
+		check("Could not refresh host set:", err)
+
+	case hostsComposeCmd:
+		name, expr := parseHostsCompose(args, hostsComposeCmd)
+		var err error
+		if *hostsComposeClear {
+			err = decomposeHostSet(museAddr, name)
+		} else {
+			err = composeHostSet(museAddr, name, expr)
+		}
+		check("Could not compose host set:", err)
+
+	case hostsDiversityCmd:
+		if len(args) != 1 {
+			cmd.Usage()
+			return
+		}
+		err := hostSetDiversity(museAddr, args[0])
+		check("Could not check host set diversity:", err)
+
+	case hostsShowCmd:
+		if len(args) != 1 {
+			cmd.Usage()
+			return
+		}
+		err := showHost(museAddr, args[0])
+		check("Could not show host:", err)
+
+	case blocklistCmd, allowlistCmd:
+		if len(args) != 0 {
+			cmd.Usage()
+			return
+		}
+		err := listAccessList(museAddr, cmd == blocklistCmd)
+		check("Could not list entries:", err)
+
+	case blocklistAddCmd, allowlistAddCmd:
+		entry := parseAccessAdd(args, cmd)
+		err := addAccessEntry(museAddr, cmd == blocklistAddCmd, entry)
+		check("Could not add entry:", err)
+
+	case blocklistRemoveCmd, allowlistRemoveCmd:
+		if len(args) != 1 {
+			cmd.Usage()
+			return
+		}
+		err := removeAccessEntry(museAddr, cmd == blocklistRemoveCmd, args[0])
+		check("Could not remove entry:", err)
+
 	case infoCmd:
 		if len(args) != 1 {
 			infoCmd.Usage()
@@ -12,6 +12,7 @@ import (
 	"strings"
 
 	"go.sia.tech/siad/types"
+	"lukechampine.com/muse"
 )
 
 // form [hostkey] [funds] [endheight/duration]
@@ -61,6 +62,148 @@ func parseHostsCreate(args []string, cmd *flag.FlagSet) (string, []string) {
 	return args[0], strings.Split(args[1], ",")
 }
 
+// rollback [name] [version]
+func parseHostsRollback(args []string, cmd *flag.FlagSet) (string, uint64) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(2)
+	}
+	version, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		log.Fatal("Malformed version number")
+	}
+	return args[0], version
+}
+
+// labelsFlag is a repeatable flag of key=value labels. An empty value removes
+// the label.
+type labelsFlag map[string]string
+
+func (l labelsFlag) String() string {
+	pairs := make([]string, 0, len(l))
+	for k, v := range l {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (l labelsFlag) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return errors.New("label must be of the form key=value")
+	}
+	l[s[:i]] = s[i+1:]
+	return nil
+}
+
+// meta [name]
+//
+// The returned function applies the flags that were set to a host set's
+// metadata; it is nil if no flags were set.
+func parseHostsMeta(args []string, cmd *flag.FlagSet) (string, func(*muse.HostSetMetadata)) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(2)
+	}
+	var edits []func(*muse.HostSetMetadata)
+	cmd.Visit(func(f *flag.Flag) {
+		v := f.Value.String()
+		switch f.Name {
+		case "owner":
+			edits = append(edits, func(md *muse.HostSetMetadata) { md.Owner = v })
+		case "description":
+			edits = append(edits, func(md *muse.HostSetMetadata) { md.Description = v })
+		case "label":
+			labels := f.Value.(labelsFlag)
+			edits = append(edits, func(md *muse.HostSetMetadata) {
+				if md.Labels == nil {
+					md.Labels = make(map[string]string)
+				}
+				for k, v := range labels {
+					if v == "" {
+						delete(md.Labels, k)
+					} else {
+						md.Labels[k] = v
+					}
+				}
+			})
+		case "min-hosts":
+			n, err := strconv.Atoi(v)
+			check("Malformed minimum host count:", err)
+			edits = append(edits, func(md *muse.HostSetMetadata) { md.MinHosts = n })
+		case "funds":
+			funds := parseCurrency(v)
+			edits = append(edits, func(md *muse.HostSetMetadata) { md.Contract.Funds = funds })
+		case "duration":
+			duration := parseBlockHeight(v)
+			edits = append(edits, func(md *muse.HostSetMetadata) { md.Contract.Duration = duration })
+		case "diversity":
+			edits = append(edits, func(md *muse.HostSetMetadata) { md.Diversity = muse.DiversityPolicy(v) })
+		}
+	})
+	if len(edits) == 0 {
+		return args[0], nil
+	}
+	return args[0], func(md *muse.HostSetMetadata) {
+		for _, edit := range edits {
+			edit(md)
+		}
+	}
+}
+
+// compose [name]
+// compose [name] [expression]
+func parseHostsCompose(args []string, cmd *flag.FlagSet) (string, string) {
+	if len(args) != 1 && len(args) != 2 {
+		cmd.Usage()
+		os.Exit(2)
+	}
+	args = append(args, "")
+	return args[0], args[1]
+}
+
+// blocklist/allowlist add [entry] [reason]
+func parseAccessAdd(args []string, cmd *flag.FlagSet) muse.AccessEntry {
+	if len(args) != 1 && len(args) != 2 {
+		cmd.Usage()
+		os.Exit(2)
+	}
+	args = append(args, "")
+	return muse.AccessEntry{Entry: args[0], Reason: args[1]}
+}
+
+// rules [name]
+//
+// If no flags were set, the returned rules are nil. Candidate hosts are
+// returned separately, as prefixes to be looked up.
+func parseHostsRules(args []string, cmd *flag.FlagSet) (name string, candidates []string, rules *muse.HostSetRules) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(2)
+	}
+	cmd.Visit(func(f *flag.Flag) {
+		if rules == nil {
+			rules = new(muse.HostSetRules)
+		}
+		v := f.Value.String()
+		switch f.Name {
+		case "candidates":
+			candidates = strings.Split(v, ",")
+		case "max-storage-price":
+			rules.MaxStoragePrice = parseCurrency(v)
+		case "min-remaining-storage":
+			rules.MinRemainingStorage = parseFilesize(v)
+		case "accepting":
+			rules.AcceptingContracts = v == "true"
+		case "min-version":
+			rules.MinVersion = v
+		case "exclude-subnets":
+			rules.ExcludedSubnets = strings.Split(v, ",")
+		}
+	})
+	return args[0], candidates, rules
+}
+
 func parseCurrency(s string) types.Currency {
 	var hastings string
 	if strings.HasSuffix(s, "H") {
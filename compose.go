@@ -0,0 +1,367 @@
+package muse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/julienschmidt/httprouter"
+	"lukechampine.com/us/hostdb"
+)
+
+// errComposed is returned when attempting to edit the hosts of a host set that
+// is composed of other host sets.
+var errComposed = errors.New("host set is composed of other sets; change its expression instead")
+
+// A setExpr is a parsed host set expression. Leaves name a host set; other
+// nodes combine their operands with op, which is one of '|' (union), '&'
+// (intersection), or '-' (difference).
+type setExpr struct {
+	name        string
+	op          rune
+	left, right *setExpr
+}
+
+// names returns the host sets referenced by e.
+func (e *setExpr) names() []string {
+	if e.op == 0 {
+		return []string{e.name}
+	}
+	return append(e.left.names(), e.right.names()...)
+}
+
+// tokenizeSetExpr splits an expression into names, operators, and parentheses.
+// Operators must be separated from names by whitespace or parentheses, so that
+// names may contain hyphens.
+func tokenizeSetExpr(s string) []string {
+	var toks []string
+	for _, field := range strings.Fields(s) {
+		for field != "" {
+			i := strings.IndexAny(field, "()")
+			if i == -1 {
+				toks = append(toks, field)
+				break
+			} else if i > 0 {
+				toks = append(toks, field[:i])
+			}
+			toks = append(toks, field[i:i+1])
+			field = field[i+1:]
+		}
+	}
+	return toks
+}
+
+// setOperator returns the operator denoted by tok, if any.
+func setOperator(tok string) rune {
+	switch tok {
+	case "|", "∪", "+":
+		return '|'
+	case "&", "∩":
+		return '&'
+	case "-", "−", `\`:
+		return '-'
+	}
+	return 0
+}
+
+// parseSetExpr parses a host set expression such as "eu | us - blocklist".
+// Intersection binds more tightly than union and difference, which are
+// evaluated left to right; parentheses may be used for grouping.
+func parseSetExpr(s string) (*setExpr, error) {
+	toks := tokenizeSetExpr(s)
+	var parseTerm func() (*setExpr, error)
+	var parseExpr func(prec int) (*setExpr, error)
+	parseTerm = func() (*setExpr, error) {
+		if len(toks) == 0 {
+			return nil, errors.New("unexpected end of expression")
+		}
+		tok := toks[0]
+		toks = toks[1:]
+		switch {
+		case tok == "(":
+			e, err := parseExpr(0)
+			if err != nil {
+				return nil, err
+			} else if len(toks) == 0 || toks[0] != ")" {
+				return nil, errors.New("missing closing parenthesis")
+			}
+			toks = toks[1:]
+			return e, nil
+		case tok == ")" || setOperator(tok) != 0:
+			return nil, fmt.Errorf("unexpected %q", tok)
+		}
+		for _, r := range tok {
+			if unicode.IsSpace(r) || unicode.IsControl(r) {
+				return nil, fmt.Errorf("invalid host set name %q", tok)
+			}
+		}
+		return &setExpr{name: tok}, nil
+	}
+	parseExpr = func(prec int) (*setExpr, error) {
+		left, err := parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		for len(toks) > 0 {
+			op := setOperator(toks[0])
+			if op == 0 {
+				break
+			}
+			opPrec := 0
+			if op == '&' {
+				opPrec = 1
+			}
+			if opPrec < prec {
+				break
+			}
+			toks = toks[1:]
+			right, err := parseExpr(opPrec + 1)
+			if err != nil {
+				return nil, err
+			}
+			left = &setExpr{op: op, left: left, right: right}
+		}
+		return left, nil
+	}
+	e, err := parseExpr(0)
+	if err != nil {
+		return nil, err
+	} else if len(toks) > 0 {
+		return nil, fmt.Errorf("unexpected %q", toks[0])
+	}
+	return e, nil
+}
+
+// members returns the hosts in the named host set, resolving the expression
+// of a composed set. The caller must hold the server lock.
+func (t *tenant) members(name string) ([]hostdb.HostPublicKey, error) {
+	set, err := t.resolveMembers(name, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]hostdb.HostPublicKey, 0, len(set))
+	for h := range set {
+		hosts = append(hosts, h)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i] < hosts[j]
+	})
+	return hosts, nil
+}
+
+func (t *tenant) resolveMembers(name string, visiting map[string]bool) (map[hostdb.HostPublicKey]bool, error) {
+	expr, ok := t.hostSetExprs[name]
+	if !ok {
+		set := make(map[hostdb.HostPublicKey]bool, len(t.hostSets[name]))
+		for _, h := range t.hostSets[name] {
+			set[h] = true
+		}
+		return set, nil
+	} else if visiting[name] {
+		return nil, fmt.Errorf("host set %q refers to itself", name)
+	}
+	visiting[name] = true
+	defer delete(visiting, name)
+	e, err := parseSetExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	var eval func(e *setExpr) (map[hostdb.HostPublicKey]bool, error)
+	eval = func(e *setExpr) (map[hostdb.HostPublicKey]bool, error) {
+		if e.op == 0 {
+			if !t.hasHostSet(e.name) {
+				return nil, fmt.Errorf("host set %q refers to unknown host set %q", name, e.name)
+			}
+			return t.resolveMembers(e.name, visiting)
+		}
+		l, err := eval(e.left)
+		if err != nil {
+			return nil, err
+		}
+		r, err := eval(e.right)
+		if err != nil {
+			return nil, err
+		}
+		switch e.op {
+		case '|':
+			for h := range r {
+				l[h] = true
+			}
+		case '&':
+			for h := range l {
+				if !r[h] {
+					delete(l, h)
+				}
+			}
+		case '-':
+			for h := range r {
+				delete(l, h)
+			}
+		}
+		return l, nil
+	}
+	return eval(e)
+}
+
+// checkEditable returns an error if the hosts of the named host set are
+// derived from rules or other host sets, and thus cannot be edited directly.
+// The caller must hold the server lock.
+func (t *tenant) checkEditable(name string) error {
+	if _, ok := t.hostSetRules[name]; ok {
+		return errRuleDefined
+	} else if _, ok := t.hostSetExprs[name]; ok {
+		return errComposed
+	}
+	return nil
+}
+
+// checkDeletable returns an error if the named host set is referenced by the
+// expression of another host set, and thus cannot be deleted. The caller must
+// hold the server lock.
+func (t *tenant) checkDeletable(name string) error {
+	for _, other := range t.hostSetNames() {
+		expr, ok := t.hostSetExprs[other]
+		if !ok || other == name {
+			continue
+		}
+		e, err := parseSetExpr(expr)
+		if err != nil {
+			continue
+		}
+		for _, ref := range e.names() {
+			if ref == name {
+				return Error{Code: CodeBadRequest, Message: fmt.Sprintf("host set is referenced by the expression of %q", other)}
+			}
+		}
+	}
+	return nil
+}
+
+// setHostSetExpr replaces the expression of the named host set, deleting it if
+// expr is empty. The caller must hold the server lock.
+func (t *tenant) setHostSetExpr(name string, expr string) error {
+	err := t.store.Update(func(tx StoreTx) error {
+		if expr == "" {
+			return tx.Delete(t.bucket("hostSetExprs"), name)
+		}
+		return tx.Put(t.bucket("hostSetExprs"), name, expr)
+	})
+	if err != nil {
+		return err
+	}
+	if expr == "" {
+		delete(t.hostSetExprs, name)
+	} else {
+		t.hostSetExprs[name] = expr
+	}
+	return nil
+}
+
+// composeHostSet defines the named host set by the parsed expression e,
+// returning its resulting hosts. If e is nil, the expression is removed, and
+// the host set keeps its current hosts as a static set.
+func (s *server) composeHostSet(t *tenant, name, expr string, e *setExpr, by actor) ([]hostdb.HostPublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, composed := t.hostSetExprs[name]
+	if e == nil {
+		if !composed {
+			return nil, Error{Code: CodeUnknownHostSet, Message: "That host set is not composed of other sets"}
+		}
+		hosts, err := t.members(name)
+		if err != nil {
+			return nil, err
+		} else if len(hosts) == 0 {
+			if err := t.checkDeletable(name); err != nil {
+				return nil, err
+			}
+		}
+		if err := t.setHostSetExpr(name, ""); err != nil {
+			return nil, err
+		}
+		// if the expression resolved to no hosts, this deletes the set
+		if _, err := t.setHostSet(name, hosts, by, "decompose"); err != nil {
+			return nil, err
+		}
+		return hosts, nil
+	}
+
+	if !composed && t.hasHostSet(name) {
+		return nil, Error{Code: CodeBadRequest, Message: "host set already exists; delete it before composing it from other sets"}
+	}
+	for _, ref := range e.names() {
+		if !t.hasHostSet(ref) {
+			return nil, Error{Code: CodeUnknownHostSet, Message: fmt.Sprintf("expression refers to unknown host set %q", ref)}
+		}
+	}
+	// resolve the new expression before saving it, to detect cycles
+	t.hostSetExprs[name] = expr
+	hosts, err := t.members(name)
+	if composed {
+		t.hostSetExprs[name] = old
+	} else {
+		delete(t.hostSetExprs, name)
+	}
+	if err != nil {
+		return nil, Error{Code: CodeBadRequest, Message: err.Error()}
+	} else if err := t.setHostSetExpr(name, expr); err != nil {
+		return nil, err
+	} else if _, err := t.setHostSet(name, hosts, by, "compose"); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+func (s *server) handleHostSetComposeGET(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
+		return
+	}
+	s.mu.Lock()
+	expr, ok := t.hostSetExprs[ps.ByName("name")]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, CodeUnknownHostSet, errors.New("That host set is not composed of other sets"))
+		return
+	}
+	writeJSON(w, RequestCompose{Expression: expr})
+}
+
+func (s *server) handleHostSetComposePUT(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
+		return
+	}
+	var rc RequestCompose
+	if err := json.NewDecoder(req.Body).Decode(&rc); err != nil {
+		writeError(w, CodeBadRequest, err)
+		return
+	}
+	var e *setExpr
+	if rc.Expression != "" {
+		var err error
+		if e, err = parseSetExpr(rc.Expression); err != nil {
+			writeError(w, CodeBadRequest, fmt.Errorf("invalid expression: %w", err))
+			return
+		}
+	}
+
+	hosts, err := s.composeHostSet(t, ps.ByName("name"), rc.Expression, e, s.requestActor(t, req))
+	if err != nil {
+		writeError(w, CodeInternal, err)
+		return
+	}
+	writeJSON(w, hosts)
+	s.publish(t.name, EventHostSetChanged, EventHostSet{
+		Name:  ps.ByName("name"),
+		Hosts: hosts,
+	})
+	if e != nil {
+		// derived sets cannot reject violations, only report them
+		s.reportDiversity(t, ps.ByName("name"), hosts)
+	}
+}
@@ -0,0 +1,180 @@
+package muse
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+	"go.sia.tech/siad/modules"
+	"lukechampine.com/us/hostdb"
+)
+
+// validate checks that p is a known diversity policy.
+func (p DiversityPolicy) validate() error {
+	switch p {
+	case "", DiversityWarn, DiversityReject, DiversityIgnore:
+		return nil
+	}
+	return fmt.Errorf("invalid diversity policy %q", p)
+}
+
+// hostSubnet returns the /24 (IPv4) or /48 (IPv6) subnet containing ip.
+func hostSubnet(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		mask := net.CIDRMask(24, 32)
+		return (&net.IPNet{IP: v4.Mask(mask), Mask: mask}).String()
+	}
+	mask := net.CIDRMask(48, 128)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+// diversityViolations groups the hosts that share a subnet or announced
+// hostname, given the announced address of each host and the IPs that address
+// resolves to.
+func diversityViolations(addrs map[hostdb.HostPublicKey]modules.NetAddress, ips map[hostdb.HostPublicKey][]net.IP) []DiversityViolation {
+	type groupKey struct{ reason, group string }
+	groups := make(map[groupKey]map[hostdb.HostPublicKey]bool)
+	add := func(reason, group string, hostKey hostdb.HostPublicKey) {
+		key := groupKey{reason, group}
+		if groups[key] == nil {
+			groups[key] = make(map[hostdb.HostPublicKey]bool)
+		}
+		groups[key][hostKey] = true
+	}
+	for hostKey, addr := range addrs {
+		if host := addr.Host(); net.ParseIP(host) == nil {
+			add("hostname", strings.ToLower(host), hostKey)
+		}
+		for _, ip := range ips[hostKey] {
+			add("subnet", hostSubnet(ip), hostKey)
+		}
+	}
+	var violations []DiversityViolation
+	for key, hosts := range groups {
+		if len(hosts) < 2 {
+			continue
+		}
+		v := DiversityViolation{Reason: key.reason, Group: key.group}
+		for hostKey := range hosts {
+			v.Hosts = append(v.Hosts, hostKey)
+		}
+		sort.Slice(v.Hosts, func(i, j int) bool {
+			return v.Hosts[i] < v.Hosts[j]
+		})
+		violations = append(violations, v)
+	}
+	sort.Slice(violations, func(i, j int) bool {
+		if violations[i].Reason != violations[j].Reason {
+			return violations[i].Reason < violations[j].Reason
+		}
+		return violations[i].Group < violations[j].Group
+	})
+	return violations
+}
+
+// resolveDiversity resolves the address and IPs of each host and returns any
+// diversity violations among them. Hosts that cannot be resolved are ignored.
+func (s *server) resolveDiversity(hostKeys []hostdb.HostPublicKey) []DiversityViolation {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	addrs := make(map[hostdb.HostPublicKey]modules.NetAddress)
+	ips := make(map[hostdb.HostPublicKey][]net.IP)
+	sem := make(chan struct{}, defaultScanConcurrency)
+	for _, hostKey := range hostKeys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(hostKey hostdb.HostPublicKey) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			hostAddr, err := s.resolveHostKey(hostKey)
+			if err != nil {
+				return
+			}
+			// a hostname that cannot be resolved can still be grouped by name
+			hostIPs, _ := lookupHostIPs(hostAddr.Host())
+			mu.Lock()
+			addrs[hostKey] = hostAddr
+			ips[hostKey] = hostIPs
+			mu.Unlock()
+		}(hostKey)
+	}
+	wg.Wait()
+	return diversityViolations(addrs, ips)
+}
+
+// checkDiversity returns a hostset_not_diverse error if the named host set's
+// policy is to reject violations and the specified hosts, which are to become
+// its members, include any. Under other policies, the hosts are not resolved;
+// violations are instead reported by reportDiversity.
+func (s *server) checkDiversity(t *tenant, name string, hostKeys []hostdb.HostPublicKey) error {
+	s.mu.Lock()
+	policy := t.hostSetMeta[name].Diversity
+	s.mu.Unlock()
+	if policy != DiversityReject || len(hostKeys) == 0 {
+		return nil
+	}
+	violations := s.resolveDiversity(hostKeys)
+	if len(violations) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(violations))
+	for i, v := range violations {
+		msgs[i] = fmt.Sprintf("%v hosts share %v %v", len(v.Hosts), v.Reason, v.Group)
+	}
+	return Error{
+		Code:    CodeNotDiverse,
+		Message: strings.Join(msgs, "; "),
+		Details: violations,
+	}
+}
+
+// reportDiversity resolves the specified hosts, the new members of the named
+// host set, in the background, publishing an EventHostSetNotDiverse event if
+// there are any violations among them. Nothing is resolved if the set's policy
+// is to ignore violations, or to reject them and the set is static, since
+// checkDiversity has already done so.
+func (s *server) reportDiversity(t *tenant, name string, hostKeys []hostdb.HostPublicKey) {
+	s.mu.Lock()
+	policy := t.hostSetMeta[name].Diversity
+	derived := t.checkEditable(name) != nil
+	s.mu.Unlock()
+	if policy == DiversityIgnore || (policy == DiversityReject && !derived) || len(hostKeys) == 0 {
+		return
+	}
+	go func() {
+		if violations := s.resolveDiversity(hostKeys); len(violations) > 0 {
+			s.publish(t.name, EventHostSetNotDiverse, EventHostSetDiversity{
+				Name:       name,
+				Violations: violations,
+			})
+		}
+	}()
+}
+
+func (s *server) handleHostSetDiversity(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
+		return
+	}
+	s.mu.Lock()
+	ok := t.hasHostSet(ps.ByName("name"))
+	hostKeys, err := t.members(ps.ByName("name"))
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, CodeUnknownHostSet, errors.New("No record of that host set"))
+		return
+	} else if err != nil {
+		writeError(w, CodeInternal, err)
+		return
+	}
+	violations := s.resolveDiversity(hostKeys)
+	if violations == nil {
+		violations = []DiversityViolation{}
+	}
+	writeJSON(w, violations)
+}
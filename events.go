@@ -0,0 +1,159 @@
+package muse
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// eventHistory is the number of events retained for clients resuming a
+	// stream via Last-Event-ID.
+	eventHistory = 1000
+
+	// eventBuffer is the number of events that may be queued for a
+	// subscriber before it is disconnected.
+	eventBuffer = 100
+)
+
+// An eventBroker distributes events to subscribers.
+type eventBroker struct {
+	mu      sync.Mutex
+	nextID  uint64
+	history []Event
+	subs    map[chan Event]struct{}
+}
+
+func (b *eventBroker) publish(tenant string, typ EventType, data interface{}) Event {
+	js, err := json.Marshal(data)
+	if err != nil {
+		panic(err) // should never happen
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	e := Event{
+		ID:        b.nextID,
+		Type:      typ,
+		Tenant:    tenant,
+		Timestamp: time.Now(),
+		Data:      js,
+	}
+	b.history = append(b.history, e)
+	if len(b.history) > eventHistory {
+		b.history = b.history[len(b.history)-eventHistory:]
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			// subscriber isn't keeping up; drop it, and let it resume
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+	return e
+}
+
+// subscribe returns the retained events after lastID, along with a channel
+// that receives all subsequent events. If lastID is greater than the ID of
+// the most recent event (i.e. the server has restarted), all retained events
+// are returned.
+func (b *eventBroker) subscribe(lastID uint64) ([]Event, chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if lastID > b.nextID {
+		lastID = 0
+	}
+	var backlog []Event
+	for _, e := range b.history {
+		if e.ID > lastID {
+			backlog = append(backlog, e)
+		}
+	}
+	ch := make(chan Event, eventBuffer)
+	if b.subs == nil {
+		b.subs = make(map[chan Event]struct{})
+	}
+	b.subs[ch] = struct{}{}
+	return backlog, ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e Event) error {
+	js, _ := json.Marshal(e)
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, js)
+	return err
+}
+
+// handleEvents streams the tenant's events. The default tenant's stream also
+// carries server-wide events.
+func (s *server) handleEvents(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
+		return
+	}
+	wants := func(e Event) bool { return e.Tenant == t.name }
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, CodeInternal, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	var lastID uint64
+	if str := req.Header.Get("Last-Event-ID"); str != "" {
+		var err error
+		if lastID, err = strconv.ParseUint(str, 10, 64); err != nil {
+			writeError(w, CodeBadRequest, fmt.Errorf("invalid Last-Event-ID: %w", err))
+			return
+		}
+	}
+	backlog, ch := s.events.subscribe(lastID)
+	defer s.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range backlog {
+		if !wants(e) {
+			continue
+		} else if writeEvent(w, e) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-ch:
+			if !ok {
+				return
+			} else if !wants(e) {
+				continue
+			} else if writeEvent(w, e) != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -5,8 +5,10 @@ go 1.17
 require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/gorilla/handlers v1.5.1
+	github.com/julienschmidt/httprouter v1.3.0
 	github.com/pkg/errors v0.9.1
 	gitlab.com/NebulousLabs/encoding v0.0.0-20200604091946-456c3dc907fe
+	go.etcd.io/bbolt v1.3.6
 	go.sia.tech/siad v1.5.7
 	go.uber.org/multierr v1.7.0
 	golang.org/x/term v0.0.0-20210421210424-b80969c67360
@@ -23,7 +25,6 @@ require (
 	github.com/dchest/threefish v0.0.0-20120919164726-3ecf4c494abf // indirect
 	github.com/felixge/httpsnoop v1.0.1 // indirect
 	github.com/gorilla/websocket v1.4.2 // indirect
-	github.com/julienschmidt/httprouter v1.3.0 // indirect
 	github.com/klauspost/cpuid v1.2.2 // indirect
 	github.com/klauspost/reedsolomon v1.9.3 // indirect
 	gitlab.com/NebulousLabs/bolt v1.4.4 // indirect
@@ -39,7 +40,6 @@ require (
 	gitlab.com/NebulousLabs/ratelimit v0.0.0-20200811080431-99b8f0768b2e // indirect
 	gitlab.com/NebulousLabs/siamux v0.0.0-20210409140711-e667c5f458e4 // indirect
 	gitlab.com/NebulousLabs/threadgroup v0.0.0-20200608151952-38921fbef213 // indirect
-	go.etcd.io/bbolt v1.3.6 // indirect
 	go.uber.org/atomic v1.7.0 // indirect
 	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2 // indirect
 	golang.org/x/net v0.0.0-20210410081132-afb366fc7cd1 // indirect
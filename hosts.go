@@ -0,0 +1,229 @@
+package muse
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.sia.tech/siad/types"
+	"lukechampine.com/us/hostdb"
+)
+
+const (
+	// maxScanRecords is the number of scans stored per host; older scans are
+	// discarded.
+	maxScanRecords = 1000
+
+	// recentSettingsAge is the maximum age of a stored scan whose settings are
+	// compared against those of a new scan.
+	recentSettingsAge = 24 * time.Hour
+)
+
+// scanBucket returns the name of the bucket holding the scans of a host.
+func scanBucket(hostKey hostdb.HostPublicKey) string {
+	return "scans/" + string(hostKey)
+}
+
+// A scanIndex locates the stored scans of a host, so that scans can be added
+// and pruned without iterating over the host's scan bucket.
+type scanIndex struct {
+	First       uint64      `json:"first"` // sequence number of the oldest scan
+	Next        uint64      `json:"next"`  // sequence number of the next scan
+	LastSuccess *ScanRecord `json:"lastSuccess,omitempty"`
+}
+
+// recordScan stores the result of scanning a host, discarding the oldest
+// stored scan if necessary.
+func (s *server) recordScan(hostKey hostdb.HostPublicKey, rec ScanRecord) {
+	err := s.store.Update(func(tx StoreTx) error {
+		var idx scanIndex
+		if _, err := tx.Get("scanIndex", string(hostKey), &idx); err != nil {
+			return err
+		}
+		bucket := scanBucket(hostKey)
+		if err := tx.Put(bucket, fmt.Sprintf("%020d", idx.Next), rec); err != nil {
+			return err
+		}
+		idx.Next++
+		if idx.Next-idx.First > maxScanRecords {
+			if err := tx.Delete(bucket, fmt.Sprintf("%020d", idx.First)); err != nil {
+				return err
+			}
+			idx.First++
+		}
+		if rec.Success {
+			idx.LastSuccess = &rec
+		}
+		return tx.Put("scanIndex", string(hostKey), idx)
+	})
+	if err != nil {
+		log.Printf("WARN: could not record scan of %v: %v", hostKey.ShortKey(), err)
+	}
+}
+
+// scanHistory returns the stored scans of a host, oldest first.
+func (s *server) scanHistory(hostKey hostdb.HostPublicKey) (recs []ScanRecord, err error) {
+	err = s.store.View(func(tx StoreTx) error {
+		return tx.ForEach(scanBucket(hostKey), func(_ string, decode func(interface{}) error) error {
+			var rec ScanRecord
+			err := decode(&rec)
+			recs = append(recs, rec)
+			return err
+		})
+	})
+	return
+}
+
+// recentSettings returns the settings reported by the newest successful scan of
+// a host, or nil if that scan is older than recentSettingsAge.
+func (s *server) recentSettings(hostKey hostdb.HostPublicKey) *hostdb.HostSettings {
+	var idx scanIndex
+	err := s.store.View(func(tx StoreTx) error {
+		_, err := tx.Get("scanIndex", string(hostKey), &idx)
+		return err
+	})
+	if err != nil {
+		log.Printf("WARN: could not load scans of %v: %v", hostKey.ShortKey(), err)
+		return nil
+	} else if idx.LastSuccess == nil || time.Since(idx.LastSuccess.Timestamp) > recentSettingsAge {
+		return nil
+	}
+	return idx.LastSuccess.Settings
+}
+
+// settingsChanges returns the unfavorable changes from one set of host
+// settings to another: increased prices and decreased collateral.
+func settingsChanges(from, to *hostdb.HostSettings) []SettingsChange {
+	var changes []SettingsChange
+	prices := []SettingsChange{
+		{"storagePrice", from.StoragePrice, to.StoragePrice},
+		{"uploadBandwidthPrice", from.UploadBandwidthPrice, to.UploadBandwidthPrice},
+		{"downloadBandwidthPrice", from.DownloadBandwidthPrice, to.DownloadBandwidthPrice},
+		{"contractPrice", from.ContractPrice, to.ContractPrice},
+		{"baseRPCPrice", from.BaseRPCPrice, to.BaseRPCPrice},
+		{"sectorAccessPrice", from.SectorAccessPrice, to.SectorAccessPrice},
+	}
+	for _, c := range prices {
+		if c.New.Cmp(c.Old) > 0 {
+			changes = append(changes, c)
+		}
+	}
+	collateral := []SettingsChange{
+		{"collateral", from.Collateral, to.Collateral},
+		{"maxCollateral", from.MaxCollateral, to.MaxCollateral},
+	}
+	for _, c := range collateral {
+		if c.New.Cmp(c.Old) < 0 {
+			changes = append(changes, c)
+		}
+	}
+	return changes
+}
+
+// priceChange returns the relative change from one price to another.
+func priceChange(from, to types.Currency) float64 {
+	if from.IsZero() {
+		return 0
+	}
+	diff := new(big.Int).Sub(to.Big(), from.Big())
+	f, _ := new(big.Rat).SetFrac(diff, from.Big()).Float64()
+	return f
+}
+
+// priceTrend returns the relative change in each price from one set of host
+// settings to another.
+func priceTrend(from, to *hostdb.HostSettings) PriceTrend {
+	return PriceTrend{
+		Storage:    priceChange(from.StoragePrice, to.StoragePrice),
+		Upload:     priceChange(from.UploadBandwidthPrice, to.UploadBandwidthPrice),
+		Download:   priceChange(from.DownloadBandwidthPrice, to.DownloadBandwidthPrice),
+		Contract:   priceChange(from.ContractPrice, to.ContractPrice),
+		Collateral: priceChange(from.Collateral, to.Collateral),
+	}
+}
+
+// exceeds reports whether any price changed by more than threshold, in either
+// direction.
+func (pt PriceTrend) exceeds(threshold float64) bool {
+	for _, c := range []float64{pt.Storage, pt.Upload, pt.Download, pt.Contract, pt.Collateral} {
+		if math.Abs(c) > threshold {
+			return true
+		}
+	}
+	return false
+}
+
+// summarizeScans computes the statistics of a host from its stored scans,
+// which must be ordered oldest first. At most limit scans are included in the
+// returned history.
+func summarizeScans(hostKey hostdb.HostPublicKey, recs []ScanRecord, limit int) HostInfo {
+	info := HostInfo{
+		HostKey: hostKey,
+		Scans:   len(recs),
+		History: []ScanRecord{},
+	}
+	if len(recs) == 0 {
+		return info
+	}
+	info.FirstScan = recs[0].Timestamp
+	info.LastScan = recs[len(recs)-1].Timestamp
+	info.Address = recs[len(recs)-1].Address
+	var first *hostdb.HostSettings
+	var totalLatency float64
+	for i := range recs {
+		rec := &recs[i]
+		if !rec.Success {
+			continue
+		}
+		info.Successes++
+		info.LastSuccess = rec.Timestamp
+		info.Settings = rec.Settings
+		totalLatency += rec.LatencyMS
+		if first == nil {
+			first = rec.Settings
+		}
+	}
+	info.Uptime = float64(info.Successes) / float64(info.Scans)
+	if info.Successes > 0 {
+		info.AvgLatencyMS = totalLatency / float64(info.Successes)
+	}
+	if first != nil && info.Settings != nil {
+		info.PriceTrend = priceTrend(first, info.Settings)
+	}
+	for i := len(recs) - 1; i >= 0 && len(info.History) < limit; i-- {
+		info.History = append(info.History, recs[i])
+	}
+	return info
+}
+
+func (s *server) handleHost(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	hostKey := hostdb.HostPublicKey(ps.ByName("key"))
+	if !strings.HasPrefix(string(hostKey), "ed25519:") || len(hostKey) != len("ed25519:")+64 {
+		writeError(w, CodeBadRequest, fmt.Errorf("invalid host key %q", hostKey))
+		return
+	}
+	limit := 20
+	if str := req.FormValue("limit"); str != "" {
+		var err error
+		if limit, err = strconv.Atoi(str); err != nil || limit < 0 {
+			writeError(w, CodeBadRequest, fmt.Errorf("invalid limit %q", str))
+			return
+		}
+	}
+	recs, err := s.scanHistory(hostKey)
+	if err != nil {
+		writeError(w, CodeInternal, err)
+		return
+	} else if len(recs) == 0 {
+		writeError(w, CodeNotFound, errors.New("No scans of that host"))
+		return
+	}
+	writeJSON(w, summarizeScans(hostKey, recs, limit))
+}
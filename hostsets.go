@@ -0,0 +1,531 @@
+package muse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"lukechampine.com/us/hostdb"
+)
+
+// An actor identifies who changed a host set.
+type actor struct {
+	name string // authenticated
+	note string // supplied by the client, and not verified
+}
+
+// requestActor returns the actor responsible for req, which must have been
+// authorized for t. The actor is named after the token that authorized the
+// request, if any, or else the request's remote address; the Muse-Actor header
+// is recorded only as a note.
+func (s *server) requestActor(t *tenant, req *http.Request) actor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := actor{name: req.RemoteAddr, note: req.Header.Get("Muse-Actor")}
+	if s.isAdmin(req) {
+		a.name = "admin"
+	} else if t.name != "" && len(t.config.TokenHashes) > 0 {
+		a.name = "tenant:" + t.name
+	}
+	return a
+}
+
+// historyBucket returns the name of the bucket holding the revisions of the
+// named host set.
+func (t *tenant) historyBucket(name string) string {
+	return t.bucket("hostSetHistory") + "/" + name
+}
+
+// setHostSet replaces the contents of the named host set, deleting it if hosts
+// is empty, and records the change as a new revision. Deleting a set also
+// deletes its metadata, unless it is still defined by rules or an expression.
+// The caller must hold the server lock.
+func (t *tenant) setHostSet(name string, hosts []hostdb.HostPublicKey, by actor, action string) (HostSetRevision, error) {
+	_, dynamic := t.hostSetRules[name]
+	_, composed := t.hostSetExprs[name]
+	deleted := len(hosts) == 0 && !dynamic && !composed
+	if deleted {
+		if err := t.checkDeletable(name); err != nil {
+			return HostSetRevision{}, err
+		}
+	}
+	rev := HostSetRevision{
+		Version:   t.hostSetVersions[name] + 1,
+		Timestamp: time.Now(),
+		Actor:     by.name,
+		Note:      by.note,
+		Action:    action,
+		Hosts:     hosts,
+	}
+	err := t.store.Update(func(tx StoreTx) error {
+		if len(hosts) > 0 {
+			if err := tx.Put(t.bucket("hostSets"), name, hosts); err != nil {
+				return err
+			}
+		} else if err := tx.Delete(t.bucket("hostSets"), name); err != nil {
+			return err
+		}
+		if deleted {
+			if err := tx.Delete(t.bucket("hostSetMeta"), name); err != nil {
+				return err
+			}
+		}
+		if err := tx.Put(t.bucket("hostSetVersions"), name, rev.Version); err != nil {
+			return err
+		}
+		return tx.Put(t.historyBucket(name), fmt.Sprintf("%020d", rev.Version), rev)
+	})
+	if err != nil {
+		return HostSetRevision{}, err
+	}
+	t.hostSetVersions[name] = rev.Version
+	if len(hosts) > 0 {
+		t.hostSets[name] = hosts
+	} else {
+		delete(t.hostSets, name)
+	}
+	if deleted {
+		delete(t.hostSetMeta, name)
+	}
+	return rev, nil
+}
+
+// hostSetHistory returns the revisions of the named host set, oldest first.
+func (t *tenant) hostSetHistory(name string) (revs []HostSetRevision, err error) {
+	err = t.store.View(func(tx StoreTx) error {
+		return tx.ForEach(t.historyBucket(name), func(_ string, decode func(interface{}) error) error {
+			var rev HostSetRevision
+			err := decode(&rev)
+			revs = append(revs, rev)
+			return err
+		})
+	})
+	return
+}
+
+// hostSetSize returns the size of the named host set relative to its minimum,
+// reporting whether it falls below that minimum. The caller must hold the
+// server lock.
+func (t *tenant) hostSetSize(name string) (EventHostSetSize, bool) {
+	hosts, _ := t.members(name)
+	size := EventHostSetSize{
+		Name:     name,
+		Hosts:    len(hosts),
+		MinHosts: t.hostSetMeta[name].MinHosts,
+	}
+	return size, size.Hosts < size.MinHosts
+}
+
+// hostSetNames returns the names of the tenant's host sets, whether static,
+// rule-defined, or composed, in sorted order. The caller must hold the server
+// lock.
+func (t *tenant) hostSetNames() []string {
+	seen := make(map[string]bool, len(t.hostSets)+len(t.hostSetRules)+len(t.hostSetExprs))
+	for name := range t.hostSets {
+		seen[name] = true
+	}
+	for name := range t.hostSetRules {
+		seen[name] = true
+	}
+	for name := range t.hostSetExprs {
+		seen[name] = true
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *server) handleHostSets(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
+		return
+	}
+	s.mu.Lock()
+	names := t.hostSetNames()
+	infos := make([]HostSetInfo, 0, len(names))
+	for _, name := range names {
+		_, dynamic := t.hostSetRules[name]
+		info := HostSetInfo{
+			Name:       name,
+			Dynamic:    dynamic,
+			Expression: t.hostSetExprs[name],
+			Metadata:   t.hostSetMeta[name],
+			Warnings:   []string{},
+		}
+		if _, err := t.members(name); err != nil {
+			info.Warnings = append(info.Warnings, err.Error())
+		}
+		size, below := t.hostSetSize(name)
+		info.Hosts = size.Hosts
+		if below {
+			info.Warnings = append(info.Warnings, fmt.Sprintf("set has %v hosts, fewer than its minimum of %v", size.Hosts, size.MinHosts))
+		}
+		infos = append(infos, info)
+	}
+	s.mu.Unlock()
+	writeJSON(w, infos)
+}
+
+// hostSetETag returns the entity tag of the named host set, which is derived
+// from its version. The caller must hold the server lock.
+func (t *tenant) hostSetETag(name string) string {
+	return fmt.Sprintf(`"%d"`, t.hostSetVersions[name])
+}
+
+func (s *server) handleHostSetGET(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
+		return
+	}
+	s.mu.Lock()
+	ok := t.hasHostSet(ps.ByName("name"))
+	hostKeys, err := t.members(ps.ByName("name"))
+	etag := t.hostSetETag(ps.ByName("name"))
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, CodeUnknownHostSet, errors.New("No record of that host set"))
+		return
+	} else if err != nil {
+		writeError(w, CodeInternal, err)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	writeJSON(w, hostKeys)
+}
+
+func (s *server) handleHostSetPUT(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
+		return
+	}
+	var hostKeys []hostdb.HostPublicKey
+	if err := json.NewDecoder(req.Body).Decode(&hostKeys); err != nil {
+		writeError(w, CodeBadRequest, err)
+		return
+	}
+	sort.Slice(hostKeys, func(i, j int) bool {
+		return hostKeys[i] < hostKeys[j]
+	})
+	if !s.validateHostKeys(w, hostKeys) {
+		return
+	}
+	if err := s.checkHosts(hostKeys); err != nil {
+		writeError(w, CodeInternal, err)
+		return
+	}
+	by := s.requestActor(t, req)
+	if err := s.checkDiversity(t, ps.ByName("name"), hostKeys); err != nil {
+		writeError(w, CodeInternal, err)
+		return
+	}
+	s.mu.Lock()
+	if match := req.Header.Get("If-Match"); match != "" {
+		ok := t.hasHostSet(ps.ByName("name"))
+		if !ok || (match != "*" && match != t.hostSetETag(ps.ByName("name"))) {
+			s.mu.Unlock()
+			writeError(w, CodeHostSetConflict, errors.New("Host set has been modified"))
+			return
+		}
+	}
+	if err := t.checkEditable(ps.ByName("name")); err != nil {
+		// a derived set can only be deleted, which also deletes its
+		// rules or expression
+		if len(hostKeys) > 0 {
+			s.mu.Unlock()
+			writeError(w, CodeBadRequest, err)
+			return
+		} else if err := t.checkDeletable(ps.ByName("name")); err != nil {
+			s.mu.Unlock()
+			writeError(w, CodeBadRequest, err)
+			return
+		}
+		err := t.setHostSetRules(ps.ByName("name"), nil)
+		if err == nil {
+			err = t.setHostSetExpr(ps.ByName("name"), "")
+		}
+		if err != nil {
+			s.mu.Unlock()
+			writeError(w, CodeInternal, err)
+			return
+		}
+	}
+	_, wasBelow := t.hostSetSize(ps.ByName("name"))
+	_, err := t.setHostSet(ps.ByName("name"), hostKeys, by, "put")
+	size, below := t.hostSetSize(ps.ByName("name"))
+	etag := t.hostSetETag(ps.ByName("name"))
+	s.mu.Unlock()
+	if err != nil {
+		writeError(w, CodeInternal, err)
+		return
+	}
+	if len(hostKeys) > 0 {
+		w.Header().Set("ETag", etag)
+	}
+	s.publish(t.name, EventHostSetChanged, EventHostSet{
+		Name:  ps.ByName("name"),
+		Hosts: hostKeys,
+	})
+	if below && !wasBelow {
+		s.publish(t.name, EventHostSetBelowMinimum, size)
+	}
+	s.reportDiversity(t, ps.ByName("name"), hostKeys)
+}
+
+// validateHostKeys checks that each host key can be resolved by the shard
+// server, writing an error to w if not.
+func (s *server) validateHostKeys(w http.ResponseWriter, hostKeys []hostdb.HostPublicKey) bool {
+	for _, hostKey := range hostKeys {
+		if _, err := s.resolveHostKey(hostKey); err != nil {
+			writeError(w, resolveErrorCode(err), fmt.Errorf("could not resolve %v: %w", hostKey, err))
+			return false
+		}
+	}
+	return true
+}
+
+// handleHostSetEdit returns a handler that adds hosts to, or removes hosts
+// from, a host set.
+func (s *server) handleHostSetEdit(add bool) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		t := s.tenant(w, req, ps)
+		if t == nil {
+			return
+		}
+		var hostKeys []hostdb.HostPublicKey
+		if err := json.NewDecoder(req.Body).Decode(&hostKeys); err != nil {
+			writeError(w, CodeBadRequest, err)
+			return
+		} else if len(hostKeys) == 0 {
+			writeError(w, CodeBadRequest, errors.New("no host keys provided"))
+			return
+		}
+		if add && !s.validateHostKeys(w, hostKeys) {
+			return
+		}
+		name := ps.ByName("name")
+		by := s.requestActor(t, req)
+		if add {
+			if err := s.checkHosts(hostKeys); err != nil {
+				writeError(w, CodeInternal, err)
+				return
+			}
+			s.mu.Lock()
+			hosts := append(append([]hostdb.HostPublicKey(nil), t.hostSets[name]...), hostKeys...)
+			s.mu.Unlock()
+			if err := s.checkDiversity(t, name, hosts); err != nil {
+				writeError(w, CodeInternal, err)
+				return
+			}
+		}
+
+		s.mu.Lock()
+		set, ok := t.hostSets[name]
+		if err := t.checkEditable(name); err != nil {
+			s.mu.Unlock()
+			writeError(w, CodeBadRequest, err)
+			return
+		} else if !ok && !add {
+			s.mu.Unlock()
+			writeError(w, CodeUnknownHostSet, errors.New("No record of that host set"))
+			return
+		}
+		inSet := make(map[hostdb.HostPublicKey]bool, len(set))
+		for _, h := range set {
+			inSet[h] = true
+		}
+		var changed []hostdb.HostPublicKey
+		for _, h := range hostKeys {
+			if inSet[h] != add {
+				inSet[h] = add
+				changed = append(changed, h)
+			}
+		}
+		resp := ResponseHostSetEdit{
+			Hosts:   make([]hostdb.HostPublicKey, 0, len(inSet)),
+			Changed: changed,
+		}
+		for h, in := range inSet {
+			if in {
+				resp.Hosts = append(resp.Hosts, h)
+			}
+		}
+		sort.Slice(resp.Hosts, func(i, j int) bool {
+			return resp.Hosts[i] < resp.Hosts[j]
+		})
+		_, wasBelow := t.hostSetSize(name)
+		var err error
+		if len(changed) > 0 {
+			action := "add"
+			if !add {
+				action = "remove"
+			}
+			_, err = t.setHostSet(name, resp.Hosts, by, action)
+		}
+		size, below := t.hostSetSize(name)
+		etag := t.hostSetETag(name)
+		s.mu.Unlock()
+		if err != nil {
+			writeError(w, CodeInternal, err)
+			return
+		}
+		if len(resp.Hosts) > 0 {
+			w.Header().Set("ETag", etag)
+		}
+		writeJSON(w, resp)
+		if len(changed) > 0 {
+			s.publish(t.name, EventHostSetChanged, EventHostSet{
+				Name:  name,
+				Hosts: resp.Hosts,
+			})
+		}
+		if below && !wasBelow {
+			s.publish(t.name, EventHostSetBelowMinimum, size)
+		}
+		if add && len(changed) > 0 {
+			s.reportDiversity(t, name, resp.Hosts)
+		}
+	}
+}
+
+func (s *server) handleHostSetHistory(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
+		return
+	}
+	revs, err := t.hostSetHistory(ps.ByName("name"))
+	if err != nil {
+		writeError(w, CodeInternal, err)
+		return
+	} else if len(revs) == 0 {
+		writeError(w, CodeUnknownHostSet, errors.New("No history for that host set"))
+		return
+	}
+	writeJSON(w, revs)
+}
+
+func (s *server) handleHostSetRollback(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
+		return
+	}
+	var rr RequestRollback
+	if err := json.NewDecoder(req.Body).Decode(&rr); err != nil {
+		writeError(w, CodeBadRequest, err)
+		return
+	}
+	name := ps.ByName("name")
+	var target HostSetRevision
+	var ok bool
+	err := t.store.View(func(tx StoreTx) (err error) {
+		ok, err = tx.Get(t.historyBucket(name), fmt.Sprintf("%020d", rr.Version), &target)
+		return
+	})
+	if err != nil {
+		writeError(w, CodeInternal, err)
+		return
+	} else if !ok {
+		writeError(w, CodeNotFound, fmt.Errorf("host set has no version %v", rr.Version))
+		return
+	}
+	// the hosts may have been blocked, or become unresolvable, since the
+	// revision was recorded
+	if !s.validateHostKeys(w, target.Hosts) {
+		return
+	} else if err := s.checkHosts(target.Hosts); err != nil {
+		writeError(w, CodeInternal, err)
+		return
+	}
+	if err := s.checkDiversity(t, name, target.Hosts); err != nil {
+		writeError(w, CodeInternal, err)
+		return
+	}
+	by := s.requestActor(t, req)
+
+	s.mu.Lock()
+	if err := t.checkEditable(name); err != nil {
+		s.mu.Unlock()
+		writeError(w, CodeBadRequest, err)
+		return
+	}
+	_, wasBelow := t.hostSetSize(name)
+	rev, err := t.setHostSet(name, target.Hosts, by, fmt.Sprintf("rollback to %v", rr.Version))
+	size, below := t.hostSetSize(name)
+	s.mu.Unlock()
+	if err != nil {
+		writeError(w, CodeInternal, err)
+		return
+	}
+	writeJSON(w, rev)
+	s.publish(t.name, EventHostSetChanged, EventHostSet{
+		Name:  name,
+		Hosts: rev.Hosts,
+	})
+	if below && !wasBelow {
+		s.publish(t.name, EventHostSetBelowMinimum, size)
+	}
+	s.reportDiversity(t, name, rev.Hosts)
+}
+
+func (s *server) handleHostSetMetadataGET(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
+		return
+	}
+	s.mu.Lock()
+	ok := t.hasHostSet(ps.ByName("name"))
+	md := t.hostSetMeta[ps.ByName("name")]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, CodeUnknownHostSet, errors.New("No record of that host set"))
+		return
+	}
+	writeJSON(w, md)
+}
+
+func (s *server) handleHostSetMetadataPUT(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
+		return
+	}
+	var md HostSetMetadata
+	if err := json.NewDecoder(req.Body).Decode(&md); err != nil {
+		writeError(w, CodeBadRequest, err)
+		return
+	} else if md.MinHosts < 0 {
+		writeError(w, CodeBadRequest, errors.New("minimum hosts cannot be negative"))
+		return
+	} else if err := md.Diversity.validate(); err != nil {
+		writeError(w, CodeBadRequest, err)
+		return
+	}
+	name := ps.ByName("name")
+	s.mu.Lock()
+	if !t.hasHostSet(name) {
+		s.mu.Unlock()
+		writeError(w, CodeUnknownHostSet, errors.New("No record of that host set"))
+		return
+	}
+	_, wasBelow := t.hostSetSize(name)
+	err := t.store.Update(func(tx StoreTx) error {
+		return tx.Put(t.bucket("hostSetMeta"), name, md)
+	})
+	if err == nil {
+		t.hostSetMeta[name] = md
+	}
+	size, below := t.hostSetSize(name)
+	s.mu.Unlock()
+	if err != nil {
+		writeError(w, CodeInternal, err)
+		return
+	}
+	if below && !wasBelow {
+		s.publish(t.name, EventHostSetBelowMinimum, size)
+	}
+}
@@ -0,0 +1,259 @@
+package muse
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"go.sia.tech/siad/types"
+	"lukechampine.com/us/hostdb"
+)
+
+// A monitor periodically checks the server's environment, publishing events
+// when something requires an operator's attention.
+type monitor struct {
+	interval     time.Duration
+	expiryWindow types.BlockHeight
+	balance      func() (types.Currency, error)
+	minBalance   types.Currency
+
+	// only accessed by the monitor goroutine
+	unsynced  bool
+	walletLow bool
+}
+
+func (s *server) runMonitor() {
+	for {
+		s.checkShard()
+		s.checkWallet()
+		time.Sleep(s.monitor.interval)
+	}
+}
+
+func (s *server) checkShard() {
+	var errStr string
+	synced, err := s.shard.Synced()
+	if err != nil {
+		errStr = err.Error()
+	} else if !synced {
+		errStr = "shard server is not synced"
+	}
+	if unsynced := errStr != ""; unsynced != s.monitor.unsynced {
+		s.monitor.unsynced = unsynced
+		if unsynced {
+			log.Println("WARN:", errStr)
+			s.publish("", EventShardUnsynced, EventShard{Error: errStr})
+		}
+	}
+	if s.monitor.unsynced {
+		// don't trust the reported height
+		return
+	}
+	height, err := s.shard.ChainHeight()
+	if err != nil {
+		return
+	}
+
+	type expiring struct {
+		tenant string
+		r      contractRecord
+	}
+	var exp []expiring
+	s.mu.Lock()
+	for _, t := range s.tenants {
+		var warned []types.FileContractID
+		for _, r := range t.contracts {
+			if !r.Renewed && !r.Warned && height+s.monitor.expiryWindow >= r.EndHeight {
+				r.Warned = true
+				exp = append(exp, expiring{t.name, *r})
+				warned = append(warned, r.ID)
+			}
+		}
+		if len(warned) > 0 {
+			if err := t.saveContracts(warned...); err != nil {
+				log.Println("WARN: could not save contracts:", err)
+			}
+		}
+	}
+	s.mu.Unlock()
+	for _, e := range exp {
+		s.publish(e.tenant, EventContractExpiring, EventContract{
+			HostKey:     e.r.HostKey,
+			ID:          e.r.ID,
+			HostAddress: e.r.HostAddress,
+			EndHeight:   e.r.EndHeight,
+		})
+	}
+}
+
+func (s *server) checkWallet() {
+	if s.monitor.balance == nil {
+		return
+	}
+	bal, err := s.monitor.balance()
+	if err != nil {
+		log.Println("WARN: could not check wallet balance:", err)
+		return
+	}
+	low := bal.Cmp(s.monitor.minBalance) < 0
+	if low && !s.monitor.walletLow {
+		s.publish("", EventWalletLow, EventWallet{
+			Balance:    bal,
+			MinBalance: s.monitor.minBalance,
+		})
+	}
+	s.monitor.walletLow = low
+}
+
+// A hostMonitor periodically scans every member of every host set, publishing
+// events when a host goes offline, stops accepting contracts, runs low on
+// storage, or changes its prices.
+type hostMonitor struct {
+	interval            time.Duration
+	minRemainingStorage uint64
+	priceChange         float64
+
+	// only accessed by the host monitor goroutine
+	hosts map[hostdb.HostPublicKey]*hostState
+}
+
+// hostState is the state of a host as last observed by the host monitor.
+type hostState struct {
+	offline      bool
+	notAccepting bool
+	lowStorage   bool
+	baseline     *hostdb.HostSettings // prices are compared against these settings
+}
+
+// WithHostMonitor enables a background monitor that scans every member of
+// every host set once per interval, recording each scan. The monitor publishes
+// an event when a host goes offline, stops accepting contracts, reports less
+// than minRemainingStorage bytes of remaining storage, or changes any of its
+// prices by more than priceChange (e.g. 0.2 for 20%). Events are published
+// when a host's state changes, not on every scan. If minRemainingStorage or
+// priceChange is zero, the corresponding events are not published.
+func WithHostMonitor(interval time.Duration, minRemainingStorage uint64, priceChange float64) ServerOption {
+	return func(s *server) {
+		s.hostMonitor = &hostMonitor{
+			interval:            interval,
+			minRemainingStorage: minRemainingStorage,
+			priceChange:         priceChange,
+			hosts:               make(map[hostdb.HostPublicKey]*hostState),
+		}
+	}
+}
+
+func (s *server) runHostMonitor() {
+	for {
+		time.Sleep(s.hostMonitor.interval)
+		s.scanMonitoredHosts()
+	}
+}
+
+func (s *server) scanMonitoredHosts() {
+	hm := s.hostMonitor
+	// determine which tenants' host sets contain each host
+	sets := make(map[hostdb.HostPublicKey]map[string][]string)
+	s.mu.Lock()
+	for _, t := range s.tenants {
+		for _, name := range t.hostSetNames() {
+			hosts, err := t.members(name)
+			if err != nil {
+				continue
+			}
+			for _, hostKey := range hosts {
+				if sets[hostKey] == nil {
+					sets[hostKey] = make(map[string][]string)
+				}
+				sets[hostKey][t.name] = append(sets[hostKey][t.name], name)
+			}
+		}
+	}
+	s.mu.Unlock()
+	for hostKey := range hm.hosts {
+		if _, ok := sets[hostKey]; !ok {
+			delete(hm.hosts, hostKey)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	results := make(map[hostdb.HostPublicKey]ScanResult, len(sets))
+	sem := make(chan struct{}, defaultScanConcurrency)
+	for hostKey := range sets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(hostKey hostdb.HostPublicKey) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			r := s.scanHost(hostKey, defaultScanTimeout)
+			mu.Lock()
+			results[hostKey] = r
+			mu.Unlock()
+		}(hostKey)
+	}
+	wg.Wait()
+
+	for hostKey, r := range results {
+		if r.Address == "" || (r.Error != nil && r.Error.Code == CodeHostBlocked) {
+			// the host was not scanned
+			continue
+		}
+		st, ok := hm.hosts[hostKey]
+		if !ok {
+			st = new(hostState)
+			hm.hosts[hostKey] = st
+		}
+		var events []EventType
+		var trend PriceTrend
+		if offline := r.Error != nil; offline != st.offline {
+			st.offline = offline
+			if offline {
+				events = append(events, EventHostOffline)
+			}
+		}
+		if settings := r.Settings; settings != nil {
+			if notAccepting := !settings.AcceptingContracts; notAccepting != st.notAccepting {
+				st.notAccepting = notAccepting
+				if notAccepting {
+					events = append(events, EventHostNotAccepting)
+				}
+			}
+			if low := settings.RemainingStorage < hm.minRemainingStorage; low != st.lowStorage {
+				st.lowStorage = low
+				if low {
+					events = append(events, EventHostLowStorage)
+				}
+			}
+			if st.baseline == nil {
+				st.baseline = settings
+			} else if pt := priceTrend(st.baseline, settings); hm.priceChange > 0 && pt.exceeds(hm.priceChange) {
+				st.baseline = settings
+				trend = pt
+				events = append(events, EventHostPriceChanged)
+			}
+		}
+		for tenant, names := range sets[hostKey] {
+			for _, typ := range events {
+				// each event gets its own data, carrying only the fields
+				// relevant to its type
+				data := EventHost{
+					HostKey:  hostKey,
+					Address:  r.Address,
+					HostSets: append([]string(nil), names...),
+				}
+				if r.Settings != nil {
+					data.RemainingStorage = r.Settings.RemainingStorage
+				}
+				switch typ {
+				case EventHostOffline:
+					data.Error = r.Error.Message
+				case EventHostPriceChanged:
+					pt := trend
+					data.PriceChange = &pt
+				}
+				s.publish(tenant, typ, data)
+			}
+		}
+	}
+}
@@ -1,14 +1,24 @@
 package muse
 
 import (
+	"bytes"
+	"context"
 	"crypto/ed25519"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/julienschmidt/httprouter"
 	"github.com/pkg/errors"
 	"gitlab.com/NebulousLabs/encoding"
 	"go.sia.tech/siad/crypto"
@@ -18,16 +28,19 @@ import (
 	"lukechampine.com/shard"
 	"lukechampine.com/us/ed25519hash"
 	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
 	"lukechampine.com/us/renterhost"
 )
 
-type mockCS struct{}
+type mockCS struct {
+	unsynced bool
+}
 
 func (mockCS) ConsensusSetSubscribe(s modules.ConsensusSetSubscriber, ccid modules.ConsensusChangeID, cancel <-chan struct{}) error {
 	return nil
 }
 
-func (mockCS) Synced() bool { return true }
+func (cs mockCS) Synced() bool { return !cs.unsynced }
 
 type memPersist struct {
 	shard.PersistData
@@ -60,14 +73,29 @@ func (stubTpool) AcceptTransactionSet([]types.Transaction) (_ error)
 func (stubTpool) UnconfirmedParents(types.Transaction) (_ []types.Transaction, _ error) { return }
 func (stubTpool) FeeEstimate() (_, _ types.Currency, _ error)                           { return }
 
+// stubShard is a synced Shard that resolves every host key to a distinct
+// loopback address.
+type stubShard struct{}
+
+func (stubShard) ChainHeight() (_ types.BlockHeight, _ error) { return }
+func (stubShard) Synced() (bool, error)                       { return true, nil }
+func (stubShard) ResolveHostKey(hostKey hostdb.HostPublicKey) (modules.NetAddress, error) {
+	h := crypto.HashBytes([]byte(hostKey))
+	return modules.NetAddress(fmt.Sprintf("127.%d.%d.1:1", h[0], h[1])), nil
+}
+
 func startSHARD(hpk hostdb.HostPublicKey, ann []byte) (string, func() error) {
+	return startSHARDHosts(map[hostdb.HostPublicKey][]byte{hpk: ann})
+}
+
+func startSHARDHosts(anns map[hostdb.HostPublicKey][]byte) (string, func() error) {
 	l, err := net.Listen("tcp", ":0")
 	if err != nil {
 		return "", nil
 	}
 	p := &memPersist{
 		PersistData: shard.PersistData{
-			Hosts: map[hostdb.HostPublicKey][]byte{hpk: ann},
+			Hosts: anns,
 		},
 	}
 	r, err := shard.NewRelay(mockCS{}, p)
@@ -93,7 +121,7 @@ func TestServer(t *testing.T) {
 	// create the muse server
 	dir, _ := ioutil.TempDir("", t.Name())
 	defer os.RemoveAll(dir)
-	srv, err := NewServer(dir, stubWallet{}, stubTpool{}, shardAddr)
+	srv, err := NewServer(dir, stubWallet{}, stubTpool{}, RemoteShard(shardAddr), WithAdminToken("admin"))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -104,7 +132,7 @@ func TestServer(t *testing.T) {
 	go http.Serve(l, srv)
 
 	// test contract formation
-	c := NewClient("http://" + l.Addr().String())
+	c := NewClient("http://"+l.Addr().String()).Tenant("", "admin")
 
 	currentHeight, err := c.SHARD().ChainHeight()
 	if err != nil {
@@ -147,6 +175,1855 @@ func TestServer(t *testing.T) {
 	} else if len(set) != 1 || set[0] != host.PublicKey() {
 		t.Fatal("wrong host set:", set)
 	}
+
+	// test contract records
+	if cs, err := c.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if len(cs) != 2 || cs[0].ID != contract.ID || !bytes.Equal(cs[0].RenterKey, contract.RenterKey) {
+		t.Fatal("wrong contracts:", cs)
+	}
+	if cs, err := c.Contracts("foo"); err != nil {
+		t.Fatal(err)
+	} else if len(cs) != 2 {
+		t.Fatal("wrong contracts:", cs)
+	}
+	if _, err := c.Contracts("nonexistent"); !errors.Is(err, ErrUnknownHostSet) {
+		t.Fatal("expected ErrUnknownHostSet, got", err)
+	}
+	if _, err := c.ComposeHostSet("composed", "foo"); err != nil {
+		t.Fatal(err)
+	} else if cs, err := c.Contracts("composed"); err != nil {
+		t.Fatal(err)
+	} else if len(cs) != 2 {
+		t.Fatal("wrong contracts:", cs)
+	}
+
+	// contracts should be isolated
+	if _, err := c.SetTenant("foo", TenantConfig{Tokens: []string{"secret"}}); err != nil {
+		t.Fatal(err)
+	}
+	foo := c.Tenant("foo", "secret")
+	if cs, err := foo.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if len(cs) != 0 {
+		t.Fatal("tenant should not see the default tenant's contracts:", cs)
+	} else if err := foo.Delete(contract.ID); !errors.Is(err, Error{Code: CodeNotFound}) {
+		t.Fatal("expected not_found, got", err)
+	} else if _, err := NewClient(c.addr).AllContracts(); !errors.Is(err, ErrUnauthorized) {
+		t.Fatal("expected unauthorized, got", err)
+	}
+	if err := c.Delete(contract.ID); err != nil {
+		t.Fatal(err)
+	} else if err := c.Delete(contract.ID); !errors.Is(err, Error{Code: CodeNotFound}) {
+		t.Fatal("expected not_found, got", err)
+	} else if cs, err := c.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if len(cs) != 1 || cs[0].ID == contract.ID {
+		t.Fatal("wrong contracts:", cs)
+	}
+
+	if resp, err := c.AddToHostSet("bar", host.PublicKey(), host.PublicKey()); err != nil {
+		t.Fatal(err)
+	} else if len(resp.Hosts) != 1 || len(resp.Changed) != 1 {
+		t.Fatal("wrong add response:", resp)
+	} else if resp, err := c.AddToHostSet("bar", host.PublicKey()); err != nil {
+		t.Fatal(err)
+	} else if len(resp.Changed) != 0 {
+		t.Fatal("host should not have been added twice:", resp)
+	}
+	if _, err := c.AddToHostSet("bar", hostdb.HostKeyFromPublicKey(make([]byte, 32))); !errors.Is(err, ErrUnknownHost) {
+		t.Fatal("expected ErrUnknownHost, got", err)
+	} else if err := c.SetHostSet("bar", []hostdb.HostPublicKey{hostdb.HostKeyFromPublicKey(make([]byte, 32))}); !errors.Is(err, ErrUnknownHost) {
+		t.Fatal("expected ErrUnknownHost, got", err)
+	}
+	if resp, err := c.RemoveFromHostSet("bar", host.PublicKey()); err != nil {
+		t.Fatal(err)
+	} else if len(resp.Hosts) != 0 || len(resp.Changed) != 1 {
+		t.Fatal("wrong remove response:", resp)
+	}
+
+	// test structured errors
+	_, err = c.HostSet("bar")
+	if !errors.Is(err, ErrUnknownHostSet) {
+		t.Fatal("expected ErrUnknownHostSet, got", err)
+	}
+	var museErr Error
+	if !errors.As(err, &museErr) || museErr.Code != CodeUnknownHostSet || museErr.Message == "" {
+		t.Fatal("wrong error:", museErr)
+	}
+	switch err.(type) {
+	case Error:
+	default:
+		t.Fatalf("expected Error value, got %T", err)
+	}
+	if !errors.Is(err, NewError(museErr.Message)) || errors.Is(err, NewError("No record")) {
+		t.Fatal("deprecated NewError should match only the exact message:", err)
+	}
+	_, err = c.Scan(hostdb.HostKeyFromPublicKey(make([]byte, 32)))
+	if !errors.Is(err, ErrUnknownHost) {
+		t.Fatal("expected ErrUnknownHost, got", err)
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	var spec struct {
+		Paths      map[string]map[string]json.RawMessage
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]json.RawMessage
+			}
+		}
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	// every route should be documented, and every documented route should exist
+	documented := make(map[string]bool)
+	for path, ops := range spec.Paths {
+		for method := range ops {
+			if method != "parameters" {
+				documented[strings.ToUpper(method)+" "+path] = true
+			}
+		}
+	}
+	for _, r := range (&server{}).routes() {
+		segs := strings.Split(r.path, "/")
+		for i, seg := range segs {
+			if strings.HasPrefix(seg, ":") {
+				segs[i] = "{" + seg[1:] + "}"
+			}
+		}
+		key := r.method + " " + strings.Join(segs, "/")
+		if !documented[key] {
+			t.Error("route missing from spec:", key)
+		}
+		delete(documented, key)
+	}
+	for key := range documented {
+		t.Error("spec contains unregistered route:", key)
+	}
+
+	// every field of the request and response types should be documented
+	for name, v := range map[string]interface{}{
+		"RequestForm":           RequestForm{},
+		"RequestRenew":          RequestRenew{},
+		"RequestScan":           RequestScan{},
+		"Contract":              Contract{},
+		"HostSettings":          hostdb.HostSettings{},
+		"Error":                 Error{Details: struct{}{}},
+		"Event":                 Event{Tenant: "foo"},
+		"EventContract":         EventContract{},
+		"EventContractError":    EventContractError{},
+		"EventHostSet":          EventHostSet{},
+		"EventHostSetSize":      EventHostSetSize{},
+		"EventWallet":           EventWallet{},
+		"EventShard":            EventShard{Error: "foo"},
+		"Webhook":               Webhook{Secret: "foo", Tenant: "foo"},
+		"TenantConfig":          TenantConfig{},
+		"ResponseHostSetEdit":   ResponseHostSetEdit{},
+		"HostSetRevision":       HostSetRevision{Note: "foo"},
+		"RequestRollback":       RequestRollback{},
+		"HostSetMetadata":       HostSetMetadata{},
+		"ContractDefaults":      ContractDefaults{},
+		"HostSetInfo":           HostSetInfo{},
+		"HostSetRules":          HostSetRules{},
+		"RequestCompose":        RequestCompose{},
+		"AccessEntry":           AccessEntry{},
+		"RequestScanBatch":      RequestScanBatch{},
+		"ScanResult":            ScanResult{Settings: &hostdb.HostSettings{}, Changes: []SettingsChange{{}}, Error: &Error{}},
+		"ScanRecord":            ScanRecord{Error: "foo", Settings: &hostdb.HostSettings{}},
+		"PriceTrend":            PriceTrend{},
+		"HostInfo":              HostInfo{Settings: &hostdb.HostSettings{}},
+		"EventHost":             EventHost{Error: "foo", PriceChange: &PriceTrend{}},
+		"ResponseScan":          ResponseScan{Changes: []SettingsChange{{}}},
+		"SettingsChange":        SettingsChange{},
+		"EventHostSettings":     EventHostSettings{},
+		"Metrics":               Metrics{},
+		"CacheMetrics":          CacheMetrics{},
+		"DiversityViolation":    DiversityViolation{},
+		"EventHostSetDiversity": EventHostSetDiversity{},
+		"TenantInfo":            TenantInfo{},
+	} {
+		schema, ok := spec.Components.Schemas[name]
+		if !ok {
+			t.Error("type missing from spec:", name)
+			continue
+		}
+		js, _ := json.Marshal(v)
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(js, &fields); err != nil {
+			t.Fatal(err)
+		}
+		for field := range fields {
+			if _, ok := schema.Properties[field]; !ok {
+				t.Errorf("field %v.%v missing from spec", name, field)
+			}
+		}
+		for field := range schema.Properties {
+			if _, ok := fields[field]; !ok {
+				t.Errorf("spec contains nonexistent field %v.%v", name, field)
+			}
+		}
+	}
+
+	// the spec should be served by the API
+	dir, _ := ioutil.TempDir("", t.Name())
+	defer os.RemoveAll(dir)
+	srv, err := NewServer(dir, stubWallet{}, stubTpool{}, RemoteShard(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/openapi.json", nil))
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), openAPISpec) {
+		t.Fatal("spec was not served:", rec.Code)
+	}
+}
+
+func TestClientRoutes(t *testing.T) {
+	// every Client method that makes a request should hit a registered route
+	mux := httprouter.New()
+	for _, r := range (&server{}).routes() {
+		mux.Handle(r.method, apiPrefix+r.path, r.handler)
+	}
+	var mu sync.Mutex
+	var reqs []*http.Request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		reqs = append(reqs, req)
+		mu.Unlock()
+		w.Write([]byte("null"))
+	}))
+	defer ts.Close()
+
+	skip := map[string]bool{"WithContext": true, "WithActor": true, "Tenant": true, "SHARD": true}
+	c := reflect.ValueOf(NewClient(ts.URL))
+	for i := 0; i < c.NumMethod(); i++ {
+		m := c.Type().Method(i)
+		if skip[m.Name] {
+			continue
+		}
+		args := make([]reflect.Value, m.Type.NumIn()-1)
+		for j := range args {
+			switch typ := m.Type.In(j + 1); typ.Kind() {
+			case reflect.String:
+				args[j] = reflect.ValueOf("foo").Convert(typ)
+			case reflect.Ptr:
+				args[j] = reflect.New(typ.Elem())
+			default:
+				args[j] = reflect.Zero(typ)
+			}
+		}
+		mu.Lock()
+		reqs = nil
+		mu.Unlock()
+		if m.Type.IsVariadic() {
+			c.Method(i).CallSlice(args)
+		} else {
+			c.Method(i).Call(args)
+		}
+		time.Sleep(10 * time.Millisecond) // wait for streaming requests
+		mu.Lock()
+		if len(reqs) == 0 {
+			t.Errorf("%v did not make a request", m.Name)
+		}
+		for _, req := range reqs {
+			if h, _, _ := mux.Lookup(req.Method, req.URL.Path); h == nil {
+				t.Errorf("%v requested unregistered route %v %v", m.Name, req.Method, req.URL.Path)
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+func TestEvents(t *testing.T) {
+	dir, _ := ioutil.TempDir("", t.Name())
+	defer os.RemoveAll(dir)
+	srv, err := NewServer(dir, stubWallet{}, stubTpool{}, stubShard{}, WithAdminToken("admin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewClient(ts.URL).WithContext(ctx).Tenant("", "admin")
+
+	nextEvent := func(ch <-chan Event) Event {
+		t.Helper()
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				t.Fatal("event stream closed")
+			}
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+		panic("unreachable")
+	}
+
+	events, err := c.Events(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey := hostdb.HostKeyFromPublicKey(make([]byte, 32))
+	if err := c.SetHostSet("foo", []hostdb.HostPublicKey{hostKey}); err != nil {
+		t.Fatal(err)
+	}
+	e := nextEvent(events)
+	var hs EventHostSet
+	if e.Type != EventHostSetChanged {
+		t.Fatal("wrong event type:", e.Type)
+	} else if err := json.Unmarshal(e.Data, &hs); err != nil {
+		t.Fatal(err)
+	} else if hs.Name != "foo" || len(hs.Hosts) != 1 || hs.Hosts[0] != hostKey {
+		t.Fatal("wrong event data:", hs)
+	}
+
+	// resume from the first event
+	if err := c.SetHostSet("foo", nil); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := c.Events(e.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e2 := nextEvent(resumed); e2.ID != e.ID+1 || e2.Type != EventHostSetChanged {
+		t.Fatal("wrong resumed event:", e2)
+	}
+
+	// the unscoped stream should not carry other tenants' events
+	if _, err := c.SetTenant("foo", TenantConfig{Tokens: []string{"secret"}}); err != nil {
+		t.Fatal(err)
+	}
+	foo := c.Tenant("foo", "secret")
+	fooEvents, err := foo.Events(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := foo.SetHostSet("bar", nil); err != nil {
+		t.Fatal(err)
+	} else if e := nextEvent(fooEvents); e.Tenant != "foo" {
+		t.Fatal("wrong tenant event:", e)
+	}
+	if err := c.SetHostSet("baz", nil); err != nil {
+		t.Fatal(err)
+	}
+	if e := nextEvent(resumed); e.Tenant != "" || e.Type != EventHostSetChanged {
+		t.Fatal("default stream received another tenant's event:", e)
+	} else if err := json.Unmarshal(e.Data, &hs); err != nil || hs.Name != "baz" {
+		t.Fatal("default stream received another tenant's event:", hs)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	// create a receiver that fails the first delivery
+	var secret string
+	var attempts int
+	received := make(chan Event, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if !VerifyWebhook(secret, body, req.Header.Get("Muse-Signature")) {
+			t.Error("invalid signature")
+		}
+		if attempts++; attempts == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		var e Event
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Error(err)
+		}
+		received <- e
+	}))
+	defer receiver.Close()
+	// and one that does not respond until the test ends
+	done := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-done
+	}))
+	defer slow.Close()
+	defer close(done)
+
+	dir, _ := ioutil.TempDir("", t.Name())
+	defer os.RemoveAll(dir)
+	srv, err := NewServer(dir, stubWallet{}, stubTpool{}, stubShard{}, WithAdminToken("admin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := NewClient(ts.URL).Tenant("", "admin")
+
+	// webhooks require the admin token
+	if _, err := NewClient(ts.URL).Webhooks(); !errors.Is(err, ErrUnauthorized) {
+		t.Fatal("expected unauthorized, got", err)
+	}
+
+	if _, err := c.AddWebhook(slow.URL); err != nil {
+		t.Fatal(err)
+	}
+	wh, err := c.AddWebhook(receiver.URL, EventHostSetChanged)
+	if err != nil {
+		t.Fatal(err)
+	} else if wh.ID == "" || wh.Secret == "" {
+		t.Fatal("webhook was not assigned an ID and secret:", wh)
+	}
+	secret = wh.Secret
+	if whs, err := c.Webhooks(); err != nil {
+		t.Fatal(err)
+	} else if len(whs) != 2 || (whs[0].ID != wh.ID && whs[1].ID != wh.ID) {
+		t.Fatal("wrong webhooks:", whs)
+	} else if whs[0].Secret != "" || whs[1].Secret != "" {
+		t.Fatal("webhook secrets should not be listed")
+	}
+
+	// webhooks should only receive the events of their own tenant
+	if _, err := c.SetTenant("foo", TenantConfig{Tokens: []string{"secret"}}); err != nil {
+		t.Fatal(err)
+	}
+	foo := c.Tenant("foo", "secret")
+	if whs, err := foo.Webhooks(); err != nil {
+		t.Fatal(err)
+	} else if len(whs) != 0 {
+		t.Fatal("tenant should not see other tenants' webhooks:", whs)
+	} else if err := foo.RemoveWebhook(wh.ID); !errors.Is(err, Error{Code: CodeNotFound}) {
+		t.Fatal("expected not_found, got", err)
+	}
+	hostKey := hostdb.HostKeyFromPublicKey(make([]byte, 32))
+	if err := foo.SetHostSet("foo", []hostdb.HostPublicKey{hostKey}); err != nil {
+		t.Fatal(err)
+	} else if err := c.SetHostSet("bar", []hostdb.HostPublicKey{hostKey}); err != nil {
+		t.Fatal(err)
+	}
+	// delivery should not be held up by the slow webhook
+	select {
+	case e := <-received:
+		if e.Type != EventHostSetChanged || e.Tenant != "" {
+			t.Fatal("wrong event:", e)
+		} else if attempts != 2 {
+			t.Fatal("expected delivery to be retried once, got", attempts, "attempts")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+
+	if err := c.RemoveWebhook(wh.ID); err != nil {
+		t.Fatal(err)
+	} else if err := c.RemoveWebhook(wh.ID); !errors.Is(err, Error{Code: CodeNotFound}) {
+		t.Fatal("expected not_found, got", err)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	dir, _ := ioutil.TempDir("", t.Name())
+	defer os.RemoveAll(dir)
+	store := NewMemStore()
+	srv, err := NewServer(dir, stubWallet{}, stubTpool{}, stubShard{}, WithStore(store), WithAdminToken("admin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	c := NewClient(ts.URL).Tenant("", "admin")
+
+	if _, err := c.Tenant("foo", "").HostSets(); !errors.Is(err, ErrUnknownTenant) {
+		t.Fatal("expected unknown_tenant, got", err)
+	}
+	// tenant management requires the admin token
+	if _, err := NewClient(ts.URL).SetTenant("foo", TenantConfig{}); !errors.Is(err, ErrUnauthorized) {
+		t.Fatal("expected unauthorized, got", err)
+	} else if _, err := NewClient(ts.URL).Tenants(); !errors.Is(err, ErrUnauthorized) {
+		t.Fatal("expected unauthorized, got", err)
+	}
+	if _, err := c.SetTenant("foo", TenantConfig{
+		Budget: types.SiacoinPrecision,
+		Tokens: []string{"secret"},
+	}); err != nil {
+		t.Fatal(err)
+	} else if names, err := c.Tenants(); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 1 || names[0] != "foo" {
+		t.Fatal("wrong tenants:", names)
+	}
+	if _, err := c.Tenant("foo", "wrong").HostSets(); !errors.Is(err, ErrUnauthorized) {
+		t.Fatal("expected unauthorized, got", err)
+	} else if _, err := c.Tenant("foo", "wrong").TenantInfo("foo"); !errors.Is(err, ErrUnauthorized) {
+		t.Fatal("expected unauthorized, got", err)
+	}
+
+	// host sets should be isolated
+	foo := c.Tenant("foo", "secret")
+	hostKey := hostdb.HostKeyFromPublicKey(make([]byte, 32))
+	if err := foo.SetHostSet("bar", []hostdb.HostPublicKey{hostKey}); err != nil {
+		t.Fatal(err)
+	} else if _, err := c.HostSet("bar"); !errors.Is(err, ErrUnknownHostSet) {
+		t.Fatal("expected unknown_host_set, got", err)
+	} else if hosts, err := foo.HostSet("bar"); err != nil {
+		t.Fatal(err)
+	} else if len(hosts) != 1 || hosts[0] != hostKey {
+		t.Fatal("wrong host set:", hosts)
+	}
+
+	// budget should be enforced
+	host := &hostdb.ScannedHost{PublicKey: hostKey}
+	if _, err := foo.Form(host, types.SiacoinPrecision.Mul64(2), 0, 100); !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatal("expected budget_exceeded, got", err)
+	}
+
+	// tenants should survive a restart
+	ts.Close()
+	srv, err = NewServer(dir, stubWallet{}, stubTpool{}, stubShard{}, WithStore(store), WithAdminToken("admin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts = httptest.NewServer(srv)
+	defer ts.Close()
+	foo = NewClient(ts.URL).Tenant("foo", "secret")
+	if hosts, err := foo.HostSet("bar"); err != nil {
+		t.Fatal(err)
+	} else if len(hosts) != 1 {
+		t.Fatal("wrong host set:", hosts)
+	} else if info, err := foo.TenantInfo("foo"); err != nil {
+		t.Fatal(err)
+	} else if !info.Spent.IsZero() || !info.Budget.Equals(types.SiacoinPrecision) {
+		t.Fatal("wrong tenant info:", info)
+	}
+
+	// tenants can be configured directly, even without an admin token
+	tenants := make(chan map[string]TenantConfig)
+	srv, err = NewServer(dir, stubWallet{}, stubTpool{}, stubShard{}, WithStore(store), WithTenants(tenants))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts2 := httptest.NewServer(srv)
+	defer ts2.Close()
+	tenants <- map[string]TenantConfig{"foo": {Budget: types.SiacoinPrecision.Mul64(2)}, "bad name": {}}
+	tenants <- nil // blocks until the first map has been applied
+	close(tenants)
+	foo = NewClient(ts2.URL).Tenant("foo", "secret")
+	if info, err := foo.TenantInfo("foo"); err != nil {
+		t.Fatal(err)
+	} else if !info.Budget.Equals(types.SiacoinPrecision.Mul64(2)) {
+		t.Fatal("wrong tenant info:", info)
+	} else if names, err := NewClient(ts2.URL).Tenants(); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 1 {
+		t.Fatal("wrong tenants:", names)
+	}
+}
+
+func TestHostSetVersion(t *testing.T) {
+	srv, err := NewServer("", stubWallet{}, stubTpool{}, stubShard{}, WithStore(NewMemStore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := NewClient(ts.URL)
+
+	key1 := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+	key2 := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+	if err := c.SetHostSetIfMatch("foo", []hostdb.HostPublicKey{key1}, ""); !errors.Is(err, ErrHostSetConflict) {
+		t.Fatal("expected conflict when editing nonexistent set, got", err)
+	} else if err := c.SetHostSet("foo", []hostdb.HostPublicKey{key1}); err != nil {
+		t.Fatal(err)
+	}
+	_, v1, err := c.HostSetVersion("foo")
+	if err != nil {
+		t.Fatal(err)
+	} else if v1 == "" {
+		t.Fatal("no version returned")
+	}
+	// a concurrent edit should cause a conflict
+	if err := c.SetHostSet("foo", []hostdb.HostPublicKey{key2}); err != nil {
+		t.Fatal(err)
+	} else if err := c.SetHostSetIfMatch("foo", []hostdb.HostPublicKey{key1, key2}, v1); !errors.Is(err, ErrHostSetConflict) {
+		t.Fatal("expected conflict, got", err)
+	}
+	hosts, v2, err := c.HostSetVersion("foo")
+	if err != nil {
+		t.Fatal(err)
+	} else if v2 == v1 {
+		t.Fatal("version did not change")
+	} else if err := c.SetHostSetIfMatch("foo", append(hosts, key1), v2); err != nil {
+		t.Fatal(err)
+	} else if hosts, err := c.HostSet("foo"); err != nil {
+		t.Fatal(err)
+	} else if len(hosts) != 2 {
+		t.Fatal("wrong host set:", hosts)
+	}
+
+	// restoring the same contents should still change the version
+	hosts, v3, err := c.HostSetVersion("foo")
+	if err != nil {
+		t.Fatal(err)
+	} else if err := c.SetHostSet("foo", []hostdb.HostPublicKey{key1}); err != nil {
+		t.Fatal(err)
+	} else if err := c.SetHostSet("foo", hosts); err != nil {
+		t.Fatal(err)
+	} else if err := c.SetHostSetIfMatch("foo", nil, v3); !errors.Is(err, ErrHostSetConflict) {
+		t.Fatal("expected conflict, got", err)
+	}
+	// the ETag should remain usable after edits via other routes
+	resp, err := c.RemoveFromHostSet("foo", key2)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, v4, err := c.HostSetVersion("foo"); err != nil {
+		t.Fatal(err)
+	} else if err := c.SetHostSetIfMatch("foo", resp.Hosts, v4); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostSetHistory(t *testing.T) {
+	srv, err := NewServer("", stubWallet{}, stubTpool{}, stubShard{}, WithStore(NewMemStore()), WithAdminToken("admin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := NewClient(ts.URL).Tenant("", "admin").WithActor("alice")
+
+	key1 := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+	key2 := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+	if err := c.SetHostSet("foo", []hostdb.HostPublicKey{key1, key2}); err != nil {
+		t.Fatal(err)
+	} else if err := c.WithActor("bob").SetHostSet("foo", nil); err != nil {
+		t.Fatal(err)
+	}
+	revs, err := c.HostSetHistory("foo")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(revs) != 2 {
+		t.Fatal("expected 2 revisions, got", len(revs))
+	} else if revs[0].Version != 1 || revs[0].Actor != "admin" || revs[0].Note != "alice" || len(revs[0].Hosts) != 2 {
+		t.Fatal("wrong first revision:", revs[0])
+	} else if revs[1].Version != 2 || revs[1].Actor != "admin" || revs[1].Note != "bob" || len(revs[1].Hosts) != 0 {
+		t.Fatal("wrong second revision:", revs[1])
+	}
+
+	// the actor should be determined by the token, not the Muse-Actor header
+	if _, err := c.SetTenant("foo", TenantConfig{Tokens: []string{"secret"}}); err != nil {
+		t.Fatal(err)
+	}
+	foo := NewClient(ts.URL).Tenant("foo", "secret").WithActor("admin")
+	if err := foo.SetHostSet("bar", []hostdb.HostPublicKey{key1}); err != nil {
+		t.Fatal(err)
+	} else if revs, err := foo.HostSetHistory("bar"); err != nil {
+		t.Fatal(err)
+	} else if len(revs) != 1 || revs[0].Actor != "tenant:foo" || revs[0].Note != "admin" {
+		t.Fatal("wrong revision:", revs)
+	}
+
+	// roll back the deletion
+	if rev, err := c.RollbackHostSet("foo", 1); err != nil {
+		t.Fatal(err)
+	} else if rev.Version != 3 || len(rev.Hosts) != 2 {
+		t.Fatal("wrong rollback revision:", rev)
+	} else if hosts, err := c.HostSet("foo"); err != nil {
+		t.Fatal(err)
+	} else if len(hosts) != 2 {
+		t.Fatal("host set was not restored:", hosts)
+	}
+	if _, err := c.RollbackHostSet("foo", 10); !errors.Is(err, Error{Code: CodeNotFound}) {
+		t.Fatal("expected not_found, got", err)
+	} else if _, err := c.HostSetHistory("bar"); !errors.Is(err, ErrUnknownHostSet) {
+		t.Fatal("expected unknown_host_set, got", err)
+	}
+}
+
+func TestHostSetMetadata(t *testing.T) {
+	srv, err := NewServer("", stubWallet{}, stubTpool{}, stubShard{}, WithStore(NewMemStore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewClient(ts.URL).WithContext(ctx)
+	events, err := c.Events(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key1 := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+	key2 := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+	md := HostSetMetadata{
+		Owner:       "alice",
+		Description: "production hosts",
+		Labels:      map[string]string{"region": "eu"},
+		MinHosts:    2,
+		Contract:    ContractDefaults{Funds: types.SiacoinPrecision, Duration: 1000},
+	}
+	if err := c.SetHostSetMetadata("foo", md); !errors.Is(err, ErrUnknownHostSet) {
+		t.Fatal("expected unknown_host_set, got", err)
+	} else if err := c.SetHostSet("foo", []hostdb.HostPublicKey{key1, key2}); err != nil {
+		t.Fatal(err)
+	} else if err := c.SetHostSetMetadata("foo", md); err != nil {
+		t.Fatal(err)
+	} else if got, err := c.HostSetMetadata("foo"); err != nil {
+		t.Fatal(err)
+	} else if got.Owner != md.Owner || got.Labels["region"] != "eu" || got.MinHosts != 2 || !got.Contract.Funds.Equals(md.Contract.Funds) {
+		t.Fatal("wrong metadata:", got)
+	}
+	if infos, err := c.HostSetInfos(); err != nil {
+		t.Fatal(err)
+	} else if len(infos) != 1 || infos[0].Name != "foo" || infos[0].Hosts != 2 || infos[0].Metadata.Description != md.Description || len(infos[0].Warnings) != 0 {
+		t.Fatal("wrong host set info:", infos)
+	}
+
+	// removing a host should drop the set below its minimum
+	if _, err := c.RemoveFromHostSet("foo", key1); err != nil {
+		t.Fatal(err)
+	}
+	if infos, err := c.HostSetInfos(); err != nil {
+		t.Fatal(err)
+	} else if len(infos) != 1 || infos[0].Hosts != 1 || len(infos[0].Warnings) != 1 {
+		t.Fatal("expected warning:", infos)
+	}
+wait:
+	for {
+		select {
+		case e := <-events:
+			if e.Type != EventHostSetBelowMinimum {
+				continue
+			}
+			var size EventHostSetSize
+			if err := json.Unmarshal(e.Data, &size); err != nil {
+				t.Fatal(err)
+			} else if size.Name != "foo" || size.Hosts != 1 || size.MinHosts != 2 {
+				t.Fatal("wrong event data:", size)
+			}
+			break wait
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+	}
+
+	// deleting the set should delete its metadata
+	if _, err := c.RemoveFromHostSet("foo", key2); err != nil {
+		t.Fatal(err)
+	} else if _, err := c.HostSetMetadata("foo"); !errors.Is(err, ErrUnknownHostSet) {
+		t.Fatal("expected unknown_host_set, got", err)
+	} else if err := c.SetHostSet("foo", []hostdb.HostPublicKey{key1}); err != nil {
+		t.Fatal(err)
+	} else if got, err := c.HostSetMetadata("foo"); err != nil {
+		t.Fatal(err)
+	} else if got.Owner != "" || got.MinHosts != 0 {
+		t.Fatal("metadata survived deletion:", got)
+	}
+}
+
+func TestHostSetRules(t *testing.T) {
+	settings := hostdb.HostSettings{
+		AcceptingContracts: true,
+		RemainingStorage:   1 << 30,
+		StoragePrice:       types.SiacoinPrecision,
+		Version:            "1.5.6",
+	}
+	ips := []net.IP{net.ParseIP("192.0.2.1")}
+	for _, test := range []struct {
+		rules HostSetRules
+		match bool
+	}{
+		{HostSetRules{}, true},
+		{HostSetRules{AcceptingContracts: true, MinVersion: "1.5.4"}, true},
+		{HostSetRules{MaxStoragePrice: types.SiacoinPrecision.Div64(2)}, false},
+		{HostSetRules{MinRemainingStorage: 1 << 31}, false},
+		{HostSetRules{MinVersion: "1.6"}, false},
+		{HostSetRules{ExcludedSubnets: []string{"198.51.100.0/24"}}, true},
+		{HostSetRules{ExcludedSubnets: []string{"192.0.2.0/24"}}, false},
+	} {
+		if test.rules.match(settings, ips) != test.match {
+			t.Errorf("expected match(%+v) = %v", test.rules, test.match)
+		}
+	}
+
+	host, err := newHost(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	shardAddr, stop := startSHARD(host.PublicKey(), host.announcement())
+	defer stop()
+	srv, err := NewServer("", stubWallet{}, stubTpool{}, RemoteShard(shardAddr), WithStore(NewMemStore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := NewClient(ts.URL)
+
+	rules := &HostSetRules{
+		Candidates:         []hostdb.HostPublicKey{host.PublicKey()},
+		AcceptingContracts: true,
+	}
+	if _, err := c.SetHostSetRules("foo", &HostSetRules{MinVersion: "foo"}); !errors.Is(err, Error{Code: CodeBadRequest}) {
+		t.Fatal("expected bad_request, got", err)
+	} else if hosts, err := c.SetHostSetRules("foo", rules); err != nil {
+		t.Fatal(err)
+	} else if len(hosts) != 1 || hosts[0] != host.PublicKey() {
+		t.Fatal("wrong members:", hosts)
+	} else if _, err := c.AddToHostSet("foo", host.PublicKey()); !errors.Is(err, Error{Code: CodeBadRequest}) {
+		t.Fatal("expected bad_request, got", err)
+	} else if info, err := c.HostInfo(host.PublicKey(), 0); err != nil {
+		t.Fatal(err)
+	} else if info.Scans != 1 || info.Successes != 1 {
+		t.Fatal("rule scan was not recorded:", info)
+	}
+
+	// tightening the rules should remove the host, but not the set
+	rules.MinVersion = "1.6"
+	if hosts, err := c.SetHostSetRules("foo", rules); err != nil {
+		t.Fatal(err)
+	} else if len(hosts) != 0 {
+		t.Fatal("wrong members:", hosts)
+	} else if infos, err := c.HostSetInfos(); err != nil {
+		t.Fatal(err)
+	} else if len(infos) != 1 || !infos[0].Dynamic || infos[0].Hosts != 0 {
+		t.Fatal("wrong host set info:", infos)
+	} else if revs, err := c.HostSetHistory("foo"); err != nil {
+		t.Fatal(err)
+	} else if len(revs) != 2 || revs[1].Action != "resolve rules" {
+		t.Fatal("wrong history:", revs)
+	}
+
+	// removing the rules should leave a static set
+	if _, err := c.SetHostSetRules("foo", nil); err != nil {
+		t.Fatal(err)
+	} else if _, err := c.HostSetRules("foo"); !errors.Is(err, ErrUnknownHostSet) {
+		t.Fatal("expected unknown_host_set, got", err)
+	} else if _, err := c.RefreshHostSet("foo"); !errors.Is(err, ErrUnknownHostSet) {
+		t.Fatal("expected unknown_host_set, got", err)
+	}
+}
+
+func TestHostSetCompose(t *testing.T) {
+	for expr, want := range map[string]string{
+		"a":                 "a",
+		"a | b - c":         "((a|b)-c)",
+		"a - b | c":         "((a-b)|c)",
+		"a | b & c":         "(a|(b&c))",
+		"(a | b) & c":       "((a|b)&c)",
+		"eu-west ∪ us − bl": "((eu-west|us)-bl)",
+	} {
+		e, err := parseSetExpr(expr)
+		if err != nil {
+			t.Fatal(expr, err)
+		}
+		var str func(e *setExpr) string
+		str = func(e *setExpr) string {
+			if e.op == 0 {
+				return e.name
+			}
+			return "(" + str(e.left) + string(e.op) + str(e.right) + ")"
+		}
+		if got := str(e); got != want {
+			t.Errorf("%q: expected %v, got %v", expr, want, got)
+		}
+	}
+	for _, expr := range []string{"", "a |", "| a", "(a | b", "a b", "a )"} {
+		if _, err := parseSetExpr(expr); err == nil {
+			t.Errorf("%q: expected error", expr)
+		}
+	}
+
+	srv, err := NewServer("", stubWallet{}, stubTpool{}, stubShard{}, WithStore(NewMemStore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := NewClient(ts.URL)
+
+	keys := make([]hostdb.HostPublicKey, 4)
+	for i := range keys {
+		keys[i] = hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+	}
+	if err := c.SetHostSet("eu", keys[:2]); err != nil {
+		t.Fatal(err)
+	} else if err := c.SetHostSet("us", keys[2:]); err != nil {
+		t.Fatal(err)
+	} else if err := c.SetHostSet("blocklist", keys[1:2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ComposeHostSet("prod", "eu | asia"); !errors.Is(err, ErrUnknownHostSet) {
+		t.Fatal("expected unknown_host_set, got", err)
+	} else if _, err := c.ComposeHostSet("eu", "us"); !errors.Is(err, Error{Code: CodeBadRequest}) {
+		t.Fatal("expected bad_request, got", err)
+	} else if hosts, err := c.ComposeHostSet("prod", "eu | us - blocklist"); err != nil {
+		t.Fatal(err)
+	} else if len(hosts) != 3 {
+		t.Fatal("wrong hosts:", hosts)
+	} else if _, err := c.ComposeHostSet("staging", "prod"); err != nil {
+		t.Fatal(err)
+	} else if _, err := c.ComposeHostSet("prod", "eu | staging"); !errors.Is(err, Error{Code: CodeBadRequest}) {
+		t.Fatal("expected cycle to be rejected, got", err)
+	}
+
+	// a set referenced by an expression cannot be deleted
+	if _, err := c.RemoveFromHostSet("blocklist", keys[1]); !errors.Is(err, Error{Code: CodeBadRequest}) {
+		t.Fatal("expected bad_request, got", err)
+	} else if err := c.SetHostSet("prod", nil); !errors.Is(err, Error{Code: CodeBadRequest}) {
+		t.Fatal("expected bad_request, got", err)
+	}
+
+	// membership is resolved on read
+	if err := c.SetHostSet("blocklist", keys[3:]); err != nil {
+		t.Fatal(err)
+	} else if hosts, err := c.HostSet("staging"); err != nil {
+		t.Fatal(err)
+	} else if len(hosts) != 3 {
+		t.Fatal("wrong hosts:", hosts)
+	} else if _, err := c.RemoveFromHostSet("prod", keys[0]); !errors.Is(err, Error{Code: CodeBadRequest}) {
+		t.Fatal("expected bad_request, got", err)
+	} else if expr, err := c.HostSetExpression("prod"); err != nil || expr != "eu | us - blocklist" {
+		t.Fatal("wrong expression:", expr, err)
+	}
+
+	// decomposing should leave a static set
+	if _, err := c.ComposeHostSet("staging", ""); err != nil {
+		t.Fatal(err)
+	} else if _, err := c.RemoveFromHostSet("staging", keys[0]); err != nil {
+		t.Fatal(err)
+	} else if infos, err := c.HostSetInfos(); err != nil {
+		t.Fatal(err)
+	} else if len(infos) != 5 || infos[3].Name != "staging" || infos[3].Expression != "" || infos[2].Expression == "" {
+		t.Fatal("wrong host set infos:", infos)
+	}
+
+	// composing and decomposing should be recorded and published
+	if revs, err := c.HostSetHistory("staging"); err != nil {
+		t.Fatal(err)
+	} else if len(revs) != 3 || revs[0].Action != "compose" || len(revs[0].Hosts) != 3 || revs[1].Action != "decompose" {
+		t.Fatal("wrong history:", revs)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := c.WithContext(ctx).Events(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changes int
+	for changes < 2 {
+		select {
+		case e := <-events:
+			var hs EventHostSet
+			if e.Type != EventHostSetChanged {
+				continue
+			} else if err := json.Unmarshal(e.Data, &hs); err != nil {
+				t.Fatal(err)
+			} else if hs.Name == "staging" && len(hs.Hosts) == 3 {
+				changes++ // once when composed, once when decomposed
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+	}
+}
+
+func TestScanBatch(t *testing.T) {
+	host, err := newHost("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	shardAddr, stop := startSHARD(host.PublicKey(), host.announcement())
+	defer stop()
+	srv, err := NewServer("", stubWallet{}, stubTpool{}, RemoteShard(shardAddr), WithStore(NewMemStore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := NewClient(ts.URL)
+
+	if _, err := c.ScanMany(RequestScanBatch{}); !errors.Is(err, Error{Code: CodeBadRequest}) {
+		t.Fatal("expected bad_request, got", err)
+	} else if _, err := c.ScanMany(RequestScanBatch{HostSet: "foo"}); !errors.Is(err, ErrUnknownHostSet) {
+		t.Fatal("expected unknown_host_set, got", err)
+	}
+
+	unknown := hostdb.HostKeyFromPublicKey(make([]byte, 32))
+	results, err := c.ScanMany(RequestScanBatch{
+		HostKeys:    []hostdb.HostPublicKey{host.PublicKey(), unknown},
+		Concurrency: 1,
+		TimeoutMS:   5000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[hostdb.HostPublicKey]ScanResult)
+	for r := range results {
+		got[r.HostKey] = r
+	}
+	if r := got[host.PublicKey()]; r.Error != nil || r.Settings == nil || r.Address != host.addr || r.LatencyMS <= 0 {
+		t.Fatalf("wrong result for host: %+v", r)
+	} else if r := got[unknown]; !errors.Is(r.Error, ErrUnknownHost) || r.Settings != nil {
+		t.Fatalf("wrong result for unknown host: %+v", r)
+	}
+
+	if err := c.SetHostSet("foo", []hostdb.HostPublicKey{host.PublicKey()}); err != nil {
+		t.Fatal(err)
+	} else if results, err := c.ScanMany(RequestScanBatch{HostSet: "foo"}); err != nil {
+		t.Fatal(err)
+	} else if r, ok := <-results; !ok || r.HostKey != host.PublicKey() || r.Error != nil {
+		t.Fatalf("wrong result: %+v", r)
+	} else if _, ok := <-results; ok {
+		t.Fatal("expected a single result")
+	}
+}
+
+func TestHostInfo(t *testing.T) {
+	hostKey := hostdb.HostKeyFromPublicKey(make([]byte, 32))
+	now := time.Now()
+	settings := func(price uint64) *hostdb.HostSettings {
+		return &hostdb.HostSettings{StoragePrice: types.NewCurrency64(price)}
+	}
+	recs := []ScanRecord{
+		{Timestamp: now, Success: true, LatencyMS: 100, Settings: settings(100)},
+		{Timestamp: now.Add(time.Hour), Error: "offline"},
+		{Timestamp: now.Add(2 * time.Hour), Success: true, LatencyMS: 300, Settings: settings(150)},
+		{Timestamp: now.Add(3 * time.Hour), Address: "example.com:9982", Error: "offline"},
+	}
+	info := summarizeScans(hostKey, recs, 2)
+	if info.Scans != 4 || info.Successes != 2 || info.Uptime != 0.5 {
+		t.Fatalf("wrong uptime: %v/%v (%v)", info.Successes, info.Scans, info.Uptime)
+	} else if info.AvgLatencyMS != 200 {
+		t.Fatal("wrong average latency:", info.AvgLatencyMS)
+	} else if info.PriceTrend.Storage != 0.5 || info.PriceTrend.Upload != 0 {
+		t.Fatalf("wrong price trend: %+v", info.PriceTrend)
+	} else if !info.PriceTrend.exceeds(0.2) || info.PriceTrend.exceeds(0.5) {
+		t.Fatalf("wrong price trend threshold: %+v", info.PriceTrend)
+	} else if !info.LastSuccess.Equal(recs[2].Timestamp) || info.Settings != recs[2].Settings || info.Address != "example.com:9982" {
+		t.Fatalf("wrong summary: %+v", info)
+	} else if len(info.History) != 2 || info.History[0].Error != "offline" || !info.History[1].Success {
+		t.Fatalf("wrong history: %+v", info.History)
+	}
+
+	host, err := newHost("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	shardAddr, stop := startSHARD(host.PublicKey(), host.announcement())
+	defer stop()
+	srv, err := NewServer("", stubWallet{}, stubTpool{}, RemoteShard(shardAddr), WithStore(NewMemStore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := NewClient(ts.URL)
+
+	if _, err := c.HostInfo(host.PublicKey(), 0); !errors.Is(err, Error{Code: CodeNotFound}) {
+		t.Fatal("expected not_found, got", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.Scan(host.PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	host.Close()
+	if _, err := c.Scan(host.PublicKey()); !errors.Is(err, ErrHostUnreachable) {
+		t.Fatal("expected host_unreachable, got", err)
+	}
+	info, err = c.HostInfo(host.PublicKey(), 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if info.Scans != 3 || info.Successes != 2 || info.Address != host.addr || info.Settings == nil {
+		t.Fatalf("wrong info: %+v", info)
+	} else if len(info.History) != 1 || info.History[0].Success {
+		t.Fatalf("wrong history: %+v", info.History)
+	}
+}
+
+func TestScanRecords(t *testing.T) {
+	s := &server{store: NewMemStore()}
+	hostKey := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+	if s.recentSettings(hostKey) != nil {
+		t.Fatal("expected no settings for unscanned host")
+	}
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < maxScanRecords+10; i++ {
+		rec := ScanRecord{
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+			Success:   i == 5,
+		}
+		if rec.Success {
+			rec.Settings = &hostdb.HostSettings{Version: "1.5.6"}
+		}
+		s.recordScan(hostKey, rec)
+	}
+	if recs, err := s.scanHistory(hostKey); err != nil {
+		t.Fatal(err)
+	} else if len(recs) != maxScanRecords {
+		t.Fatal("wrong number of scans:", len(recs))
+	} else if !recs[0].Timestamp.Equal(start.Add(10*time.Second)) || !recs[len(recs)-1].Timestamp.Equal(start.Add(time.Duration(maxScanRecords+9)*time.Second)) {
+		t.Fatal("wrong scans retained:", recs[0].Timestamp, recs[len(recs)-1].Timestamp)
+	}
+	// the newest successful scan is remembered even after it is pruned
+	if settings := s.recentSettings(hostKey); settings == nil || settings.Version != "1.5.6" {
+		t.Fatal("wrong recent settings:", settings)
+	}
+}
+
+func TestSettingsChanges(t *testing.T) {
+	from := hostdb.HostSettings{
+		StoragePrice:  types.NewCurrency64(100),
+		ContractPrice: types.NewCurrency64(100),
+		Collateral:    types.NewCurrency64(100),
+		MaxCollateral: types.NewCurrency64(100),
+	}
+	to := from
+	to.StoragePrice = types.NewCurrency64(200)
+	to.ContractPrice = types.NewCurrency64(50)
+	to.Collateral = types.NewCurrency64(50)
+	to.MaxCollateral = types.NewCurrency64(200)
+	if changes := settingsChanges(&from, &to); len(changes) != 2 ||
+		changes[0].Field != "storagePrice" || !changes[0].Old.Equals(from.StoragePrice) || !changes[0].New.Equals(to.StoragePrice) ||
+		changes[1].Field != "collateral" || !changes[1].Old.Equals(from.Collateral) || !changes[1].New.Equals(to.Collateral) {
+		t.Fatalf("wrong changes: %+v", changes)
+	} else if changes := settingsChanges(&to, &to); len(changes) != 0 {
+		t.Fatalf("expected no changes, got %+v", changes)
+	}
+
+	host, err := newHost("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	shardAddr, stop := startSHARD(host.PublicKey(), host.announcement())
+	defer stop()
+	store := NewMemStore()
+	srv, err := NewServer("", stubWallet{}, stubTpool{}, RemoteShard(shardAddr), WithStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewClient(ts.URL).WithContext(ctx)
+	events, err := c.Events(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stale scans are ignored
+	prev := host.settings()
+	prev.Collateral = types.NewCurrency64(100)
+	storeScan := func(age time.Duration) {
+		rec := ScanRecord{Timestamp: time.Now().Add(-age), Success: true, Settings: &prev}
+		(&server{store: store}).recordScan(host.PublicKey(), rec)
+	}
+	storeScan(48 * time.Hour)
+	if rs, err := c.ScanChanges(host.PublicKey()); err != nil {
+		t.Fatal(err)
+	} else if len(rs.Changes) != 0 || rs.NetAddress != host.addr {
+		t.Fatalf("wrong scan response: %+v", rs)
+	}
+
+	// a decrease from the newest scan should be reported
+	storeScan(0)
+	if rs, err := c.ScanChanges(host.PublicKey()); err != nil {
+		t.Fatal(err)
+	} else if len(rs.Changes) != 1 || rs.Changes[0].Field != "collateral" || !rs.Changes[0].Old.Equals(prev.Collateral) || !rs.Changes[0].New.IsZero() {
+		t.Fatalf("wrong changes: %+v", rs.Changes)
+	}
+	select {
+	case e := <-events:
+		var eh EventHostSettings
+		if e.Type != EventHostSettingsChanged {
+			t.Fatal("wrong event type:", e.Type)
+		} else if err := json.Unmarshal(e.Data, &eh); err != nil {
+			t.Fatal(err)
+		} else if eh.HostKey != host.PublicKey() || eh.Address != host.addr || len(eh.Changes) != 1 {
+			t.Fatalf("wrong event data: %+v", eh)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	// the new settings are compared against the previous scan
+	if rs, err := c.ScanChanges(host.PublicKey()); err != nil {
+		t.Fatal(err)
+	} else if len(rs.Changes) != 0 {
+		t.Fatalf("expected no changes, got %+v", rs.Changes)
+	}
+}
+
+func TestHostCache(t *testing.T) {
+	host, err := newHost("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	shardAddr, stop := startSHARD(host.PublicKey(), host.announcement())
+	defer stop()
+	srv, err := NewServer("", stubWallet{}, stubTpool{}, RemoteShard(shardAddr), WithStore(NewMemStore()),
+		WithHostCache(time.Minute, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := NewClient(ts.URL)
+
+	for i := 0; i < 3; i++ {
+		if settings, err := c.Scan(host.PublicKey()); err != nil {
+			t.Fatal(err)
+		} else if settings.NetAddress != host.addr {
+			t.Fatal("wrong address:", settings.NetAddress)
+		} else if hostKey, err := c.SHARD().LookupHost(string(host.PublicKey())[8:16]); err != nil {
+			t.Fatal(err)
+		} else if hostKey != host.PublicKey() {
+			t.Fatal("wrong host key:", hostKey)
+		}
+	}
+	if info, err := c.HostInfo(host.PublicKey(), 0); err != nil {
+		t.Fatal(err)
+	} else if info.Scans != 1 {
+		t.Fatal("cached scans should not be recorded:", info.Scans)
+	}
+	if m, err := c.Metrics(); err != nil {
+		t.Fatal(err)
+	} else if hc := m.HostCache; !hc.Enabled || hc.ResolveHits != 2 || hc.ResolveMisses != 1 ||
+		hc.ScanHits != 2 || hc.ScanMisses != 1 || hc.LookupHits != 2 || hc.LookupMisses != 1 ||
+		hc.Addresses != 1 || hc.Lookups != 1 || hc.Scans != 1 {
+		t.Fatalf("wrong metrics: %+v", hc)
+	}
+
+	// cached lookups should be served with the original Content-Type
+	var contentTypes []string
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(ts.URL + apiPrefix + "/shard/host/" + string(host.PublicKey()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		contentTypes = append(contentTypes, resp.Header.Get("Content-Type"))
+	}
+	if contentTypes[0] == "" || contentTypes[1] != contentTypes[0] {
+		t.Fatal("wrong content types:", contentTypes)
+	}
+
+	// a new block may contain announcements
+	hc := &server{}
+	WithHostCache(time.Minute, time.Minute)(hc)
+	hc.cache.setHeight(1)
+	hc.cache.addrs[string(host.PublicKey())] = cacheEntry{host.addr, time.Now().Add(time.Minute)}
+	hc.cache.scans[string(host.PublicKey())] = cacheEntry{ScanResult{}, time.Now().Add(time.Minute)}
+	hc.cache.lookups["/host/foo"] = cacheEntry{cachedLookup{body: []byte("foo")}, time.Now().Add(-time.Second)}
+	if m := hc.cache.snapshot(); m.Addresses != 1 || m.Scans != 1 || m.Lookups != 0 {
+		t.Fatalf("wrong metrics: %+v", m)
+	}
+	hc.cache.setHeight(1)
+	if m := hc.cache.snapshot(); m.Addresses != 1 || m.Invalidations != 0 {
+		t.Fatalf("wrong metrics: %+v", m)
+	}
+	hc.cache.setHeight(2)
+	if m := hc.cache.snapshot(); m.Addresses != 0 || m.Scans != 1 || m.Invalidations != 1 {
+		t.Fatalf("wrong metrics: %+v", m)
+	}
+	// a failed scan evicts the host
+	hc.cache.addrs[string(host.PublicKey())] = cacheEntry{host.addr, time.Now().Add(time.Minute)}
+	hc.cacheScan(ScanResult{HostKey: host.PublicKey(), Error: &Error{Code: CodeHostUnreachable}})
+	if m := hc.cache.snapshot(); m.Addresses != 0 || m.Scans != 0 || m.Evictions != 1 {
+		t.Fatalf("wrong metrics: %+v", m)
+	}
+}
+
+func TestShardPool(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping shard failover test in short mode")
+	}
+	host, err := newHost("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	shardAddr, stop := startSHARD(host.PublicKey(), host.announcement())
+	defer stop()
+	otherAddr, stopOther := startSHARD(host.PublicKey(), host.announcement())
+	defer stopOther()
+	emptyAddr, stopEmpty := startSHARDHosts(nil)
+	defer stopEmpty()
+	deadAddr, stopDead := startSHARDHosts(nil)
+	stopDead()
+
+	// requests should fail over to a working shard server
+	srv, err := NewServer("", stubWallet{}, stubTpool{}, RemoteShard(deadAddr), WithStore(NewMemStore()),
+		WithShards([]Shard{RemoteShard(shardAddr)}, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := NewClient(ts.URL)
+	if settings, err := c.Scan(host.PublicKey()); err != nil {
+		t.Fatal(err)
+	} else if settings.NetAddress != host.addr {
+		t.Fatal("wrong address:", settings.NetAddress)
+	} else if hostKey, err := c.SHARD().LookupHost(string(host.PublicKey())); err != nil {
+		t.Fatal(err)
+	} else if hostKey != host.PublicKey() {
+		t.Fatal("wrong host key:", hostKey)
+	}
+
+	// an in-process relay should behave like a shard server
+	r, err := shard.NewRelay(mockCS{}, &memPersist{
+		PersistData: shard.PersistData{
+			Hosts: map[hostdb.HostPublicKey][]byte{host.PublicKey(): host.announcement()},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err = NewServer("", stubWallet{}, stubTpool{}, LocalShard(r), WithStore(NewMemStore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts2 := httptest.NewServer(srv)
+	defer ts2.Close()
+	c = NewClient(ts2.URL)
+	if settings, err := c.Scan(host.PublicKey()); err != nil {
+		t.Fatal(err)
+	} else if settings.NetAddress != host.addr {
+		t.Fatal("wrong address:", settings.NetAddress)
+	} else if hostKey, err := c.SHARD().LookupHost(string(host.PublicKey())); err != nil {
+		t.Fatal(err)
+	} else if hostKey != host.PublicKey() {
+		t.Fatal("wrong host key:", hostKey)
+	} else if _, err := c.Scan(hostdb.HostPublicKey("ed25519:" + strings.Repeat("0", 64))); !errors.Is(err, ErrUnknownHost) {
+		t.Fatal("expected unknown_host, got", err)
+	}
+
+	// with a quorum, enough servers must agree
+	if _, err := newShardPool([]Shard{RemoteShard(shardAddr)}, 2); err == nil {
+		t.Fatal("expected quorum to be rejected")
+	}
+	shards := []Shard{RemoteShard(shardAddr), RemoteShard(otherAddr), RemoteShard(emptyAddr), RemoteShard(deadAddr)}
+	p, _ := newShardPool(shards, 2)
+	if addr, err := p.ResolveHostKey(host.PublicKey()); err != nil {
+		t.Fatal(err)
+	} else if addr != host.addr {
+		t.Fatal("wrong address:", addr)
+	} else if _, err := p.ChainHeight(); err != nil {
+		t.Fatal(err)
+	}
+	p, _ = newShardPool(shards, 3)
+	if _, err := p.ResolveHostKey(host.PublicKey()); !errors.Is(err, errShardDisagreement) || resolveErrorCode(err) != CodeInternal {
+		t.Fatal("expected disagreement, got", err)
+	}
+	p, _ = newShardPool(shards, 4)
+	if _, err := p.ChainHeight(); !isShardFailure(err) {
+		t.Fatal("expected shard failure, got", err)
+	}
+
+	// proxied requests should be retried on the next shard server
+	p, _ = newShardPool([]Shard{RemoteShard(deadAddr), RemoteShard(shardAddr)}, 0)
+	rec := httptest.NewRecorder()
+	p.proxy().ServeHTTP(rec, httptest.NewRequest("GET", apiPrefix+"/shard/host/"+string(host.PublicKey()), nil))
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), host.announcement()) {
+		t.Fatalf("wrong proxy response: %v %q", rec.Code, rec.Body.Bytes())
+	} else if b := p.healthy()[0]; b.shard.(*remoteShard).addr != shardAddr {
+		t.Fatal("dead shard server should be avoided")
+	}
+
+	// but not if the shard server was reached, whatever its response
+	badGateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "upstream failed", http.StatusBadGateway)
+	}))
+	defer badGateway.Close()
+	p, _ = newShardPool([]Shard{RemoteShard(badGateway.URL), RemoteShard(shardAddr)}, 0)
+	rec = httptest.NewRecorder()
+	p.proxy().ServeHTTP(rec, httptest.NewRequest("GET", apiPrefix+"/shard/height", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatal("expected 502, got", rec.Code)
+	} else if b := p.healthy()[0]; b.shard.(*remoteShard).addr != badGateway.URL {
+		t.Fatal("reachable shard server should not be avoided")
+	}
+
+	// and should fail with 503 if no shard server is available
+	for _, shards := range [][]Shard{{RemoteShard(deadAddr)}, {stubShard{}}} {
+		p, _ = newShardPool(shards, 0)
+		rec = httptest.NewRecorder()
+		p.proxy().ServeHTTP(rec, httptest.NewRequest("GET", apiPrefix+"/shard/height", nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatal("expected 503, got", rec.Code)
+		}
+	}
+}
+
+func TestChainChecks(t *testing.T) {
+	host, err := newHost("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	shardAddr, stop := startSHARD(host.PublicKey(), host.announcement())
+	defer stop()
+	srv, err := NewServer("", stubWallet{}, stubTpool{}, RemoteShard(shardAddr), WithStore(NewMemStore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := NewClient(ts.URL)
+	sh := &hostdb.ScannedHost{
+		HostSettings: host.settings(),
+		PublicKey:    host.PublicKey(),
+	}
+
+	// the shard server's height is 0
+	if _, err := c.Form(sh, types.ZeroCurrency, maxStartHeightDrift+1, 1000); !errors.Is(err, Error{Code: CodeBadRequest}) {
+		t.Fatal("expected bad_request, got", err)
+	} else if _, err := c.Form(sh, types.ZeroCurrency, maxStartHeightDrift, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	// an unsynced shard server should be reported
+	r, err := shard.NewRelay(mockCS{unsynced: true}, &memPersist{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err = NewServer("", stubWallet{}, stubTpool{}, LocalShard(r), WithStore(NewMemStore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts2 := httptest.NewServer(srv)
+	defer ts2.Close()
+	c = NewClient(ts2.URL)
+	if _, err := c.Form(sh, types.ZeroCurrency, 0, 1000); !errors.Is(err, ErrNotSynced) {
+		t.Fatal("expected not_synced, got", err)
+	} else if _, err := c.Renew(sh, &renter.Contract{}, types.ZeroCurrency, 0, 1000); !errors.Is(err, ErrNotSynced) {
+		t.Fatal("expected not_synced, got", err)
+	}
+
+	// so should an unreachable one
+	srv, err = NewServer("", stubWallet{}, stubTpool{}, RemoteShard("http://127.0.0.1:1"), WithStore(NewMemStore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts3 := httptest.NewServer(srv)
+	defer ts3.Close()
+	c = NewClient(ts3.URL)
+	if _, err := c.Form(sh, types.ZeroCurrency, 0, 1000); !errors.Is(err, ErrNotSynced) {
+		t.Fatal("expected not_synced, got", err)
+	}
+}
+
+func TestContractLimits(t *testing.T) {
+	host, err := newHost("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	shardAddr, stop := startSHARD(host.PublicKey(), host.announcement())
+	defer stop()
+	limits := ContractLimits{
+		MaxStoragePrice: types.NewCurrency64(10),
+		MaxDuration:     500,
+	}
+	srv, err := NewServer("", stubWallet{}, stubTpool{}, RemoteShard(shardAddr), WithStore(NewMemStore()),
+		WithContractLimits(func() ContractLimits { return limits }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := NewClient(ts.URL)
+	sh := &hostdb.ScannedHost{
+		HostSettings: host.settings(),
+		PublicKey:    host.PublicKey(),
+	}
+
+	sh.StoragePrice = types.NewCurrency64(11)
+	if _, err := c.Form(sh, types.ZeroCurrency, 0, 100); !errors.Is(err, ErrPriceGouging) {
+		t.Fatal("expected price_gouging, got", err)
+	} else if _, err := c.Renew(sh, &renter.Contract{}, types.ZeroCurrency, 0, 100); !errors.Is(err, ErrPriceGouging) {
+		t.Fatal("expected price_gouging, got", err)
+	}
+	sh.StoragePrice = types.ZeroCurrency
+	if _, err := c.Form(sh, types.ZeroCurrency, 0, 1000); !errors.Is(err, Error{Code: CodeBadRequest}) {
+		t.Fatal("expected bad_request, got", err)
+	}
+
+	// limits may change while the server is running
+	limits = ContractLimits{}
+	if _, err := c.Form(sh, types.ZeroCurrency, 0, 1000); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostMonitor(t *testing.T) {
+	host, err := newHost("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	shardAddr, stop := startSHARD(host.PublicKey(), host.announcement())
+	defer stop()
+	// the test host reports no remaining storage
+	srv, err := NewServer("", stubWallet{}, stubTpool{}, RemoteShard(shardAddr), WithStore(NewMemStore()),
+		WithHostMonitor(50*time.Millisecond, 1<<30, 0.2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewClient(ts.URL).WithContext(ctx)
+
+	events, err := c.Events(0)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := c.SetHostSet("foo", []hostdb.HostPublicKey{host.PublicKey()}); err != nil {
+		t.Fatal(err)
+	}
+	nextHostEvent := func() (EventType, EventHost) {
+		t.Helper()
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					t.Fatal("event stream closed")
+				} else if e.Type == EventHostSetChanged {
+					continue
+				}
+				var eh EventHost
+				if err := json.Unmarshal(e.Data, &eh); err != nil {
+					t.Fatal(err)
+				}
+				return e.Type, eh
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for event")
+			}
+		}
+	}
+	if typ, eh := nextHostEvent(); typ != EventHostLowStorage {
+		t.Fatal("wrong event type:", typ)
+	} else if eh.HostKey != host.PublicKey() || eh.Address != host.addr || len(eh.HostSets) != 1 || eh.HostSets[0] != "foo" {
+		t.Fatalf("wrong event data: %+v", eh)
+	} else if eh.Error != "" || eh.PriceChange != nil {
+		t.Fatalf("event data includes fields of other event types: %+v", eh)
+	}
+
+	// events are only published when the host's state changes
+	host.Close()
+	if typ, eh := nextHostEvent(); typ != EventHostOffline {
+		t.Fatal("wrong event type:", typ)
+	} else if eh.Error == "" {
+		t.Fatalf("wrong event data: %+v", eh)
+	}
+	if info, err := c.HostInfo(host.PublicKey(), 0); err != nil {
+		t.Fatal(err)
+	} else if info.Scans < 2 || info.Successes == 0 || info.Successes == info.Scans {
+		t.Fatalf("monitor scans were not recorded: %+v", info)
+	}
+}
+
+func TestAccessLists(t *testing.T) {
+	// hosts that cannot be resolved should fail closed against subnets
+	hostKey := hostdb.HostKeyFromPublicKey(make([]byte, 32))
+	for _, test := range []struct {
+		al      accessLists
+		blocked bool
+	}{
+		{accessLists{block: []AccessEntry{{Entry: "10.0.0.0/8"}}}, true},
+		{accessLists{allow: []AccessEntry{{Entry: "10.0.0.0/8"}}}, true},
+		{accessLists{block: []AccessEntry{{Entry: "ed25519:" + strings.Repeat("1", 64)}}}, false},
+	} {
+		err := test.al.check(hostKey, "unresolvable.invalid:9982")
+		if blocked := errors.Is(err, ErrHostBlocked); blocked != test.blocked {
+			t.Fatalf("%+v: expected blocked = %v, got %v", test.al, test.blocked, err)
+		}
+	}
+
+	if testing.Short() {
+		t.Skip("skipping host scan test in short mode")
+	}
+	host, err := newHost("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	shardAddr, stop := startSHARD(host.PublicKey(), host.announcement())
+	defer stop()
+	srv, err := NewServer("", stubWallet{}, stubTpool{}, RemoteShard(shardAddr), WithStore(NewMemStore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := NewClient(ts.URL)
+
+	if _, err := c.Scan(host.PublicKey()); err != nil {
+		t.Fatal(err)
+	} else if err := c.SetBlocklist([]AccessEntry{{Entry: "127.0.0.1/99"}}); !errors.Is(err, Error{Code: CodeBadRequest}) {
+		t.Fatal("expected bad_request, got", err)
+	}
+
+	// block the host's subnet
+	blocklist := []AccessEntry{{Entry: "127.0.0.0/8", Reason: "loopback"}}
+	if err := c.SetBlocklist(blocklist); err != nil {
+		t.Fatal(err)
+	} else if entries, err := c.Blocklist(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || entries[0] != blocklist[0] {
+		t.Fatal("wrong blocklist:", entries)
+	} else if _, err := c.Scan(host.PublicKey()); !errors.Is(err, ErrHostBlocked) {
+		t.Fatal("expected host_blocked, got", err)
+	} else if err := c.SetHostSet("foo", []hostdb.HostPublicKey{host.PublicKey()}); !errors.Is(err, ErrHostBlocked) {
+		t.Fatal("expected host_blocked, got", err)
+	}
+
+	// block the host by key
+	if err := c.SetBlocklist([]AccessEntry{{Entry: string(host.PublicKey())}}); err != nil {
+		t.Fatal(err)
+	} else if _, err := c.Scan(host.PublicKey()); !errors.Is(err, ErrHostBlocked) {
+		t.Fatal("expected host_blocked, got", err)
+	} else if err := c.SetBlocklist(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// an allowlist should exclude every other host
+	other := hostdb.HostKeyFromPublicKey(make([]byte, 32))
+	if err := c.SetAllowlist([]AccessEntry{{Entry: string(other)}}); err != nil {
+		t.Fatal(err)
+	} else if _, err := c.Scan(host.PublicKey()); !errors.Is(err, ErrHostBlocked) {
+		t.Fatal("expected host_blocked, got", err)
+	} else if err := c.SetAllowlist([]AccessEntry{{Entry: string(other)}, {Entry: "127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	} else if _, err := c.Scan(host.PublicKey()); err != nil {
+		t.Fatal(err)
+	} else if err := c.SetHostSet("foo", []hostdb.HostPublicKey{host.PublicKey()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// rolling back to a revision containing a blocked host should fail
+	if err := c.SetHostSet("foo", nil); err != nil {
+		t.Fatal(err)
+	} else if err := c.SetAllowlist(nil); err != nil {
+		t.Fatal(err)
+	} else if err := c.SetBlocklist([]AccessEntry{{Entry: string(host.PublicKey())}}); err != nil {
+		t.Fatal(err)
+	} else if _, err := c.RollbackHostSet("foo", 1); !errors.Is(err, ErrHostBlocked) {
+		t.Fatal("expected host_blocked, got", err)
+	}
+}
+
+func TestHostSetDiversity(t *testing.T) {
+	keys := make([]hostdb.HostPublicKey, 5)
+	for i := range keys {
+		pk := make([]byte, 32)
+		pk[0] = byte(i)
+		keys[i] = hostdb.HostKeyFromPublicKey(pk)
+	}
+	addrs := map[hostdb.HostPublicKey]modules.NetAddress{
+		keys[0]: "host1.example.com:9982",
+		keys[1]: "HOST1.example.com:9982",
+		keys[2]: "198.51.100.7:9982",
+		keys[3]: "[2001:db8:1:2::1]:9982",
+		keys[4]: "[2001:db8:1:3::1]:9982",
+	}
+	ips := map[hostdb.HostPublicKey][]net.IP{
+		keys[0]: {net.ParseIP("203.0.113.5")},
+		keys[1]: {net.ParseIP("203.0.113.200")},
+		keys[2]: {net.ParseIP("198.51.100.7")},
+		keys[3]: {net.ParseIP("2001:db8:1:2::1")},
+		keys[4]: {net.ParseIP("2001:db8:1:3::1")},
+	}
+	exp := []DiversityViolation{
+		{Reason: "hostname", Group: "host1.example.com", Hosts: keys[0:2]},
+		{Reason: "subnet", Group: "2001:db8:1::/48", Hosts: keys[3:5]},
+		{Reason: "subnet", Group: "203.0.113.0/24", Hosts: keys[0:2]},
+	}
+	if vs := diversityViolations(addrs, ips); !reflect.DeepEqual(vs, exp) {
+		t.Fatalf("wrong violations: expected %v, got %v", exp, vs)
+	}
+	if testing.Short() {
+		t.Skip("skipping host scan test in short mode")
+	}
+
+	// two hosts on the same machine
+	host1, err := newHost("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host1.Close()
+	host2, err := newHost("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host2.Close()
+	shardAddr, stop := startSHARDHosts(map[hostdb.HostPublicKey][]byte{
+		host1.PublicKey(): host1.announcement(),
+		host2.PublicKey(): host2.announcement(),
+	})
+	defer stop()
+	srv, err := NewServer("", stubWallet{}, stubTpool{}, RemoteShard(shardAddr), WithStore(NewMemStore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := NewClient(ts.URL)
+
+	// by default, violations are only reported
+	hosts := []hostdb.HostPublicKey{host1.PublicKey(), host2.PublicKey()}
+	if err := c.SetHostSet("foo", hosts[:1]); err != nil {
+		t.Fatal(err)
+	} else if vs, err := c.HostSetDiversity("foo"); err != nil {
+		t.Fatal(err)
+	} else if len(vs) != 0 {
+		t.Fatal("expected no violations, got", vs)
+	} else if _, err := c.AddToHostSet("foo", hosts[1]); err != nil {
+		t.Fatal(err)
+	} else if vs, err := c.HostSetDiversity("foo"); err != nil {
+		t.Fatal(err)
+	} else if len(vs) != 1 || vs[0].Group != "127.0.0.0/24" || len(vs[0].Hosts) != 2 {
+		t.Fatal("wrong violations:", vs)
+	}
+
+	// with the reject policy, the set cannot be made less diverse
+	if err := c.SetHostSetMetadata("foo", HostSetMetadata{Diversity: "sometimes"}); !errors.Is(err, Error{Code: CodeBadRequest}) {
+		t.Fatal("expected bad_request, got", err)
+	} else if err := c.SetHostSetMetadata("foo", HostSetMetadata{Diversity: DiversityReject}); err != nil {
+		t.Fatal(err)
+	} else if err := c.SetHostSet("foo", hosts[:1]); err != nil {
+		t.Fatal(err)
+	} else if _, err := c.AddToHostSet("foo", hosts[1]); !errors.Is(err, ErrNotDiverse) {
+		t.Fatal("expected hostset_not_diverse, got", err)
+	} else if err := c.SetHostSet("foo", hosts); !errors.Is(err, ErrNotDiverse) {
+		t.Fatal("expected hostset_not_diverse, got", err)
+	} else if got, err := c.HostSet("foo"); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 1 {
+		t.Fatal("wrong hosts:", got)
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", t.Name())
+	defer os.RemoveAll(dir)
+	bs, err := OpenBoltStore(filepath.Join(dir, "muse.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	for name, store := range map[string]Store{"bolt": bs, "mem": NewMemStore()} {
+		if err := store.Update(func(tx StoreTx) error {
+			if err := tx.Put("foo", "b", 2); err != nil {
+				return err
+			}
+			return tx.Put("foo", "a", 1)
+		}); err != nil {
+			t.Fatal(name, err)
+		}
+		// failed transactions should not be applied
+		if err := store.Update(func(tx StoreTx) error {
+			tx.Put("foo", "c", 3)
+			tx.Put("foo", "a", 5)
+			tx.Put("foo", "a", 6)
+			tx.Delete("foo", "b")
+			return errors.New("rollback")
+		}); err == nil {
+			t.Fatal(name, "expected error")
+		}
+		var keys []string
+		var values []int
+		err := store.View(func(tx StoreTx) error {
+			return tx.ForEach("foo", func(key string, decode func(interface{}) error) error {
+				var n int
+				keys = append(keys, key)
+				err := decode(&n)
+				values = append(values, n)
+				return err
+			})
+		})
+		if err != nil {
+			t.Fatal(name, err)
+		} else if strings.Join(keys, ",") != "a,b" {
+			t.Fatal(name, "wrong keys:", keys)
+		} else if values[0] != 1 || values[1] != 2 {
+			t.Fatal(name, "wrong values:", values)
+		} else if err := store.View(func(tx StoreTx) error { return tx.Put("foo", "d", 4) }); err == nil {
+			t.Fatal(name, "expected write in read-only transaction to fail")
+		}
+	}
+}
+
+func TestPersist(t *testing.T) {
+	dir, _ := ioutil.TempDir("", t.Name())
+	defer os.RemoveAll(dir)
+	store := NewMemStore()
+	srv, err := NewServer(dir, stubWallet{}, stubTpool{}, stubShard{}, WithStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	c := NewClient(ts.URL)
+
+	// concurrent writes should all be persisted
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hostKey := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+			if err := c.SetHostSet(fmt.Sprint("set", i), []hostdb.HostPublicKey{hostKey}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	ts.Close()
+	srv, err = NewServer(dir, stubWallet{}, stubTpool{}, stubShard{}, WithStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts = httptest.NewServer(srv)
+	defer ts.Close()
+	if sets, err := NewClient(ts.URL).HostSets(); err != nil {
+		t.Fatal(err)
+	} else if len(sets) != 20 {
+		t.Fatal("expected 20 host sets, got", len(sets))
+	}
+
+	// state written by earlier versions should be migrated
+	hostKey := hostdb.HostKeyFromPublicKey(make([]byte, 32))
+	js, _ := json.Marshal(map[string][]hostdb.HostPublicKey{"legacy": {hostKey}})
+	if err := ioutil.WriteFile(filepath.Join(dir, "hostSets.json"), js, 0660); err != nil {
+		t.Fatal(err)
+	}
+	srv, err = NewServer(dir, stubWallet{}, stubTpool{}, stubShard{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts2 := httptest.NewServer(srv)
+	defer ts2.Close()
+	if hosts, err := NewClient(ts2.URL).HostSet("legacy"); err != nil {
+		t.Fatal(err)
+	} else if len(hosts) != 1 || hosts[0] != hostKey {
+		t.Fatal("wrong host set:", hosts)
+	} else if _, err := os.Stat(filepath.Join(dir, "hostSets.json.migrated")); err != nil {
+		t.Fatal("legacy file was not renamed:", err)
+	}
+
+	// corruption should be detected
+	corrupt := filepath.Join(dir, "corrupt")
+	os.Mkdir(corrupt, 0700)
+	if err := ioutil.WriteFile(filepath.Join(corrupt, "muse.db"), frand.Bytes(1<<16), 0660); err != nil {
+		t.Fatal(err)
+	} else if _, err := NewServer(corrupt, stubWallet{}, stubTpool{}, stubShard{}); err == nil {
+		t.Fatal("expected corrupt database to be rejected")
+	}
 }
 
 // minimal host, copied from us/ghost
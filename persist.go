@@ -0,0 +1,41 @@
+package muse
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"lukechampine.com/us/hostdb"
+)
+
+// migrateJSON imports the hostSets.json file written by earlier versions of
+// muse into the default tenant's host sets in store. The file is renamed with a
+// ".migrated" suffix, so that it is not imported again.
+func migrateJSON(dir string, store Store) error {
+	path := filepath.Join(dir, "hostSets.json")
+	js, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var hostSets map[string][]hostdb.HostPublicKey
+	if err := json.Unmarshal(js, &hostSets); err != nil {
+		return fmt.Errorf("%v is corrupt: %w", path, err)
+	}
+	t := newTenant("", store)
+	err = store.Update(func(tx StoreTx) error {
+		for name, set := range hostSets {
+			if err := tx.Put(t.bucket("hostSets"), name, set); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return os.Rename(path, path+".migrated")
+}
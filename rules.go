@@ -0,0 +1,327 @@
+package muse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.sia.tech/siad/build"
+	"lukechampine.com/us/hostdb"
+)
+
+// errRuleDefined is returned when attempting to edit the hosts of a host set
+// that is defined by rules.
+var errRuleDefined = errors.New("host set is defined by rules; change its rules instead")
+
+// validate checks that the rules are well-formed.
+func (r HostSetRules) validate() error {
+	if r.MinVersion != "" && !build.IsVersion(r.MinVersion) {
+		return fmt.Errorf("invalid minimum version %q", r.MinVersion)
+	}
+	for _, subnet := range r.ExcludedSubnets {
+		if _, _, err := net.ParseCIDR(subnet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// match reports whether a host with the specified settings, reachable at the
+// specified IPs, satisfies the rules.
+func (r HostSetRules) match(settings hostdb.HostSettings, ips []net.IP) bool {
+	if !r.MaxStoragePrice.IsZero() && settings.StoragePrice.Cmp(r.MaxStoragePrice) > 0 {
+		return false
+	} else if settings.RemainingStorage < r.MinRemainingStorage {
+		return false
+	} else if r.AcceptingContracts && !settings.AcceptingContracts {
+		return false
+	} else if r.MinVersion != "" && build.VersionCmp(settings.Version, r.MinVersion) < 0 {
+		return false
+	}
+	for _, subnet := range r.ExcludedSubnets {
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ipnet.Contains(ip) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// setHostSetRules replaces the rules of the named host set, deleting them if
+// rules is nil. The caller must hold the server lock.
+func (t *tenant) setHostSetRules(name string, rules *HostSetRules) error {
+	err := t.store.Update(func(tx StoreTx) error {
+		if rules == nil {
+			return tx.Delete(t.bucket("hostSetRules"), name)
+		}
+		return tx.Put(t.bucket("hostSetRules"), name, rules)
+	})
+	if err != nil {
+		return err
+	}
+	if rules == nil {
+		delete(t.hostSetRules, name)
+	} else {
+		t.hostSetRules[name] = *rules
+	}
+	return nil
+}
+
+// hasHostSet reports whether the named host set exists. Sets defined by rules
+// or composed of other sets exist even if they currently contain no hosts. The
+// caller must hold the server lock.
+func (t *tenant) hasHostSet(name string) bool {
+	_, static := t.hostSets[name]
+	_, dynamic := t.hostSetRules[name]
+	_, composed := t.hostSetExprs[name]
+	return static || dynamic || composed
+}
+
+// resolveRules scans the candidates of rules and returns those that satisfy
+// them, sorted. Candidates that cannot be scanned, or that are not permitted by
+// the server's access lists, are excluded. An error is returned if the shard
+// server is unreachable, or if the rules exclude subnets and the address of a
+// scanned candidate cannot be resolved.
+func (s *server) resolveRules(candidates []hostdb.HostPublicKey, rules HostSetRules) ([]hostdb.HostPublicKey, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var members []hostdb.HostPublicKey
+	var shardErr, lookupErr error
+	sem := make(chan struct{}, defaultScanConcurrency)
+	for _, hostKey := range candidates {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(hostKey hostdb.HostPublicKey) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			r := s.scanHost(hostKey, defaultScanTimeout)
+			if r.Error != nil {
+				if r.Address == "" && r.Error.Code == CodeInternal {
+					// the shard server is unreachable
+					mu.Lock()
+					shardErr = r.Error
+					mu.Unlock()
+				}
+				return
+			}
+			var ips []net.IP
+			if len(rules.ExcludedSubnets) > 0 {
+				var err error
+				if ips, err = lookupHostIPs(r.Address.Host()); err != nil {
+					mu.Lock()
+					lookupErr = fmt.Errorf("could not resolve address of host %v: %w", hostKey.ShortKey(), err)
+					mu.Unlock()
+					return
+				}
+			}
+			if rules.match(*r.Settings, ips) {
+				mu.Lock()
+				members = append(members, hostKey)
+				mu.Unlock()
+			}
+		}(hostKey)
+	}
+	wg.Wait()
+	if shardErr != nil {
+		return nil, fmt.Errorf("could not resolve host keys: %w", shardErr)
+	} else if lookupErr != nil {
+		return nil, lookupErr
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i] < members[j]
+	})
+	return members, nil
+}
+
+// equalHostKeys reports whether two sorted lists of host keys are equal.
+func equalHostKeys(a, b []hostdb.HostPublicKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// candidates returns the hosts that may satisfy the rules of the named host
+// set. The caller must hold the server lock.
+func (t *tenant) candidates(name string) []hostdb.HostPublicKey {
+	rules := t.hostSetRules[name]
+	if len(rules.Candidates) > 0 {
+		return append([]hostdb.HostPublicKey(nil), rules.Candidates...)
+	}
+	seen := make(map[hostdb.HostPublicKey]bool)
+	var hosts []hostdb.HostPublicKey
+	for _, r := range t.contracts {
+		if !seen[r.HostKey] {
+			seen[r.HostKey] = true
+			hosts = append(hosts, r.HostKey)
+		}
+	}
+	return hosts
+}
+
+// refreshHostSet resolves the rules of the named host set and records any
+// change in its membership, returning the resulting membership.
+func (s *server) refreshHostSet(t *tenant, name string) ([]hostdb.HostPublicKey, error) {
+	s.mu.Lock()
+	rules, ok := t.hostSetRules[name]
+	candidates := t.candidates(name)
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrUnknownHostSet
+	}
+	members, err := s.resolveRules(candidates, rules)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if _, ok := t.hostSetRules[name]; !ok {
+		// rules were removed while resolving
+		s.mu.Unlock()
+		return nil, ErrUnknownHostSet
+	}
+	changed := !equalHostKeys(members, t.hostSets[name])
+	_, wasBelow := t.hostSetSize(name)
+	if changed {
+		_, err = t.setHostSet(name, members, actor{name: "muse"}, "resolve rules")
+	}
+	size, below := t.hostSetSize(name)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		s.publish(t.name, EventHostSetChanged, EventHostSet{
+			Name:  name,
+			Hosts: members,
+		})
+	}
+	if below && !wasBelow {
+		s.publish(t.name, EventHostSetBelowMinimum, size)
+	}
+	if changed {
+		// derived sets cannot reject violations, only report them
+		s.reportDiversity(t, name, members)
+	}
+	return members, nil
+}
+
+// WithRuleInterval causes the server to resolve the rules of every
+// rule-defined host set once per interval.
+func WithRuleInterval(interval time.Duration) ServerOption {
+	return func(s *server) {
+		s.ruleInterval = interval
+	}
+}
+
+func (s *server) runRules() {
+	for {
+		time.Sleep(s.ruleInterval)
+		type dynamicSet struct {
+			t    *tenant
+			name string
+		}
+		var sets []dynamicSet
+		s.mu.Lock()
+		for _, t := range s.tenants {
+			for name := range t.hostSetRules {
+				sets = append(sets, dynamicSet{t, name})
+			}
+		}
+		s.mu.Unlock()
+		for _, ds := range sets {
+			if _, err := s.refreshHostSet(ds.t, ds.name); err != nil && !errors.Is(err, ErrUnknownHostSet) {
+				log.Printf("WARN: could not resolve rules of host set %q: %v", ds.name, err)
+			}
+		}
+	}
+}
+
+func (s *server) handleHostSetRulesGET(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
+		return
+	}
+	s.mu.Lock()
+	rules, ok := t.hostSetRules[ps.ByName("name")]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, CodeUnknownHostSet, errors.New("That host set is not defined by rules"))
+		return
+	}
+	writeJSON(w, rules)
+}
+
+func (s *server) handleHostSetRulesPUT(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
+		return
+	}
+	var rules *HostSetRules
+	if err := json.NewDecoder(req.Body).Decode(&rules); err != nil {
+		writeError(w, CodeBadRequest, err)
+		return
+	} else if rules != nil {
+		if err := rules.validate(); err != nil {
+			writeError(w, CodeBadRequest, err)
+			return
+		}
+	}
+	name := ps.ByName("name")
+	s.mu.Lock()
+	if _, ok := t.hostSetExprs[name]; ok {
+		s.mu.Unlock()
+		writeError(w, CodeBadRequest, errComposed)
+		return
+	}
+	err := t.setHostSetRules(name, rules)
+	hosts := append([]hostdb.HostPublicKey{}, t.hostSets[name]...)
+	s.mu.Unlock()
+	if err != nil {
+		writeError(w, CodeInternal, err)
+		return
+	} else if rules == nil {
+		// the set keeps its current hosts as a static set
+		writeJSON(w, hosts)
+		return
+	}
+	members, err := s.refreshHostSet(t, name)
+	if err != nil {
+		writeError(w, CodeInternal, err)
+		return
+	}
+	writeJSON(w, members)
+}
+
+func (s *server) handleHostSetRefresh(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
+		return
+	}
+	members, err := s.refreshHostSet(t, ps.ByName("name"))
+	if errors.Is(err, ErrUnknownHostSet) {
+		writeError(w, CodeUnknownHostSet, errors.New("That host set is not defined by rules"))
+		return
+	} else if err != nil {
+		writeError(w, CodeInternal, err)
+		return
+	}
+	writeJSON(w, members)
+}
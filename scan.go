@@ -0,0 +1,169 @@
+package muse
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"lukechampine.com/us/hostdb"
+)
+
+const (
+	defaultScanConcurrency = 10
+	defaultScanTimeout     = 10 * time.Second
+	maxScanConcurrency     = 100
+	maxScanTimeout         = 2 * time.Minute
+)
+
+// scanHost resolves and scans a host, subject to the specified timeout, and
+// records the outcome of the scan. The new settings are compared against those
+// of the host's most recent scan, if any. If a recent scan of the host is
+// cached, it is returned instead, without recording it again.
+func (s *server) scanHost(hostKey hostdb.HostPublicKey, timeout time.Duration) ScanResult {
+	r := ScanResult{HostKey: hostKey}
+	hostAddr, err := s.resolveHostKey(hostKey)
+	if err != nil {
+		r.Error = &Error{Code: resolveErrorCode(err), Message: err.Error()}
+		return r
+	}
+	r.Address = hostAddr
+	if err := s.checkHost(hostKey, hostAddr); err != nil {
+		e := err.(Error)
+		r.Error = &e
+		return r
+	} else if cached, ok := s.cachedScan(hostKey); ok && cached.Address == hostAddr {
+		return cached
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	host, err := hostdb.Scan(ctx, hostAddr, hostKey)
+	r.LatencyMS = float64(time.Since(start)) / float64(time.Millisecond)
+	rec := ScanRecord{
+		Timestamp: start,
+		Address:   hostAddr,
+		Success:   err == nil,
+		LatencyMS: r.LatencyMS,
+	}
+	if err != nil {
+		r.Error = &Error{Code: hostErrorCode(err), Message: err.Error()}
+		rec.Error = err.Error()
+	} else {
+		r.Settings = &host.HostSettings
+		rec.Settings = r.Settings
+		if prev := s.recentSettings(hostKey); prev != nil {
+			r.Changes = settingsChanges(prev, r.Settings)
+		}
+	}
+	s.recordScan(hostKey, rec)
+	s.cacheScan(r)
+	return r
+}
+
+// publishSettingsChanges publishes an EventHostSettingsChanged event to the
+// tenant if the scan revealed any unfavorable changes.
+func (s *server) publishSettingsChanges(t *tenant, r ScanResult) {
+	if len(r.Changes) > 0 {
+		s.publish(t.name, EventHostSettingsChanged, EventHostSettings{
+			HostKey: r.HostKey,
+			Address: r.Address,
+			Changes: r.Changes,
+		})
+	}
+}
+
+func (s *server) handleScanBatch(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
+		return
+	}
+	var rs RequestScanBatch
+	if err := json.NewDecoder(req.Body).Decode(&rs); err != nil {
+		writeError(w, CodeBadRequest, err)
+		return
+	} else if (rs.HostSet == "") == (len(rs.HostKeys) == 0) {
+		writeError(w, CodeBadRequest, errors.New("exactly one of hostSet and hostKeys must be provided"))
+		return
+	} else if rs.Concurrency < 0 || rs.Concurrency > maxScanConcurrency {
+		writeError(w, CodeBadRequest, fmt.Errorf("concurrency must be between 0 and %v", maxScanConcurrency))
+		return
+	} else if rs.TimeoutMS < 0 || rs.TimeoutMS > maxScanTimeout.Milliseconds() {
+		writeError(w, CodeBadRequest, fmt.Errorf("timeout must be between 0 and %v ms", maxScanTimeout.Milliseconds()))
+		return
+	}
+	concurrency := rs.Concurrency
+	if concurrency == 0 {
+		concurrency = defaultScanConcurrency
+	}
+	timeout := time.Duration(rs.TimeoutMS) * time.Millisecond
+	if timeout == 0 {
+		timeout = defaultScanTimeout
+	}
+	hostKeys := rs.HostKeys
+	if rs.HostSet != "" {
+		s.mu.Lock()
+		ok := t.hasHostSet(rs.HostSet)
+		members, err := t.members(rs.HostSet)
+		s.mu.Unlock()
+		if !ok {
+			writeError(w, CodeUnknownHostSet, errors.New("No record of that host set"))
+			return
+		} else if err != nil {
+			writeError(w, CodeInternal, err)
+			return
+		}
+		hostKeys = members
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, CodeInternal, errors.New("streaming is not supported"))
+		return
+	}
+
+	// scan concurrently, writing each result as soon as it is available
+	results := make(chan ScanResult)
+	go func() {
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, concurrency)
+		for _, hostKey := range hostKeys {
+			select {
+			case sem <- struct{}{}:
+			case <-req.Context().Done():
+			}
+			if req.Context().Err() != nil {
+				break
+			}
+			wg.Add(1)
+			go func(hostKey hostdb.HostPublicKey) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				r := s.scanHost(hostKey, timeout)
+				s.publishSettingsChanges(t, r)
+				select {
+				case results <- r:
+				case <-req.Context().Done():
+				}
+			}(hostKey)
+		}
+		wg.Wait()
+		close(results)
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	enc := json.NewEncoder(w)
+	for r := range results {
+		if err := enc.Encode(r); err != nil {
+			// client disconnected; drain remaining results
+			continue
+		}
+		flusher.Flush()
+	}
+}
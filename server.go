@@ -4,12 +4,12 @@ import (
 	"context"
 	"crypto/ed25519"
 	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
-	"os"
 	"path/filepath"
 	"reflect"
 	"sort"
@@ -17,12 +17,15 @@ import (
 	"sync"
 	"time"
 
+	"github.com/julienschmidt/httprouter"
 	"go.sia.tech/siad/modules"
+	"go.sia.tech/siad/types"
 	"lukechampine.com/frand"
-	"lukechampine.com/shard"
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/renter"
 	"lukechampine.com/us/renter/proto"
+	"lukechampine.com/us/renterhost"
+	"lukechampine.com/us/wallet"
 )
 
 func writeJSON(w http.ResponseWriter, v interface{}) {
@@ -37,32 +40,203 @@ func writeJSON(w http.ResponseWriter, v interface{}) {
 	enc.Encode(v)
 }
 
+// writeError writes err as a JSON-encoded Error. If err is not already an
+// *Error, it is assigned the supplied code.
+func writeError(w http.ResponseWriter, code ErrorCode, err error) {
+	e, ok := err.(Error)
+	if !ok {
+		e = Error{Code: code, Message: err.Error()}
+	}
+	status := http.StatusInternalServerError
+	switch e.Code {
+	case CodeBadRequest, CodeUnknownHost, CodePriceGouging, CodeNotDiverse:
+		status = http.StatusBadRequest
+	case CodeUnauthorized:
+		status = http.StatusUnauthorized
+	case CodeBudgetExceeded, CodeHostBlocked:
+		status = http.StatusForbidden
+	case CodeHostSetConflict:
+		status = http.StatusPreconditionFailed
+	case CodeNotFound, CodeUnknownHostSet, CodeUnknownTenant:
+		status = http.StatusNotFound
+	case CodeMethodNotAllowed:
+		status = http.StatusMethodNotAllowed
+	case CodeNotSynced:
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// resolveErrorCode classifies an error returned by shardPool.ResolveHostKey.
+func resolveErrorCode(err error) ErrorCode {
+	if errors.As(err, new(*url.Error)) || errors.Is(err, errShardDisagreement) {
+		// the shard servers are unreachable or unreliable
+		return CodeInternal
+	}
+	return CodeUnknownHost
+}
+
+// hostErrorCode classifies an error encountered while communicating with a
+// host.
+func hostErrorCode(err error) ErrorCode {
+	switch {
+	case errors.As(err, new(*url.Error)):
+		// wallet or tpool server is unreachable
+		return CodeInternal
+	case errors.As(err, new(*renterhost.RPCError)):
+		return CodeHostRejected
+	case errors.As(err, new(net.Error)), errors.Is(err, context.DeadlineExceeded):
+		return CodeHostUnreachable
+	case strings.Contains(err.Error(), wallet.ErrInsufficientFunds.Error()):
+		// walrus returns wallet errors as plain strings, so we can't use
+		// errors.Is here
+		return CodeInsufficientFunds
+	default:
+		return CodeInternal
+	}
+}
+
 type server struct {
-	hostSets map[string][]hostdb.HostPublicKey
-	dir      string
-
-	wallet proto.Wallet
-	tpool  proto.TransactionPool
-	shard  *shard.Client
-	mu     sync.Mutex
-	utxoMu sync.Mutex // separate mutex for utxos, preventing reuse
+	tenants map[string]*tenant
+	store   Store
+	access  accessLists
+
+	wallet   proto.Wallet
+	tpool    proto.TransactionPool
+	shard    *shardPool
+	mu       sync.Mutex
+	utxoMu   sync.Mutex // separate mutex for utxos, preventing reuse
+	events   eventBroker
+	webhooks *webhookManager
+	monitor  *monitor
+
+	hostMonitor  *hostMonitor
+	cache        *hostCache
+	ruleInterval time.Duration
+	extraShards  []Shard
+	limits       func() ContractLimits
+	shardQuorum  int
+	adminToken   string // hashed
+
+	tenantConfigs <-chan map[string]TenantConfig
+}
+
+// publish publishes an event concerning the named tenant to event stream
+// subscribers and webhooks.
+func (s *server) publish(tenant string, typ EventType, data interface{}) {
+	s.webhooks.enqueue(s.events.publish(tenant, typ, data))
+}
+
+// maxStartHeightDrift is the maximum difference between the start height of a
+// contract being formed or renewed and the current chain height.
+const maxStartHeightDrift = 10
+
+// checkChain returns a not_synced error if the shard server is not synced (or
+// cannot be reached), or a bad_request error if startHeight is too far from the
+// current chain height.
+func (s *server) checkChain(startHeight types.BlockHeight) error {
+	synced, err := s.shard.Synced()
+	if err != nil {
+		return Error{Code: CodeNotSynced, Message: fmt.Sprintf("could not check whether shard server is synced: %v", err)}
+	} else if !synced {
+		return Error{Code: CodeNotSynced, Message: "shard server is not synced"}
+	}
+	height, err := s.shard.ChainHeight()
+	if err != nil {
+		return Error{Code: CodeNotSynced, Message: fmt.Sprintf("could not get current height: %v", err)}
+	} else if startHeight+maxStartHeightDrift < height || startHeight > height+maxStartHeightDrift {
+		return Error{
+			Code:    CodeBadRequest,
+			Message: fmt.Sprintf("start height %v is too far from current height %v", startHeight, height),
+		}
+	}
+	return nil
+}
+
+// ContractLimits restrict the contracts that the server will form or renew.
+// Prices are in the same units as the corresponding host settings. Zero values
+// impose no limit.
+type ContractLimits struct {
+	MaxStoragePrice  types.Currency
+	MaxUploadPrice   types.Currency
+	MaxDownloadPrice types.Currency
+	MaxContractPrice types.Currency
+	MaxDuration      types.BlockHeight
+}
+
+// checkLimits returns a price_gouging error if the host's prices exceed the
+// server's limits, or a bad_request error if the contract is too long.
+func (s *server) checkLimits(settings hostdb.HostSettings, startHeight, endHeight types.BlockHeight) error {
+	if s.limits == nil {
+		return nil
+	}
+	l := s.limits()
+	if l.MaxDuration > 0 && endHeight > startHeight+l.MaxDuration {
+		return Error{
+			Code:    CodeBadRequest,
+			Message: fmt.Sprintf("contract duration %v exceeds limit of %v blocks", endHeight-startHeight, l.MaxDuration),
+		}
+	}
+	for _, p := range []struct {
+		name         string
+		price, limit types.Currency
+	}{
+		{"storage", settings.StoragePrice, l.MaxStoragePrice},
+		{"upload", settings.UploadBandwidthPrice, l.MaxUploadPrice},
+		{"download", settings.DownloadBandwidthPrice, l.MaxDownloadPrice},
+		{"contract", settings.ContractPrice, l.MaxContractPrice},
+	} {
+		if !p.limit.IsZero() && p.price.Cmp(p.limit) > 0 {
+			return Error{
+				Code:    CodePriceGouging,
+				Message: fmt.Sprintf("host's %v price (%v H) exceeds limit of %v H", p.name, p.price, p.limit),
+			}
+		}
+	}
+	return nil
 }
 
-func (s *server) handleForm(w http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodPost {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+func (s *server) handleForm(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
 		return
 	}
 	var rf RequestForm
 	if err := json.NewDecoder(req.Body).Decode(&rf); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, CodeBadRequest, err)
+		return
+	}
+	if err := s.reserveFunds(t, rf.Funds); err != nil {
+		writeError(w, CodeInternal, err)
 		return
 	}
 	start := time.Now()
+	err := s.checkLimits(rf.Settings, rf.StartHeight, rf.EndHeight)
+	if err == nil {
+		err = s.checkChain(rf.StartHeight)
+	}
+	if err != nil {
+		if err := s.releaseFunds(t, rf.Funds); err != nil {
+			log.Println("WARN: could not release tenant funds:", err)
+		}
+		writeError(w, CodeBadRequest, err)
+		return
+	}
 	log.Println("resolving a host key:", rf.HostKey)
-	hostAddr, err := s.shard.ResolveHostKey(rf.HostKey)
+	hostAddr, err := s.resolveHostKey(rf.HostKey)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		if err := s.releaseFunds(t, rf.Funds); err != nil {
+			log.Println("WARN: could not release tenant funds:", err)
+		}
+		writeError(w, resolveErrorCode(err), err)
+		return
+	} else if err := s.checkHost(rf.HostKey, hostAddr); err != nil {
+		if err := s.releaseFunds(t, rf.Funds); err != nil {
+			log.Println("WARN: could not release tenant funds:", err)
+		}
+		writeError(w, CodeHostBlocked, err)
 		return
 	}
 	rf.Settings.NetAddress = hostAddr
@@ -78,7 +252,10 @@ func (s *server) handleForm(w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		log.Println("release utxoMu:", rf.HostKey, time.Since(start))
 		s.utxoMu.Unlock()
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := s.releaseFunds(t, rf.Funds); err != nil {
+			log.Println("WARN: could not release tenant funds:", err)
+		}
+		writeError(w, hostErrorCode(err), err)
 		return
 	}
 
@@ -96,6 +273,11 @@ func (s *server) handleForm(w http.ResponseWriter, req *http.Request) {
 	s.utxoMu.Unlock()
 	if submitErr != nil && submitErr != modules.ErrDuplicateTransactionSet {
 		log.Println("WARN: contract transaction was not accepted", submitErr)
+		s.publish(t.name, EventTpoolRejected, EventContractError{
+			HostKey:    rev.HostKey(),
+			ContractID: rev.ID(),
+			Error:      submitErr.Error(),
+		})
 	}
 
 	c := Contract{
@@ -107,26 +289,59 @@ func (s *server) handleForm(w http.ResponseWriter, req *http.Request) {
 		HostAddress: host.NetAddress,
 		EndHeight:   rf.EndHeight,
 	}
+	if err := s.trackContract(t, c, types.FileContractID{}); err != nil {
+		log.Println("WARN: could not save contract record:", err)
+	}
 	writeJSON(w, c)
+	s.publish(t.name, EventContractFormed, EventContract{
+		HostKey:     c.HostKey,
+		ID:          c.ID,
+		HostAddress: c.HostAddress,
+		EndHeight:   c.EndHeight,
+	})
 	log.Println("forming a contract finishes:", rf.HostKey, time.Since(start))
 }
 
-func (s *server) handleRenew(w http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodPost {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+func (s *server) handleRenew(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
 		return
 	}
 	var rf RequestRenew
 	if err := json.NewDecoder(req.Body).Decode(&rf); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, CodeBadRequest, err)
+		return
+	}
+	if err := s.reserveFunds(t, rf.Funds); err != nil {
+		writeError(w, CodeInternal, err)
 		return
 	}
 
 	start := time.Now()
+	err := s.checkLimits(rf.Settings, rf.StartHeight, rf.EndHeight)
+	if err == nil {
+		err = s.checkChain(rf.StartHeight)
+	}
+	if err != nil {
+		if err := s.releaseFunds(t, rf.Funds); err != nil {
+			log.Println("WARN: could not release tenant funds:", err)
+		}
+		writeError(w, CodeBadRequest, err)
+		return
+	}
 	log.Println("resolving a host key:", rf.HostKey)
-	hostAddr, err := s.shard.ResolveHostKey(rf.HostKey)
+	hostAddr, err := s.resolveHostKey(rf.HostKey)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		if err := s.releaseFunds(t, rf.Funds); err != nil {
+			log.Println("WARN: could not release tenant funds:", err)
+		}
+		writeError(w, resolveErrorCode(err), err)
+		return
+	} else if err := s.checkHost(rf.HostKey, hostAddr); err != nil {
+		if err := s.releaseFunds(t, rf.Funds); err != nil {
+			log.Println("WARN: could not release tenant funds:", err)
+		}
+		writeError(w, CodeHostBlocked, err)
 		return
 	}
 	rf.Settings.NetAddress = hostAddr
@@ -141,7 +356,15 @@ func (s *server) handleRenew(w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		log.Println("release utxoMu:", rf.HostKey, time.Since(start))
 		s.utxoMu.Unlock()
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := s.releaseFunds(t, rf.Funds); err != nil {
+			log.Println("WARN: could not release tenant funds:", err)
+		}
+		writeError(w, hostErrorCode(err), err)
+		s.publish(t.name, EventContractRenewFailed, EventContractError{
+			HostKey:    rf.HostKey,
+			ContractID: rf.ID,
+			Error:      err.Error(),
+		})
 		return
 	}
 
@@ -151,6 +374,11 @@ func (s *server) handleRenew(w http.ResponseWriter, req *http.Request) {
 	s.utxoMu.Unlock()
 	if submitErr != nil && submitErr != modules.ErrDuplicateTransactionSet {
 		log.Println("WARN: contract transaction was not accepted", submitErr)
+		s.publish(t.name, EventTpoolRejected, EventContractError{
+			HostKey:    rev.HostKey(),
+			ContractID: rev.ID(),
+			Error:      submitErr.Error(),
+		})
 	}
 
 	c := Contract{
@@ -162,138 +390,302 @@ func (s *server) handleRenew(w http.ResponseWriter, req *http.Request) {
 		HostAddress: rf.Settings.NetAddress,
 		EndHeight:   rf.EndHeight,
 	}
+	if err := s.trackContract(t, c, rf.ID); err != nil {
+		log.Println("WARN: could not save contract record:", err)
+	}
 	writeJSON(w, c)
+	s.publish(t.name, EventContractRenewed, EventContract{
+		HostKey:     c.HostKey,
+		ID:          c.ID,
+		RenewedFrom: rf.ID,
+		HostAddress: c.HostAddress,
+		EndHeight:   c.EndHeight,
+	})
 	log.Println("renewing a contract finishes:", rf.HostKey, time.Since(start))
 }
 
-func (s *server) handleHostSets(w http.ResponseWriter, req *http.Request) {
-	setName := strings.TrimPrefix(req.URL.Path, "/hostsets/")
-	if strings.Contains(setName, "/") {
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+// handleContracts lists the tenant's contracts. If the "hostset" query
+// parameter names a host set, only contracts with its hosts are listed.
+func (s *server) handleContracts(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
 		return
 	}
-
-	switch req.Method {
-	case http.MethodGet:
-		if setName == "" {
-			s.mu.Lock()
-			setNames := make([]string, 0, len(s.hostSets))
-			for name := range s.hostSets {
-				setNames = append(setNames, name)
-			}
-			s.mu.Unlock()
-			sort.Strings(setNames)
-			writeJSON(w, setNames)
-		} else {
-			if setName == "" {
-				http.Error(w, "No host set name provided", http.StatusBadRequest)
-				return
-			}
-			s.mu.Lock()
-			set, ok := s.hostSets[setName]
-			hostKeys := append([]hostdb.HostPublicKey(nil), set...)
+	s.mu.Lock()
+	var inSet map[hostdb.HostPublicKey]bool
+	if name := req.FormValue("hostset"); name != "" {
+		if !t.hasHostSet(name) {
 			s.mu.Unlock()
-			if !ok {
-				http.Error(w, "No record of that host set", http.StatusBadRequest)
-				return
-			}
-			writeJSON(w, hostKeys)
-		}
-
-	case http.MethodPut:
-		if setName == "" {
-			http.Error(w, "No host set name provided", http.StatusBadRequest)
+			writeError(w, CodeUnknownHostSet, errors.New("No record of that host set"))
 			return
 		}
-
-		var hostKeys []hostdb.HostPublicKey
-		if err := json.NewDecoder(req.Body).Decode(&hostKeys); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		hosts, err := t.members(name)
+		if err != nil {
+			s.mu.Unlock()
+			writeError(w, CodeInternal, err)
 			return
 		}
-		sort.Slice(hostKeys, func(i, j int) bool {
-			return hostKeys[i] < hostKeys[j]
-		})
-		s.mu.Lock()
-		s.hostSets[setName] = hostKeys
-		if len(hostKeys) == 0 {
-			delete(s.hostSets, setName)
+		inSet = make(map[hostdb.HostPublicKey]bool, len(hosts))
+		for _, h := range hosts {
+			inSet[h] = true
 		}
-		hostSetsJSON, _ := json.MarshalIndent(s.hostSets, "", "  ")
-		s.mu.Unlock()
-		err := ioutil.WriteFile(filepath.Join(s.dir, "hostSets.json"), hostSetsJSON, 0660)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	}
+	cs := make([]Contract, 0, len(t.contracts))
+	for _, r := range t.contracts {
+		if inSet == nil || inSet[r.HostKey] {
+			cs = append(cs, Contract{
+				Contract: renter.Contract{
+					HostKey:   r.HostKey,
+					ID:        r.ID,
+					RenterKey: r.RenterKey,
+				},
+				HostAddress: r.HostAddress,
+				EndHeight:   r.EndHeight,
+			})
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].EndHeight != cs[j].EndHeight {
+			return cs[i].EndHeight < cs[j].EndHeight
 		}
+		return cs[i].ID.String() < cs[j].ID.String()
+	})
+	writeJSON(w, cs)
+}
 
-	default:
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+func (s *server) handleContractDelete(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
+		return
+	}
+	var id types.FileContractID
+	if err := id.LoadString(ps.ByName("id")); err != nil {
+		writeError(w, CodeBadRequest, fmt.Errorf("invalid contract ID: %w", err))
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := t.contracts[id]; !ok {
+		writeError(w, CodeNotFound, errors.New("No record of that contract"))
+	} else if err := t.deleteContract(id); err != nil {
+		writeError(w, CodeInternal, err)
 	}
 }
 
-func (s *server) handleScan(w http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodPost {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+func (s *server) handleScan(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
 		return
 	}
 	var rs RequestScan
 	if err := json.NewDecoder(req.Body).Decode(&rs); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, CodeBadRequest, err)
 		return
 	}
-	hostAddr, err := s.shard.ResolveHostKey(rs.HostKey)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	r := s.scanHost(rs.HostKey, defaultScanTimeout)
+	if r.Error != nil {
+		writeError(w, r.Error.Code, r.Error)
 		return
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	host, err := hostdb.Scan(ctx, hostAddr, rs.HostKey)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	writeJSON(w, ResponseScan{
+		HostSettings: *r.Settings,
+		Changes:      r.Changes,
+	})
+	s.publishSettingsChanges(t, r)
+}
+
+func handleOpenAPI(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// A route is an API endpoint. Paths are relative to apiPrefix.
+type route struct {
+	method  string
+	path    string
+	handler httprouter.Handle
+}
+
+func (s *server) routes() []route {
+	// tenant-scoped routes are also served under /tenants/:tenant; the
+	// unprefixed routes operate on the default tenant
+	tenantRoutes := []route{
+		{http.MethodPost, "/form", s.handleForm},
+		{http.MethodPost, "/renew", s.handleRenew},
+		{http.MethodGet, "/contracts", s.handleContracts},
+		{http.MethodDelete, "/contracts/:id", s.handleContractDelete},
+		{http.MethodPost, "/scan", s.handleScan},
+		{http.MethodPost, "/scan/batch", s.handleScanBatch},
+		{http.MethodGet, "/hostsets", s.handleHostSets},
+		{http.MethodGet, "/hostsets/:name", s.handleHostSetGET},
+		{http.MethodPut, "/hostsets/:name", s.handleHostSetPUT},
+		{http.MethodPost, "/hostsets/:name/add", s.handleHostSetEdit(true)},
+		{http.MethodPost, "/hostsets/:name/remove", s.handleHostSetEdit(false)},
+		{http.MethodGet, "/hostsets/:name/history", s.handleHostSetHistory},
+		{http.MethodPost, "/hostsets/:name/rollback", s.handleHostSetRollback},
+		{http.MethodGet, "/hostsets/:name/metadata", s.handleHostSetMetadataGET},
+		{http.MethodPut, "/hostsets/:name/metadata", s.handleHostSetMetadataPUT},
+		{http.MethodGet, "/hostsets/:name/rules", s.handleHostSetRulesGET},
+		{http.MethodPut, "/hostsets/:name/rules", s.handleHostSetRulesPUT},
+		{http.MethodPost, "/hostsets/:name/refresh", s.handleHostSetRefresh},
+		{http.MethodGet, "/hostsets/:name/compose", s.handleHostSetComposeGET},
+		{http.MethodPut, "/hostsets/:name/compose", s.handleHostSetComposePUT},
+		{http.MethodGet, "/hostsets/:name/diversity", s.handleHostSetDiversity},
+		{http.MethodGet, "/events", s.handleEvents},
+		{http.MethodGet, "/webhooks", s.handleWebhooks},
+		{http.MethodPost, "/webhooks", s.handleWebhookAdd},
+		{http.MethodDelete, "/webhooks/:id", s.handleWebhookDelete},
+	}
+	// the remaining routes are server-wide, and require the admin token
+	routes := []route{
+		{http.MethodGet, "/tenants", s.admin(s.handleTenants)},
+		{http.MethodGet, "/tenants/:tenant", s.handleTenantGET},
+		{http.MethodPut, "/tenants/:tenant", s.admin(s.handleTenantPUT)},
+		{http.MethodGet, "/hosts/:key", s.admin(s.handleHost)},
+		{http.MethodGet, "/blocklist", s.admin(s.handleAccessListGET(true))},
+		{http.MethodPut, "/blocklist", s.admin(s.handleAccessListPUT(true))},
+		{http.MethodGet, "/allowlist", s.admin(s.handleAccessListGET(false))},
+		{http.MethodPut, "/allowlist", s.admin(s.handleAccessListPUT(false))},
+		{http.MethodGet, "/metrics", s.admin(s.handleMetrics)},
+		{http.MethodGet, "/openapi.json", handleOpenAPI},
+	}
+	for _, r := range tenantRoutes {
+		routes = append(routes, r, route{r.method, "/tenants/:tenant" + r.path, r.handler})
+	}
+	return routes
+}
+
+// A ServerOption configures optional server behavior.
+type ServerOption func(*server)
+
+// WithMonitor enables a background monitor that checks, every interval,
+// whether the shard server is synced and whether any contract formed or
+// renewed by the server is within expiryWindow blocks of its end height,
+// publishing EventShardUnsynced and EventContractExpiring events accordingly.
+func WithMonitor(interval time.Duration, expiryWindow types.BlockHeight) ServerOption {
+	return func(s *server) {
+		if s.monitor == nil {
+			s.monitor = new(monitor)
+		}
+		s.monitor.interval = interval
+		s.monitor.expiryWindow = expiryWindow
+	}
+}
+
+// WithBalanceAlert causes the monitor to publish an EventWalletLow event when
+// the wallet balance, as reported by balance, falls below min. It has no
+// effect unless WithMonitor is also supplied.
+func WithBalanceAlert(balance func() (types.Currency, error), min types.Currency) ServerOption {
+	return func(s *server) {
+		if s.monitor == nil {
+			s.monitor = new(monitor)
+		}
+		s.monitor.balance = balance
+		s.monitor.minBalance = min
 	}
-	writeJSON(w, host.HostSettings)
 }
 
-// NewServer returns an HTTP handler that serves the muse API.
-func NewServer(dir string, wallet proto.Wallet, tpool proto.TransactionPool, shardAddr string) (http.Handler, error) {
+// WithContractLimits causes the server to refuse to form or renew contracts
+// that exceed the limits returned by limits, which is called for each request.
+func WithContractLimits(limits func() ContractLimits) ServerOption {
+	return func(s *server) {
+		s.limits = limits
+	}
+}
+
+// WithShards configures additional shards, which are used along with the shard
+// passed to NewServer. If quorum is at most 1, requests are sent to
+// the first server that has not recently failed, failing over to the others if
+// it is unreachable or not synced. Otherwise, requests are sent to every
+// server, and an answer is only accepted if at least quorum servers return it.
+func WithShards(shards []Shard, quorum int) ServerOption {
+	return func(s *server) {
+		s.extraShards = shards
+		s.shardQuorum = quorum
+	}
+}
+
+// WithAdminToken requires requests to the server-wide routes and the default
+// tenant's routes to carry token as a bearer token. The admin token also grants
+// access to the routes of every other tenant. Without an admin token, tenants
+// cannot be configured via the API.
+func WithAdminToken(token string) ServerOption {
+	return func(s *server) {
+		s.adminToken = hashToken(token)
+	}
+}
+
+// WithStore causes the server to persist its state in store, rather than in a
+// database within its directory.
+func WithStore(store Store) ServerOption {
+	return func(s *server) {
+		s.store = store
+	}
+}
+
+// NewServer returns an HTTP handler that serves the muse API, using sh to
+// resolve host keys and track the chain.
+func NewServer(dir string, wallet proto.Wallet, tpool proto.TransactionPool, sh Shard, opts ...ServerOption) (http.Handler, error) {
 	srv := &server{
 		wallet: wallet,
 		tpool:  tpool,
-		shard:  shard.NewClient(shardAddr),
-		dir:    dir,
+	}
+	for _, opt := range opts {
+		opt(srv)
 	}
 
-	// load host sets
-	hostSetsJSON, err := ioutil.ReadFile(filepath.Join(dir, "hostSets.json"))
-	if os.IsNotExist(err) {
-		srv.hostSets = make(map[string][]hostdb.HostPublicKey)
-	} else {
+	var err error
+	srv.shard, err = newShardPool(append([]Shard{sh}, srv.extraShards...), srv.shardQuorum)
+	if err != nil {
+		return nil, err
+	}
+	if srv.store == nil {
+		srv.store, err = OpenBoltStore(filepath.Join(dir, "muse.db"))
 		if err != nil {
 			return nil, err
-		}
-		if err := json.Unmarshal(hostSetsJSON, &srv.hostSets); err != nil {
-			return nil, err
+		} else if err := migrateJSON(dir, srv.store); err != nil {
+			return nil, fmt.Errorf("could not migrate JSON state: %w", err)
 		}
 	}
-
-	mux := http.NewServeMux()
-	mux.HandleFunc("/form", srv.handleForm)
-	mux.HandleFunc("/renew", srv.handleRenew)
-	mux.HandleFunc("/hostsets/", srv.handleHostSets)
-	mux.HandleFunc("/scan", srv.handleScan)
-
-	// shard proxy
-	shardURL, err := url.Parse(shardAddr)
+	srv.tenants, err = loadTenants(srv.store)
+	if err != nil {
+		return nil, err
+	}
+	srv.access, err = loadAccessLists(srv.store)
+	if err != nil {
+		return nil, err
+	}
+	srv.webhooks, err = newWebhookManager(srv.store)
 	if err != nil {
 		return nil, err
 	}
-	mux.Handle("/shard/", &httputil.ReverseProxy{Director: func(req *http.Request) {
-		req.URL.Scheme = shardURL.Scheme
-		req.URL.Host = shardURL.Host
-		req.URL.Path = strings.TrimPrefix(req.URL.Path, "/shard")
-	}})
+	go srv.webhooks.run()
+	if srv.monitor != nil && srv.monitor.interval > 0 {
+		go srv.runMonitor()
+	}
+	if srv.ruleInterval > 0 {
+		go srv.runRules()
+	}
+	if srv.hostMonitor != nil && srv.hostMonitor.interval > 0 {
+		go srv.runHostMonitor()
+	}
+	if srv.tenantConfigs != nil {
+		go srv.runTenantConfigs()
+	}
+
+	mux := httprouter.New()
+	mux.NotFound = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeError(w, CodeNotFound, errors.New(http.StatusText(http.StatusNotFound)))
+	})
+	mux.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeError(w, CodeMethodNotAllowed, errors.New(http.StatusText(http.StatusMethodNotAllowed)))
+	})
+	for _, r := range srv.routes() {
+		mux.Handle(r.method, apiPrefix+r.path, r.handler)
+	}
+
+	// shard proxy
+	mux.Handler(http.MethodGet, apiPrefix+"/shard/*path", srv.cachingShardProxy(srv.shard.proxy()))
 	return mux, nil
 }
@@ -0,0 +1,365 @@
+package muse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/encoding"
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/siad/modules"
+	"go.sia.tech/siad/types"
+	"lukechampine.com/shard"
+	"lukechampine.com/us/ed25519hash"
+	"lukechampine.com/us/hostdb"
+)
+
+// A Shard is a source of chain and host announcement data, typically a shard
+// server. If a Shard also implements http.Handler, it is used to serve the
+// shard API under /shard.
+type Shard interface {
+	ChainHeight() (types.BlockHeight, error)
+	Synced() (bool, error)
+	ResolveHostKey(hostKey hostdb.HostPublicKey) (modules.NetAddress, error)
+}
+
+// A remoteShard is a Shard backed by a shard server reached over HTTP.
+type remoteShard struct {
+	*shard.Client
+	addr  string
+	proxy *httputil.ReverseProxy
+}
+
+func (rs *remoteShard) String() string { return rs.addr }
+
+// ServeHTTP implements http.Handler by proxying requests to the shard server.
+func (rs *remoteShard) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rs.proxy.ServeHTTP(w, req)
+}
+
+// RemoteShard returns a Shard that communicates with the shard server at addr.
+func RemoteShard(addr string) Shard {
+	u, err := url.Parse(addr)
+	if err != nil {
+		// every request will fail, causing the server to be treated as down
+		u = new(url.URL)
+	}
+	return &remoteShard{
+		Client: shard.NewClient(addr),
+		addr:   addr,
+		proxy: &httputil.ReverseProxy{
+			Director: func(req *http.Request) {
+				req.URL.Scheme = u.Scheme
+				req.URL.Host = u.Host
+			},
+			ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+				if sr, ok := w.(*shardResponse); ok {
+					// let the shardPool fail over to another server
+					sr.err = err
+					return
+				}
+				w.WriteHeader(http.StatusBadGateway)
+			},
+		},
+	}
+}
+
+// A localShard is a Shard backed by an in-process shard.Relay.
+type localShard struct {
+	relay *shard.Relay
+	http.Handler
+}
+
+func (ls *localShard) String() string { return "local" }
+
+// ChainHeight implements Shard.
+func (ls *localShard) ChainHeight() (types.BlockHeight, error) {
+	return ls.relay.Height(), nil
+}
+
+// Synced implements Shard.
+func (ls *localShard) Synced() (bool, error) {
+	return ls.relay.Synced(), nil
+}
+
+// ResolveHostKey implements Shard.
+func (ls *localShard) ResolveHostKey(hostKey hostdb.HostPublicKey) (modules.NetAddress, error) {
+	b, ok := ls.relay.HostAnnouncement(hostKey)
+	if !ok {
+		return "", errors.New("no record of that host")
+	}
+	var ha modules.HostAnnouncement
+	var sig crypto.Signature
+	if err := encoding.NewDecoder(bytes.NewReader(b), encoding.DefaultAllocLimit).DecodeAll(&ha, &sig); err != nil {
+		return "", err
+	} else if !ed25519hash.Verify(hostKey.Ed25519(), crypto.HashObject(ha), sig[:]) {
+		return "", errors.New("invalid signature")
+	}
+	return ha.NetAddress, nil
+}
+
+// LocalShard returns a Shard that uses r directly, without running a shard
+// server.
+func LocalShard(r *shard.Relay) Shard {
+	return &localShard{
+		relay:   r,
+		Handler: shard.NewServer(r),
+	}
+}
+
+// shardRetryInterval is how long a shard server is avoided after it fails.
+const shardRetryInterval = 30 * time.Second
+
+// errShardDisagreement is returned when too few shard servers agree on an
+// answer.
+var errShardDisagreement = errors.New("shard servers disagree")
+
+// A shardBackend is one of the shard servers in a shardPool.
+type shardBackend struct {
+	shard Shard
+	down  time.Time // when the server last failed
+}
+
+// A shardPool distributes requests among one or more shard servers. If quorum
+// is at most 1, each request is sent to the first healthy server, failing over
+// to the next if it is unreachable; otherwise, each request is sent to every
+// server, and at least quorum of them must return the same answer.
+type shardPool struct {
+	backends []*shardBackend
+	quorum   int
+
+	mu sync.Mutex // protects the down field of each backend
+}
+
+// newShardPool returns a shardPool for the provided shards.
+func newShardPool(shards []Shard, quorum int) (*shardPool, error) {
+	if quorum > len(shards) {
+		return nil, fmt.Errorf("shard quorum (%v) exceeds number of shard servers (%v)", quorum, len(shards))
+	}
+	p := &shardPool{quorum: quorum}
+	for _, s := range shards {
+		if s == nil {
+			return nil, errors.New("nil shard")
+		}
+		p.backends = append(p.backends, &shardBackend{shard: s})
+	}
+	return p, nil
+}
+
+// healthy returns the backends, ordered such that those that have not failed
+// within the last shardRetryInterval come first.
+func (p *shardPool) healthy() []*shardBackend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var up, down []*shardBackend
+	for _, b := range p.backends {
+		if time.Since(b.down) < shardRetryInterval {
+			down = append(down, b)
+		} else {
+			up = append(up, b)
+		}
+	}
+	return append(up, down...)
+}
+
+// setDown records whether a backend has failed, logging any change.
+func (p *shardPool) setDown(b *shardBackend, reason error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	wasDown := !b.down.IsZero()
+	if reason != nil {
+		b.down = time.Now()
+		if !wasDown && len(p.backends) > 1 {
+			log.Printf("WARN: shard server %v failed: %v", b.shard, reason)
+		}
+	} else {
+		b.down = time.Time{}
+		if wasDown && len(p.backends) > 1 {
+			log.Printf("shard server %v recovered", b.shard)
+		}
+	}
+}
+
+// isShardFailure reports whether err indicates that a shard server could not
+// be reached, as opposed to e.g. having no record of a host.
+func isShardFailure(err error) bool {
+	return errors.As(err, new(*url.Error))
+}
+
+// failover calls fn with each backend in turn, healthy backends first, until
+// fn does not fail.
+func (p *shardPool) failover(fn func(Shard) error) (err error) {
+	for _, b := range p.healthy() {
+		if err = fn(b.shard); !isShardFailure(err) {
+			p.setDown(b, nil)
+			return err
+		}
+		p.setDown(b, err)
+	}
+	return err
+}
+
+// agree calls fn with every backend concurrently and returns the answer, or
+// error, returned by at least quorum of them.
+func (p *shardPool) agree(fn func(Shard) (interface{}, error)) (interface{}, error) {
+	type answer struct {
+		v   interface{}
+		err string
+	}
+	answers := make([]answer, len(p.backends))
+	errs := make([]error, len(p.backends))
+	var wg sync.WaitGroup
+	for i, b := range p.backends {
+		wg.Add(1)
+		go func(i int, b *shardBackend) {
+			defer wg.Done()
+			v, err := fn(b.shard)
+			if isShardFailure(err) {
+				p.setDown(b, err)
+			} else {
+				p.setDown(b, nil)
+			}
+			answers[i] = answer{v: v}
+			if err != nil {
+				answers[i].err = err.Error()
+			}
+			errs[i] = err
+		}(i, b)
+	}
+	wg.Wait()
+
+	counts := make(map[answer]int)
+	var responded int
+	var failure error
+	for i, a := range answers {
+		if isShardFailure(errs[i]) {
+			failure = errs[i]
+			continue
+		}
+		responded++
+		if counts[a]++; counts[a] >= p.quorum {
+			return a.v, errs[i]
+		}
+	}
+	if responded < p.quorum {
+		return nil, fmt.Errorf("only %v of %v shard servers responded: %w", responded, len(p.backends), failure)
+	}
+	return nil, fmt.Errorf("%w: no answer was returned by %v of %v servers", errShardDisagreement, p.quorum, len(p.backends))
+}
+
+// ChainHeight returns the current block height.
+func (p *shardPool) ChainHeight() (height types.BlockHeight, err error) {
+	if p.quorum > 1 {
+		v, err := p.agree(func(c Shard) (interface{}, error) { return c.ChainHeight() })
+		if err != nil {
+			return 0, err
+		}
+		return v.(types.BlockHeight), nil
+	}
+	err = p.failover(func(c Shard) (err error) {
+		height, err = c.ChainHeight()
+		return
+	})
+	return
+}
+
+// Synced returns whether the shard servers are synced. When failing over, a
+// server that is not synced is treated as having failed.
+func (p *shardPool) Synced() (synced bool, err error) {
+	if p.quorum > 1 {
+		v, err := p.agree(func(c Shard) (interface{}, error) { return c.Synced() })
+		if err != nil {
+			return false, err
+		}
+		return v.(bool), nil
+	}
+	for _, b := range p.healthy() {
+		synced, err = b.shard.Synced()
+		if err == nil && synced {
+			p.setDown(b, nil)
+			return true, nil
+		} else if err == nil {
+			p.setDown(b, errors.New("not synced"))
+		} else {
+			p.setDown(b, err)
+		}
+	}
+	return synced, err
+}
+
+// ResolveHostKey resolves a host public key to that host's most recently
+// announced network address.
+func (p *shardPool) ResolveHostKey(hostKey hostdb.HostPublicKey) (addr modules.NetAddress, err error) {
+	if p.quorum > 1 {
+		v, err := p.agree(func(c Shard) (interface{}, error) { return c.ResolveHostKey(hostKey) })
+		if err != nil {
+			return "", err
+		}
+		return v.(modules.NetAddress), nil
+	}
+	err = p.failover(func(c Shard) (err error) {
+		addr, err = c.ResolveHostKey(hostKey)
+		return
+	})
+	return
+}
+
+// A shardResponse buffers a response from a shard server's API, recording
+// whether the server could be reached at all.
+type shardResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	err    error // set if the server could not be reached
+}
+
+func (sr *shardResponse) Header() http.Header { return sr.header }
+
+func (sr *shardResponse) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+}
+
+func (sr *shardResponse) Write(p []byte) (int, error) {
+	sr.WriteHeader(http.StatusOK)
+	return sr.body.Write(p)
+}
+
+// proxy returns a handler that serves the shard API using the first healthy
+// shard that implements http.Handler. Each response is buffered, so that if a
+// shard server cannot be reached, it is avoided by subsequent requests and the
+// request is retried on the next one.
+func (p *shardPool) proxy() http.Handler {
+	return http.StripPrefix(apiPrefix+"/shard", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, b := range p.healthy() {
+			h, ok := b.shard.(http.Handler)
+			if !ok {
+				continue
+			}
+			sr := &shardResponse{header: make(http.Header)}
+			h.ServeHTTP(sr, req)
+			if sr.err != nil {
+				p.setDown(b, sr.err)
+				continue
+			}
+			p.setDown(b, nil)
+			if sr.status == 0 {
+				sr.status = http.StatusOK
+			}
+			for k, v := range sr.header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(sr.status)
+			w.Write(sr.body.Bytes())
+			return
+		}
+		writeError(w, CodeNotSynced, errors.New("shard API is not available"))
+	}))
+}
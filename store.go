@@ -0,0 +1,250 @@
+package muse
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// A Store persists the server's state as JSON values, grouped into buckets and
+// identified by non-empty keys. All reads and writes happen within a
+// transaction.
+type Store interface {
+	// View calls fn within a read-only transaction.
+	View(fn func(tx StoreTx) error) error
+	// Update calls fn within a read-write transaction. If fn returns an
+	// error, none of its writes are applied.
+	Update(fn func(tx StoreTx) error) error
+	// Close closes the Store.
+	Close() error
+}
+
+// A StoreTx is a Store transaction.
+type StoreTx interface {
+	// Get decodes the value of key in bucket into v, reporting whether the
+	// key exists.
+	Get(bucket, key string, v interface{}) (bool, error)
+	// Put sets the value of key in bucket to the JSON encoding of v,
+	// creating the bucket if necessary.
+	Put(bucket, key string, v interface{}) error
+	// Delete removes key from bucket. It is not an error if the key does
+	// not exist.
+	Delete(bucket, key string) error
+	// ForEach calls fn on each key in bucket, in ascending order, along
+	// with a function that decodes its value.
+	ForEach(bucket string, fn func(key string, decode func(v interface{}) error) error) error
+}
+
+// errEmptyKey is returned when attempting to store a value under an empty key.
+var errEmptyKey = errors.New("store keys must be non-empty")
+
+type boltStore struct {
+	db *bbolt.DB
+}
+
+type boltTx struct {
+	tx *bbolt.Tx
+}
+
+func (s boltStore) View(fn func(tx StoreTx) error) error {
+	return s.db.View(func(tx *bbolt.Tx) error { return fn(boltTx{tx}) })
+}
+
+func (s boltStore) Update(fn func(tx StoreTx) error) error {
+	return s.db.Update(func(tx *bbolt.Tx) error { return fn(boltTx{tx}) })
+}
+
+func (s boltStore) Close() error {
+	return s.db.Close()
+}
+
+func (tx boltTx) Get(bucket, key string, v interface{}) (bool, error) {
+	b := tx.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return false, nil
+	}
+	js := b.Get([]byte(key))
+	if js == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(js, v)
+}
+
+func (tx boltTx) Put(bucket, key string, v interface{}) error {
+	if key == "" {
+		return errEmptyKey
+	}
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b, err := tx.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), js)
+}
+
+func (tx boltTx) Delete(bucket, key string) error {
+	b := tx.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.Delete([]byte(key))
+}
+
+func (tx boltTx) ForEach(bucket string, fn func(key string, decode func(v interface{}) error) error) error {
+	b := tx.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(k, js []byte) error {
+		return fn(string(k), func(v interface{}) error { return json.Unmarshal(js, v) })
+	})
+}
+
+// OpenBoltStore opens the bbolt database at path, creating it if it does not
+// exist. The database is checked for consistency before it is returned.
+func OpenBoltStore(path string) (Store, error) {
+	db, err := bbolt.Open(path, 0660, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		for err := range tx.Check() {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return boltStore{db}, nil
+}
+
+// memStore is an in-memory Store.
+type memStore struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+type memTx struct {
+	buckets  map[string]map[string][]byte
+	writable bool
+	undo     []memUndo
+}
+
+// A memUndo records the value of a key before it was written, so that the
+// write can be undone.
+type memUndo struct {
+	bucket, key string
+	v           []byte
+	existed     bool
+}
+
+// record records the current value of key, before it is written.
+func (tx *memTx) record(bucket, key string) {
+	v, ok := tx.buckets[bucket][key]
+	tx.undo = append(tx.undo, memUndo{bucket, key, v, ok})
+}
+
+// rollback undoes every write made by tx, most recent first.
+func (tx *memTx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		u := tx.undo[i]
+		if u.existed {
+			tx.buckets[u.bucket][u.key] = u.v
+		} else {
+			delete(tx.buckets[u.bucket], u.key)
+		}
+	}
+}
+
+func (s *memStore) View(fn func(tx StoreTx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return fn(&memTx{buckets: s.buckets})
+}
+
+func (s *memStore) Update(fn func(tx StoreTx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// write in place, undoing the writes if the transaction fails
+	tx := &memTx{buckets: s.buckets, writable: true}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.rollback()
+		}
+	}()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+func (s *memStore) Close() error { return nil }
+
+func (tx *memTx) Get(bucket, key string, v interface{}) (bool, error) {
+	js, ok := tx.buckets[bucket][key]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(js, v)
+}
+
+func (tx *memTx) Put(bucket, key string, v interface{}) error {
+	if !tx.writable {
+		return bbolt.ErrTxNotWritable
+	} else if key == "" {
+		return errEmptyKey
+	}
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if tx.buckets[bucket] == nil {
+		tx.buckets[bucket] = make(map[string][]byte)
+	}
+	tx.record(bucket, key)
+	tx.buckets[bucket][key] = js
+	return nil
+}
+
+func (tx *memTx) Delete(bucket, key string) error {
+	if !tx.writable {
+		return bbolt.ErrTxNotWritable
+	} else if _, ok := tx.buckets[bucket][key]; !ok {
+		return nil
+	}
+	tx.record(bucket, key)
+	delete(tx.buckets[bucket], key)
+	return nil
+}
+
+func (tx *memTx) ForEach(bucket string, fn func(key string, decode func(v interface{}) error) error) error {
+	b := tx.buckets[bucket]
+	keys := make([]string, 0, len(b))
+	for k := range b {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		js := b[k]
+		if err := fn(k, func(v interface{}) error { return json.Unmarshal(js, v) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewMemStore returns a Store that keeps its state in memory.
+func NewMemStore() Store {
+	return &memStore{buckets: make(map[string]map[string][]byte)}
+}
@@ -0,0 +1,415 @@
+package muse
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"go.sia.tech/siad/modules"
+	"go.sia.tech/siad/types"
+	"lukechampine.com/us/hostdb"
+)
+
+// validTenantName matches valid tenant names.
+var validTenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// defaultTenantKey is the store key of the default tenant. It is not a valid
+// tenant name.
+const defaultTenantKey = "_default"
+
+// A contractRecord is the server's record of a contract that it formed or
+// renewed.
+type contractRecord struct {
+	HostKey     hostdb.HostPublicKey `json:"hostKey"`
+	ID          types.FileContractID `json:"id"`
+	RenterKey   ed25519.PrivateKey   `json:"renterKey"`
+	HostAddress modules.NetAddress   `json:"hostAddress"`
+	EndHeight   types.BlockHeight    `json:"endHeight"`
+	Renewed     bool                 `json:"renewed"`
+	Warned      bool                 `json:"warned"`
+}
+
+// tenantConfig is the persisted configuration of a tenant. Tokens are stored
+// as hashes.
+type tenantConfig struct {
+	Budget      types.Currency `json:"budget"`
+	Spent       types.Currency `json:"spent"`
+	TokenHashes []string       `json:"tokenHashes"`
+}
+
+// A tenant is an isolated namespace of host sets and contracts. The default
+// tenant, whose name is empty, serves the unprefixed routes and cannot be
+// configured.
+type tenant struct {
+	name      string
+	store     Store
+	config    tenantConfig
+	hostSets  map[string][]hostdb.HostPublicKey
+	contracts map[types.FileContractID]*contractRecord
+
+	// latest revision of each host set; see setHostSet
+	hostSetVersions map[string]uint64
+	hostSetMeta     map[string]HostSetMetadata
+	hostSetRules    map[string]HostSetRules
+	hostSetExprs    map[string]string
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// hasToken reports whether req carries a bearer token whose hash is one of
+// hashes.
+func hasToken(req *http.Request, hashes ...string) bool {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	h := hashToken(token)
+	for _, th := range hashes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(th)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// authorized reports whether req carries one of the tenant's tokens. Tenants
+// without tokens accept all requests.
+func (t *tenant) authorized(req *http.Request) bool {
+	return len(t.config.TokenHashes) == 0 || hasToken(req, t.config.TokenHashes...)
+}
+
+// isAdmin reports whether req carries the server's admin token.
+func (s *server) isAdmin(req *http.Request) bool {
+	return s.adminToken != "" && hasToken(req, s.adminToken)
+}
+
+func (t *tenant) info() TenantInfo {
+	return TenantInfo{
+		Name:   t.name,
+		Budget: t.config.Budget,
+		Spent:  t.config.Spent,
+	}
+}
+
+// key returns the tenant's key in the "tenants" bucket.
+func (t *tenant) key() string {
+	if t.name == "" {
+		return defaultTenantKey
+	}
+	return t.name
+}
+
+// bucket returns the name of one of the tenant's store buckets.
+func (t *tenant) bucket(kind string) string {
+	return kind + "/" + t.key()
+}
+
+// saveContracts persists the records of the specified contracts.
+func (t *tenant) saveContracts(ids ...types.FileContractID) error {
+	return t.store.Update(func(tx StoreTx) error {
+		for _, id := range ids {
+			if r, ok := t.contracts[id]; ok {
+				if err := tx.Put(t.bucket("contracts"), id.String(), r); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// deleteContract removes the record of the specified contract.
+func (t *tenant) deleteContract(id types.FileContractID) error {
+	err := t.store.Update(func(tx StoreTx) error {
+		return tx.Delete(t.bucket("contracts"), id.String())
+	})
+	if err == nil {
+		delete(t.contracts, id)
+	}
+	return err
+}
+
+func (t *tenant) saveConfig() error {
+	return t.store.Update(func(tx StoreTx) error {
+		return tx.Put("tenants", t.key(), t.config)
+	})
+}
+
+func newTenant(name string, store Store) *tenant {
+	return &tenant{
+		name:      name,
+		store:     store,
+		hostSets:  make(map[string][]hostdb.HostPublicKey),
+		contracts: make(map[types.FileContractID]*contractRecord),
+
+		hostSetVersions: make(map[string]uint64),
+		hostSetMeta:     make(map[string]HostSetMetadata),
+		hostSetRules:    make(map[string]HostSetRules),
+		hostSetExprs:    make(map[string]string),
+	}
+}
+
+func loadTenant(tx StoreTx, store Store, name string) (*tenant, error) {
+	t := newTenant(name, store)
+	if _, err := tx.Get("tenants", t.key(), &t.config); err != nil {
+		return nil, err
+	}
+	err := tx.ForEach(t.bucket("hostSets"), func(name string, decode func(interface{}) error) error {
+		var set []hostdb.HostPublicKey
+		err := decode(&set)
+		t.hostSets[name] = set
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = tx.ForEach(t.bucket("hostSetVersions"), func(name string, decode func(interface{}) error) error {
+		var v uint64
+		err := decode(&v)
+		t.hostSetVersions[name] = v
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = tx.ForEach(t.bucket("hostSetMeta"), func(name string, decode func(interface{}) error) error {
+		var md HostSetMetadata
+		err := decode(&md)
+		t.hostSetMeta[name] = md
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = tx.ForEach(t.bucket("hostSetRules"), func(name string, decode func(interface{}) error) error {
+		var rules HostSetRules
+		err := decode(&rules)
+		t.hostSetRules[name] = rules
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = tx.ForEach(t.bucket("hostSetExprs"), func(name string, decode func(interface{}) error) error {
+		var expr string
+		err := decode(&expr)
+		t.hostSetExprs[name] = expr
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = tx.ForEach(t.bucket("contracts"), func(_ string, decode func(interface{}) error) error {
+		r := new(contractRecord)
+		err := decode(r)
+		t.contracts[r.ID] = r
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// loadTenants loads all tenants from store, including the default tenant.
+func loadTenants(store Store) (tenants map[string]*tenant, err error) {
+	err = store.View(func(tx StoreTx) error {
+		def, err := loadTenant(tx, store, "")
+		if err != nil {
+			return err
+		}
+		tenants = map[string]*tenant{"": def}
+		return tx.ForEach("tenants", func(name string, _ func(interface{}) error) error {
+			if name == defaultTenantKey {
+				return nil
+			}
+			t, err := loadTenant(tx, store, name)
+			if err != nil {
+				return fmt.Errorf("could not load tenant %q: %w", name, err)
+			}
+			tenants[name] = t
+			return nil
+		})
+	})
+	return
+}
+
+// admin returns a handler that requires requests to carry the server's admin
+// token, if it has one, before calling h.
+func (s *server) admin(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if s.adminToken != "" && !s.isAdmin(req) {
+			writeError(w, CodeUnauthorized, errors.New("Invalid or missing admin token"))
+			return
+		}
+		h(w, req, ps)
+	}
+}
+
+// tenant returns the tenant named in ps, or the default tenant if ps does not
+// name a tenant. If the tenant does not exist, or req is not authorized to
+// access it, an error is written to w and tenant returns nil.
+//
+// The admin token grants access to every tenant. The default tenant cannot
+// have tokens of its own; if the server has an admin token, the default tenant
+// requires it.
+func (s *server) tenant(w http.ResponseWriter, req *http.Request, ps httprouter.Params) *tenant {
+	s.mu.Lock()
+	t, ok := s.tenants[ps.ByName("tenant")]
+	authorized := ok && (s.isAdmin(req) || (t.name == "" && s.adminToken == "") || (t.name != "" && t.authorized(req)))
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, CodeUnknownTenant, errors.New("No record of that tenant"))
+		return nil
+	} else if !authorized {
+		writeError(w, CodeUnauthorized, errors.New("Invalid or missing tenant token"))
+		return nil
+	}
+	return t
+}
+
+// reserveFunds adds funds to the tenant's lifetime spending, failing if this
+// would exceed its budget.
+func (s *server) reserveFunds(t *tenant, funds types.Currency) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b := t.config.Budget; !b.IsZero() && t.config.Spent.Add(funds).Cmp(b) > 0 {
+		return Error{
+			Code:    CodeBudgetExceeded,
+			Message: fmt.Sprintf("tenant has %v H of its %v H budget remaining", b.Sub(t.config.Spent), b),
+		}
+	}
+	t.config.Spent = t.config.Spent.Add(funds)
+	if err := t.saveConfig(); err != nil {
+		t.config.Spent = t.config.Spent.Sub(funds)
+		return err
+	}
+	return nil
+}
+
+// releaseFunds undoes a call to reserveFunds.
+func (s *server) releaseFunds(t *tenant, funds types.Currency) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.config.Spent = t.config.Spent.Sub(funds)
+	return t.saveConfig()
+}
+
+// trackContract records a newly formed or renewed contract, marking the
+// contract it was renewed from (if any) as renewed.
+func (s *server) trackContract(t *tenant, c Contract, renewedFrom types.FileContractID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.contracts[c.ID] = &contractRecord{
+		HostKey:     c.HostKey,
+		ID:          c.ID,
+		RenterKey:   c.RenterKey,
+		HostAddress: c.HostAddress,
+		EndHeight:   c.EndHeight,
+	}
+	if old, ok := t.contracts[renewedFrom]; ok {
+		old.Renewed = true
+	}
+	return t.saveContracts(c.ID, renewedFrom)
+}
+
+func (s *server) handleTenants(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.tenants))
+	for name := range s.tenants {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(names)
+	writeJSON(w, names)
+}
+
+func (s *server) handleTenantGET(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
+		return
+	}
+	s.mu.Lock()
+	info := t.info()
+	s.mu.Unlock()
+	writeJSON(w, info)
+}
+
+// setTenant creates or updates the named tenant. If tc.Tokens is nil, the
+// tenant's existing tokens are kept.
+func (s *server) setTenant(name string, tc TenantConfig) (TenantInfo, error) {
+	if !validTenantName.MatchString(name) {
+		return TenantInfo{}, Error{Code: CodeBadRequest, Message: "Tenant names must consist of lowercase letters, digits, '-', and '_'"}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tenants[name]
+	if !ok {
+		t = newTenant(name, s.store)
+		s.tenants[name] = t
+	}
+	t.config.Budget = tc.Budget
+	if tc.Tokens != nil {
+		t.config.TokenHashes = t.config.TokenHashes[:0]
+		for _, token := range tc.Tokens {
+			t.config.TokenHashes = append(t.config.TokenHashes, hashToken(token))
+		}
+	}
+	if err := t.saveConfig(); err != nil {
+		return TenantInfo{}, err
+	}
+	return t.info(), nil
+}
+
+// runTenantConfigs applies each set of tenant configurations received from
+// s.tenantConfigs.
+func (s *server) runTenantConfigs() {
+	for tenants := range s.tenantConfigs {
+		for name, tc := range tenants {
+			if _, err := s.setTenant(name, tc); err != nil {
+				log.Printf("WARN: could not configure tenant %q: %v", name, err)
+			}
+		}
+	}
+}
+
+// WithTenants causes the server to create or update the tenants in each map
+// received from tenants, as PUT /tenants/:tenant does. Unlike the API, this
+// does not require the server to have an admin token. Each map takes
+// precedence over earlier changes made via the API to the tenants it lists.
+func WithTenants(tenants <-chan map[string]TenantConfig) ServerOption {
+	return func(s *server) {
+		s.tenantConfigs = tenants
+	}
+}
+
+func (s *server) handleTenantPUT(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if s.adminToken == "" {
+		// otherwise, anyone could replace a tenant's tokens
+		writeError(w, CodeUnauthorized, errors.New("Tenants can only be configured if the server has an admin token"))
+		return
+	}
+	var tc TenantConfig
+	if err := json.NewDecoder(req.Body).Decode(&tc); err != nil {
+		writeError(w, CodeBadRequest, err)
+		return
+	}
+	info, err := s.setTenant(ps.ByName("tenant"), tc)
+	if err != nil {
+		writeError(w, CodeInternal, err)
+		return
+	}
+	writeJSON(w, info)
+}
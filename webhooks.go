@@ -0,0 +1,328 @@
+package muse
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"lukechampine.com/frand"
+)
+
+const (
+	// webhookMaxAttempts is the number of times a delivery is attempted
+	// before it is dropped.
+	webhookMaxAttempts = 20
+
+	// webhookMaxBackoff is the maximum delay between delivery attempts.
+	webhookMaxBackoff = time.Hour
+)
+
+// signWebhook returns the signature of a webhook request body.
+func signWebhook(secret string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// VerifyWebhook reports whether sig, the value of the Muse-Signature header of
+// a webhook request, is a valid signature of body under secret.
+func VerifyWebhook(secret string, body []byte, sig string) bool {
+	return hmac.Equal([]byte(signWebhook(secret, body)), []byte(sig))
+}
+
+// A webhookDelivery is a pending delivery of an event to a webhook.
+type webhookDelivery struct {
+	ID          string    `json:"id"`
+	WebhookID   string    `json:"webhookID"`
+	Event       Event     `json:"event"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+}
+
+// A webhookManager delivers events to webhooks. Webhooks and pending
+// deliveries are persisted, so that deliveries survive restarts.
+type webhookManager struct {
+	store  Store
+	client http.Client
+	wake   chan struct{}
+
+	mu    sync.Mutex
+	hooks map[string]Webhook
+	queue []webhookDelivery
+	busy  map[string]bool // webhooks with deliveries in progress
+}
+
+func (m *webhookManager) saveQueue(tx StoreTx) error {
+	return tx.Put("webhookQueue", "queue", m.queue)
+}
+
+// webhooks returns the webhooks of the named tenant, without their secrets.
+func (m *webhookManager) webhooks(tenant string) []Webhook {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hooks := make([]Webhook, 0, len(m.hooks))
+	for _, wh := range m.hooks {
+		if wh.Tenant == tenant {
+			wh.Secret = ""
+			hooks = append(hooks, wh)
+		}
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		return hooks[i].ID < hooks[j].ID
+	})
+	return hooks
+}
+
+func (m *webhookManager) addWebhook(wh Webhook) (Webhook, error) {
+	wh.ID = hex.EncodeToString(frand.Bytes(8))
+	if wh.Secret == "" {
+		wh.Secret = hex.EncodeToString(frand.Bytes(32))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hooks[wh.ID] = wh
+	return wh, m.store.Update(func(tx StoreTx) error {
+		return tx.Put("webhooks", wh.ID, wh)
+	})
+}
+
+// removeWebhook removes the specified webhook of the named tenant, reporting
+// whether it existed.
+func (m *webhookManager) removeWebhook(tenant, id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if wh, ok := m.hooks[id]; !ok || wh.Tenant != tenant {
+		return false, nil
+	}
+	delete(m.hooks, id)
+	queue := m.queue[:0]
+	for _, d := range m.queue {
+		if d.WebhookID != id {
+			queue = append(queue, d)
+		}
+	}
+	m.queue = queue
+	return true, m.store.Update(func(tx StoreTx) error {
+		if err := tx.Delete("webhooks", id); err != nil {
+			return err
+		}
+		return m.saveQueue(tx)
+	})
+}
+
+// enqueue queues e for delivery to each webhook of its tenant that is
+// subscribed to its type.
+func (m *webhookManager) enqueue(e Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var queued bool
+	for _, wh := range m.hooks {
+		if wh.Tenant != e.Tenant || !wh.wants(e.Type) {
+			continue
+		}
+		m.queue = append(m.queue, webhookDelivery{
+			ID:          hex.EncodeToString(frand.Bytes(8)),
+			WebhookID:   wh.ID,
+			Event:       e,
+			NextAttempt: time.Now(),
+		})
+		queued = true
+	}
+	if !queued {
+		return
+	}
+	if err := m.store.Update(m.saveQueue); err != nil {
+		log.Println("WARN: could not save webhook queue:", err)
+	}
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (wh Webhook) wants(t EventType) bool {
+	if len(wh.Events) == 0 {
+		return true
+	}
+	for _, et := range wh.Events {
+		if et == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *webhookManager) deliver(wh Webhook, d webhookDelivery) error {
+	body, _ := json.Marshal(d.Event)
+	req, err := http.NewRequest(http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Muse-Event", string(d.Event.Type))
+	req.Header.Set("Muse-Delivery", d.ID)
+	req.Header.Set("Muse-Signature", signWebhook(wh.Secret, body))
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %v", resp.Status)
+	}
+	return nil
+}
+
+// deliverDue starts attempting the deliveries whose NextAttempt has passed.
+// Each webhook is delivered to by its own goroutine, so that a slow endpoint
+// does not delay deliveries to the others; a webhook whose previous deliveries
+// are still in progress is skipped.
+func (m *webhookManager) deliverDue() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	due := make(map[string][]webhookDelivery)
+	for _, d := range m.queue {
+		if !m.busy[d.WebhookID] && !d.NextAttempt.After(time.Now()) {
+			due[d.WebhookID] = append(due[d.WebhookID], d)
+		}
+	}
+	for id, ds := range due {
+		if wh, ok := m.hooks[id]; ok {
+			m.busy[id] = true
+			go m.deliverAll(wh, ds)
+		}
+	}
+}
+
+// deliverAll attempts each delivery to wh in order, and then removes the
+// successful deliveries from the queue, rescheduling the others.
+func (m *webhookManager) deliverAll(wh Webhook, ds []webhookDelivery) {
+	results := make(map[string]error, len(ds))
+	for _, d := range ds {
+		results[d.ID] = m.deliver(wh, d)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.busy, wh.ID)
+	queue := m.queue[:0]
+	for _, d := range m.queue {
+		err, attempted := results[d.ID]
+		if !attempted {
+			queue = append(queue, d)
+			continue
+		} else if err == nil {
+			continue
+		}
+		d.Attempts++
+		if d.Attempts >= webhookMaxAttempts {
+			log.Printf("WARN: dropping webhook delivery %v after %v attempts: %v", d.ID, d.Attempts, err)
+			continue
+		}
+		backoff := time.Second << (d.Attempts - 1)
+		if backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+		d.NextAttempt = time.Now().Add(backoff)
+		queue = append(queue, d)
+	}
+	m.queue = queue
+	if err := m.store.Update(m.saveQueue); err != nil {
+		log.Println("WARN: could not save webhook queue:", err)
+	}
+}
+
+func (m *webhookManager) run() {
+	for {
+		m.deliverDue()
+		select {
+		case <-m.wake:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func newWebhookManager(store Store) (*webhookManager, error) {
+	m := &webhookManager{
+		store:  store,
+		client: http.Client{Timeout: 30 * time.Second},
+		wake:   make(chan struct{}, 1),
+		hooks:  make(map[string]Webhook),
+		busy:   make(map[string]bool),
+	}
+	err := store.View(func(tx StoreTx) error {
+		if _, err := tx.Get("webhookQueue", "queue", &m.queue); err != nil {
+			return err
+		}
+		return tx.ForEach("webhooks", func(id string, decode func(interface{}) error) error {
+			var wh Webhook
+			err := decode(&wh)
+			m.hooks[id] = wh
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (s *server) handleWebhooks(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
+		return
+	}
+	writeJSON(w, s.webhooks.webhooks(t.name))
+}
+
+func (s *server) handleWebhookAdd(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
+		return
+	}
+	var wh Webhook
+	if err := json.NewDecoder(req.Body).Decode(&wh); err != nil {
+		writeError(w, CodeBadRequest, err)
+		return
+	}
+	if u, err := url.Parse(wh.URL); err != nil {
+		writeError(w, CodeBadRequest, err)
+		return
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		writeError(w, CodeBadRequest, fmt.Errorf("unsupported URL scheme %q", u.Scheme))
+		return
+	}
+	wh.Tenant = t.name
+	wh, err := s.webhooks.addWebhook(wh)
+	if err != nil {
+		writeError(w, CodeInternal, err)
+		return
+	}
+	writeJSON(w, wh)
+}
+
+func (s *server) handleWebhookDelete(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	t := s.tenant(w, req, ps)
+	if t == nil {
+		return
+	}
+	if ok, err := s.webhooks.removeWebhook(t.name, ps.ByName("id")); err != nil {
+		writeError(w, CodeInternal, err)
+	} else if !ok {
+		writeError(w, CodeNotFound, errors.New("No record of that webhook"))
+	}
+}